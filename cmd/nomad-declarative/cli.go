@@ -0,0 +1,467 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Vaelatern/nomad-declarative/engine"
+	"github.com/Vaelatern/nomad-declarative/internal/submission"
+)
+
+// command is a word given first on the command line, like `render`.
+type command struct {
+	Name string
+	// Args are the positional arguments it takes, for its usage line
+	Args    string
+	Summary string
+	Help    string
+	// Flags are the flags it uses, beyond the global ones
+	Flags []string
+	Run   func(inv invocation) error
+}
+
+// globalFlags are taken by every command.
+var globalFlags = []string{"config", "output", "env", "target", "select", "log-level", "log-format", "metrics-file", "render-workers", "no-config-template"}
+
+var (
+	executeFlags = []string{"workers", "script-timeout", "timeout", "retries", "retry-backoff", "max-retry-backoff",
+		"report", "junit", "state", "prune", "manifest"}
+	serveFlags = append(slices.Clone(executeFlags), "interval", "max-sync-backoff", "listen", "webhook-secret-file", "webhook-mode")
+)
+
+// commands are listed in help in this order.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			Name:    "render",
+			Args:    "[config [output]]",
+			Summary: "render every selected job into the output dir",
+			Help: `Renders the templates of every selected job into <output>/<job>, or
+<output>/<target>/<job> for jobs with targets. Jobs that fail to render are
+logged and skipped.`,
+			Run: runRender,
+		},
+		{
+			Name:    "validate",
+			Args:    "[config]",
+			Summary: "check the config, templates and rendered outputs",
+			Help: `Reads the config, checks the dependency graph, renders every selected job
+into a temporary dir and checks that HCL, Kubernetes manifests and typed
+resources in it parse. Nothing is written to the output dir. Exits non-zero
+if anything is wrong.`,
+			Run: runValidate,
+		},
+		{
+			Name:    "plan",
+			Args:    "[config [output]]",
+			Summary: "render, then show what applying would change",
+			Help: `Renders, then prints what applying the typed resources would create (+),
+update (~) or prune (-). Pruning is only shown when nothing is deselected.`,
+			Flags: []string{"state"},
+			Run:   runPlan,
+		},
+		{
+			Name:    "apply",
+			Args:    "[config [output]]",
+			Summary: "render, then apply resources and run scripts",
+			Help: `Renders, then applies each job's typed resources and runs its scripts, in
+waves following _depends_on. Dependencies outside the selection are taken
+as already applied. The same as the old --execute.`,
+			Flags: executeFlags,
+			Run:   runApply,
+		},
+		{
+			Name:    "diff",
+			Args:    "[config [output]]",
+			Summary: "show how rendering would change the output dir",
+			Help: `Renders every selected job into a temporary dir and prints a unified diff
+from what is in the output dir now. The output dir is left alone.`,
+			Flags: []string{"exit-code"},
+			Run:   runDiff,
+		},
+		{
+			Name:    "prune",
+			Args:    "[config [output]]",
+			Summary: "delete applied resources that are no longer declared",
+			Help: `Renders, then deletes every resource remembered in the state file that no
+job declares any more. Refuses to run with a selection, as resources of
+jobs left out would look undeclared.`,
+			Flags: []string{"state"},
+			Run:   runPrune,
+		},
+		{
+			Name:    "list",
+			Args:    "[config]",
+			Summary: "list the selected deployments",
+			Help: `Prints every selected deployment with its pack, target, origin and dependencies.
+The jobs are rendered in memory to find those their templates read.`,
+			Run: runList,
+		},
+		{
+			Name:    "show",
+			Args:    "<job>...",
+			Summary: "show the settings and rendered files of jobs",
+			Help: `Prints the settings of each named deployment, or every deployment of a
+named job, then renders it into a temporary dir and prints its files.`,
+			Run: runShow,
+		},
+		{
+			Name:    "test",
+			Args:    "[pack dir]...",
+			Summary: "render the test cases of packs and compare with their goldens",
+			Help: `Renders each tests/<case>.toml of the packs given, or of every pack in
+./packs with tests, as a job named after the case, and compares the files
+with those in tests/<case>/. With --update the goldens are written instead.
+Exits non-zero if any case fails.`,
+			Flags: []string{"update"},
+			Run:   runTest,
+		},
+		{
+			Name:    "keygen",
+			Summary: "print a new age identity for encrypting config",
+			Help: `Prints a new age identity, with its public key as a comment, as age-keygen
+does. Give it to the other commands in NOMAD_DECLARATIVE_AGE_KEY, or in the
+file NOMAD_DECLARATIVE_AGE_KEY_FILE names.`,
+			Run: runKeygen,
+		},
+		{
+			Name:    "encrypt",
+			Args:    "<file [key] | ->",
+			Summary: "encrypt a config value or file",
+			Help: `With a file, encrypts the whole file in place as an armored age file. With a
+file and a dotted key like pack.job.password, sets that key in the file to
+the value on stdin, encrypted, leaving the rest of the file as it is. With
+-, prints the value on stdin as ENC[age,...] to paste into a config.
+
+Everything is encrypted to the recipients in NOMAD_DECLARATIVE_AGE_RECIPIENTS,
+or to those of the identities.`,
+			Run: runEncrypt,
+		},
+		{
+			Name:    "decrypt",
+			Args:    "<file | ->",
+			Summary: "print a decrypted config value or file",
+			Help: `With a file, prints the plaintext of the encrypted file. With -, decrypts
+the ENC[age,...] value on stdin. Nothing is written.`,
+			Run: runDecrypt,
+		},
+		{
+			Name:    "edit",
+			Args:    "<file>",
+			Summary: "edit an encrypted config file",
+			Help: `Opens the plaintext of an encrypted file in $EDITOR, then encrypts it again
+in place if it was changed and still parses.`,
+			Run: runEdit,
+		},
+		{
+			Name:    "graph",
+			Args:    "[config]",
+			Summary: "print the dependency graph in Graphviz DOT format",
+			Help: `Prints the dependencies between the selected deployments, from _depends_on
+and from the jobs their templates read, which are rendered in memory to find
+them.`,
+			Run: runGraph,
+		},
+		{
+			Name:    "serve",
+			Args:    "[config [output]]",
+			Summary: "keep the clusters converged on the config",
+			Help: `Renders and applies what changed every --interval, and straight away when
+the local config or packs change. Serves /status, /healthz and /metrics on
+--listen, and push webhooks on /webhook with --webhook-secret-file.`,
+			Flags: serveFlags,
+			Run:   runServe,
+		},
+		{
+			Name:    "help",
+			Args:    "[command]",
+			Summary: "show help for a command",
+			Run:     runHelp,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// invocation is what the command line asks for.
+type invocation struct {
+	Command *command
+	// ConfFile is empty for the default, config.toml or config.d
+	ConfFile string
+	OutPath  string
+	// Args are the positional arguments left for the command
+	Args     []string
+	Settings execSettings
+	// ExitCode asks diff to exit non-zero when there are differences
+	ExitCode bool
+	// Update asks test to write the goldens
+	Update bool
+}
+
+// listFlag is a flag that may be given many times, or once with values
+// separated by commas.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// selection narrows the deployments a command works on. An empty selection
+// takes them all.
+type selection struct {
+	Targets  []string
+	Patterns []string
+}
+
+func (s selection) empty() bool {
+	return len(s.Targets) == 0 && len(s.Patterns) == 0
+}
+
+// match reports if d is on one of the targets, and if its deployment, job or
+// pack name matches one of the patterns.
+func (s selection) match(d engine.Deployment) bool {
+	if len(s.Targets) > 0 && !slices.Contains(s.Targets, d.Target.Name) {
+		return false
+	}
+	if len(s.Patterns) == 0 {
+		return true
+	}
+	for _, p := range s.Patterns {
+		for _, name := range []string{d.Name(), d.Job.JobName, d.Pack()} {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseCommandLine reads the flags and the command word, which may come in
+// any order. Without a command word the old form is followed: `[config
+// [output]]`, rendering, or applying with --execute.
+func parseCommandLine(fs *flag.FlagSet, args []string) (invocation, error) {
+	doExec := fs.Bool("execute", false, "self execute - run all scripts produced. Set your NOMAD_ADDR correctly first. The same as the apply command.")
+	workers := fs.Int("workers", runtime.NumCPU(), "how many scripts to run at once when executing, 0 for no limit")
+	renderWorkers := fs.Int("render-workers", runtime.NumCPU(), "how many jobs to render at once")
+	noConfigTemplate := fs.Bool("no-config-template", false, "read config files as written, without templating them")
+	scriptTimeout := fs.Duration("script-timeout", 0, "kill a single script after this long, 0 for no limit")
+	timeout := fs.Duration("timeout", 0, "give up on the whole execution after this long, 0 for no limit")
+	retries := fs.Int("retries", 0, "run a script that failed in a retryable way up to this many more times, jobs can override with _retries")
+	retryBackoff := fs.Duration("retry-backoff", time.Second, "wait before the first retry, doubling each time")
+	maxRetryBackoff := fs.Duration("max-retry-backoff", 30*time.Second, "longest wait between retries")
+	reportPath := fs.String("report", "", "write a JSON report of the execution to this file")
+	junitPath := fs.String("junit", "", "write a JUnit XML report of the execution to this file")
+	statePath := fs.String("state", ".nomad-declarative-state.json", "file remembering which resources were applied, so they can be pruned")
+	prune := fs.Bool("prune", false, "when executing, delete applied resources that are no longer declared")
+	manifestPath := fs.String("manifest", ".nomad-declarative-applied.json", "file recording what was last applied for each job")
+	interval := fs.Duration("interval", time.Minute, "how often to re-render and apply what changed")
+	maxBackoff := fs.Duration("max-sync-backoff", 10*time.Minute, "longest wait between syncs while they keep failing")
+	listen := fs.String("listen", "127.0.0.1:8080", "address of the status endpoint, empty for none")
+	webhookSecretFile := fs.String("webhook-secret-file", "", "take push webhooks on /webhook signed with the secret in this file")
+	webhookMode := fs.String("webhook-mode", "plan", "what a push does: plan or apply, which ?mode=plan can lower for one hook")
+	metricsPath := fs.String("metrics-file", "", "write Prometheus metrics to this file, for node_exporter's textfile collector")
+	logLevel := fs.String("log-level", "info", "least important events to log: debug, info, warn or error")
+	logFormat := fs.String("log-format", "text", "how to write log events: text or json")
+	configPtr := fs.String("config", "", "path to config file or dir, config.toml or config.d by default")
+	outputPtr := fs.String("output", "", "dir to output under, ./output by default")
+	exitCode := fs.Bool("exit-code", false, "exit with 1 when there are differences")
+	update := fs.Bool("update", false, "write the goldens from what is rendered")
+	var env, targets, patterns listFlag
+	fs.Var(&env, "env", "KEY=VALUE to add to the environment, may be repeated; target and job _env win")
+	fs.Var(&targets, "target", "only work on deployments to this target, may be repeated")
+	fs.Var(&patterns, "select", "only work on deployments whose name, job or pack matches this glob, may be repeated")
+
+	// Flags may come before and after the command word and its arguments,
+	// so parsing goes on past each positional argument
+	var positional []string
+	fs.Usage = func() {
+		if len(positional) > 0 {
+			if c := findCommand(positional[0]); c != nil {
+				commandUsage(fs.Output(), fs, c)
+				return
+			}
+		}
+		usage(fs.Output(), fs)
+	}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return invocation{}, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	inv := invocation{ExitCode: *exitCode, Update: *update}
+	if len(positional) > 0 {
+		inv.Command = findCommand(positional[0])
+	}
+	if inv.Command != nil {
+		positional = positional[1:]
+	} else if *doExec {
+		inv.Command = findCommand("apply")
+	} else {
+		inv.Command = findCommand("render")
+	}
+
+	l, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		return inv, err
+	}
+	logger = l
+	slog.SetDefault(logger)
+
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return inv, fmt.Errorf("bad -select pattern %q: %v", p, err)
+		}
+	}
+	for _, kv := range env {
+		key, val, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return inv, fmt.Errorf("-env takes KEY=VALUE, not %q", kv)
+		}
+		// Scripts and API clients start from the process environment, with
+		// target and job settings on top
+		os.Setenv(key, val)
+	}
+
+	// Commands working on jobs take them as arguments, the others may still
+	// be given the config and output dir the old way
+	if slices.Contains([]string{"show", "help", "test", "keygen", "encrypt", "decrypt", "edit"}, inv.Command.Name) {
+		inv.Args = positional
+	} else {
+		if *configPtr == "" && len(positional) > 0 {
+			*configPtr, positional = positional[0], positional[1:]
+		}
+		if *outputPtr == "" && len(positional) > 0 {
+			*outputPtr, positional = positional[0], positional[1:]
+		}
+		if len(positional) > 0 {
+			return inv, fmt.Errorf("%s: unexpected arguments %s", inv.Command.Name, strings.Join(positional, " "))
+		}
+	}
+	inv.ConfFile = *configPtr
+	inv.OutPath = *outputPtr
+	if inv.OutPath == "" {
+		inv.OutPath = "./output"
+	}
+
+	inv.Settings = execSettings{
+		Options: submission.Options{
+			Workers:         *workers,
+			ScriptTimeout:   *scriptTimeout,
+			Output:          os.Stdout,
+			Logger:          logger,
+			Retries:         *retries,
+			RetryBackoff:    *retryBackoff,
+			MaxRetryBackoff: *maxRetryBackoff,
+		},
+		Timeout:    *timeout,
+		ReportPath: *reportPath,
+		JUnitPath:  *junitPath,
+		StatePath:  *statePath,
+		Prune:      *prune,
+
+		ManifestPath: *manifestPath,
+		Interval:     *interval,
+		MaxBackoff:   *maxBackoff,
+		Listen:       *listen,
+
+		WebhookSecretFile: *webhookSecretFile,
+		WebhookMode:       *webhookMode,
+
+		MetricsPath:   *metricsPath,
+		Select:        selection{Targets: targets, Patterns: patterns},
+		RenderWorkers: *renderWorkers,
+
+		NoConfigTemplate: *noConfigTemplate,
+	}
+	if *logFormat == "json" {
+		// Script output becomes log events too, so every line is indexed
+		inv.Settings.Options.Output = nil
+	}
+	return inv, nil
+}
+
+// usage prints what every command is for.
+func usage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: nomad-declarative <command> [flags] [args]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.Name, c.Summary)
+	}
+	fmt.Fprintf(w, "\nWithout a command, `nomad-declarative [config [output]]` renders, and\napplies with --execute.\n")
+	fmt.Fprintf(w, "\nGlobal flags:\n")
+	printFlags(w, fs, globalFlags)
+	fmt.Fprintf(w, "\nRun `nomad-declarative help <command>` for more.\n")
+}
+
+// commandUsage prints the help of one command and the flags it takes.
+func commandUsage(w io.Writer, fs *flag.FlagSet, c *command) {
+	fmt.Fprintf(w, "Usage: nomad-declarative %s [flags] %s\n\n%s.\n", c.Name, c.Args, strings.ToUpper(c.Summary[:1])+c.Summary[1:])
+	if c.Help != "" {
+		fmt.Fprintf(w, "\n%s\n", c.Help)
+	}
+	if len(c.Flags) > 0 {
+		fmt.Fprintf(w, "\nFlags:\n")
+		printFlags(w, fs, c.Flags)
+	}
+	fmt.Fprintf(w, "\nGlobal flags:\n")
+	printFlags(w, fs, globalFlags)
+}
+
+func printFlags(w io.Writer, fs *flag.FlagSet, names []string) {
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		fmt.Fprintf(w, "  -%s", f.Name)
+		if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" && f.DefValue != "0s" {
+			fmt.Fprintf(w, " (default %s)", f.DefValue)
+		}
+		fmt.Fprintf(w, "\n      %s\n", f.Usage)
+	}
+}
+
+func runHelp(inv invocation) error {
+	if len(inv.Args) == 0 {
+		usage(os.Stdout, flag.CommandLine)
+		return nil
+	}
+	c := findCommand(inv.Args[0])
+	if c == nil {
+		return fmt.Errorf("no command %s", inv.Args[0])
+	}
+	commandUsage(os.Stdout, flag.CommandLine, c)
+	return nil
+}
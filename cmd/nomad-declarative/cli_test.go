@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/Vaelatern/nomad-declarative/engine"
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	cases := []struct {
+		args    []string
+		command string
+		conf    string
+		out     string
+		rest    []string
+		check   func(invocation) bool
+	}{
+		{args: nil, command: "render", out: "./output"},
+		{args: []string{"c.toml"}, command: "render", conf: "c.toml", out: "./output"},
+		{args: []string{"c.toml", "out"}, command: "render", conf: "c.toml", out: "out"},
+		{args: []string{"-execute", "c.toml", "out"}, command: "apply", conf: "c.toml", out: "out"},
+		{args: []string{"c.toml", "out", "--execute"}, command: "apply", conf: "c.toml", out: "out"},
+		{args: []string{"c.toml", "-prune", "out", "-execute"}, command: "apply", conf: "c.toml", out: "out",
+			check: func(inv invocation) bool { return inv.Settings.Prune }},
+		{args: []string{"--config", "c.toml", "out"}, command: "render", conf: "c.toml", out: "out"},
+		{args: []string{"--output=out", "c.toml"}, command: "render", conf: "c.toml", out: "out"},
+		{args: []string{"apply", "c.toml", "-workers", "3"}, command: "apply", conf: "c.toml", out: "./output",
+			check: func(inv invocation) bool { return inv.Settings.Options.Workers == 3 }},
+		{args: []string{"-exit-code", "diff", "--config=c.toml"}, command: "diff", conf: "c.toml", out: "./output",
+			check: func(inv invocation) bool { return inv.ExitCode }},
+		{args: []string{"show", "web", "-target", "east,west", "db"}, command: "show", out: "./output", rest: []string{"web", "db"},
+			check: func(inv invocation) bool { return slices.Equal(inv.Settings.Select.Targets, []string{"east", "west"}) }},
+	}
+	for _, c := range cases {
+		fs := flag.NewFlagSet("nomad-declarative", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		inv, err := parseCommandLine(fs, c.args)
+		if err != nil {
+			t.Errorf("%q: %v", c.args, err)
+			continue
+		}
+		if inv.Command.Name != c.command || inv.ConfFile != c.conf || inv.OutPath != c.out || !slices.Equal(inv.Args, c.rest) {
+			t.Errorf("%q gave %s config=%q output=%q args=%q, want %s config=%q output=%q args=%q",
+				c.args, inv.Command.Name, inv.ConfFile, inv.OutPath, inv.Args, c.command, c.conf, c.out, c.rest)
+		}
+		if c.check != nil && !c.check(inv) {
+			t.Errorf("%q: flags not taken: %+v", c.args, inv.Settings)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"c.toml", "out", "extra"},
+		{"render", "-select", "["},
+		{"-env", "NOVALUE"},
+		{"-no-such-flag"},
+	} {
+		fs := flag.NewFlagSet("nomad-declarative", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		if _, err := parseCommandLine(fs, args); err == nil {
+			t.Errorf("%q was taken", args)
+		}
+	}
+}
+
+func TestSelectionMatch(t *testing.T) {
+	deploy := func(pack, job, target string) engine.Deployment {
+		return engine.Deployment{
+			Job:    engine.Job{JobName: job, Pack: confparse.PackSettings{"name": pack}},
+			Target: engine.Target{Name: target},
+		}
+	}
+	web := deploy("frontends", "web", "east")
+	db := deploy("databases", "postgres", "")
+	cases := []struct {
+		sel  selection
+		want []bool // web, db
+	}{
+		{selection{}, []bool{true, true}},
+		{selection{Targets: []string{"east"}}, []bool{true, false}},
+		{selection{Targets: []string{"west"}}, []bool{false, false}},
+		{selection{Patterns: []string{"east/*"}}, []bool{true, false}},
+		{selection{Patterns: []string{"post*"}}, []bool{false, true}},
+		{selection{Patterns: []string{"databases"}}, []bool{false, true}},
+		{selection{Patterns: []string{"web", "postgres"}}, []bool{true, true}},
+		{selection{Targets: []string{"east"}, Patterns: []string{"postgres"}}, []bool{false, false}},
+	}
+	for _, c := range cases {
+		got := []bool{c.sel.match(web), c.sel.match(db)}
+		if !slices.Equal(got, c.want) {
+			t.Errorf("%+v matched web, postgres = %v, want %v", c.sel, got, c.want)
+		}
+	}
+}
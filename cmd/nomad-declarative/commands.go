@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hclparse"
+
+	"github.com/Vaelatern/nomad-declarative/engine"
+	"github.com/Vaelatern/nomad-declarative/internal/kube"
+	"github.com/Vaelatern/nomad-declarative/internal/origins"
+	"github.com/Vaelatern/nomad-declarative/internal/reconcile"
+	"github.com/Vaelatern/nomad-declarative/internal/resources"
+	"github.com/Vaelatern/nomad-declarative/internal/submission"
+	"github.com/Vaelatern/nomad-declarative/internal/textdiff"
+)
+
+// workspace is what most commands start from: the config, and the
+// deployments selected from it with their dependency graph.
+type workspace struct {
+	conf engine.Config
+	// all are every deployment of the config, which templates may read
+	all     []engine.Deployment
+	deploys []engine.Deployment
+	graph   engine.Graph
+}
+
+func loadWorkspace(inv invocation) (workspace, error) {
+	var ws workspace
+	conf, err := loadConfig(inv.ConfFile, inv.Settings)
+	if err != nil {
+		return ws, fmt.Errorf("Can't open and process config %v", err)
+	}
+	ws.conf = conf
+	ws.all, ws.deploys, ws.graph, err = selectedDeployments(conf, inv.Settings.Select)
+	if err != nil {
+		return ws, err
+	}
+	logger.Debug("Read config", "file", inv.ConfFile, "deployments", len(ws.deploys))
+	return ws, nil
+}
+
+// selectedDeployments expands the config into all its deployments, and
+// those sel picks with their dependency graph. Dependencies left out are
+// dropped from the graph.
+func selectedDeployments(conf engine.Config, sel selection) ([]engine.Deployment, []engine.Deployment, engine.Graph, error) {
+	deploys, err := engine.Deployments(conf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if sel.empty() {
+		return deploys, deploys, engine.DependencyGraph(deploys), nil
+	}
+	var kept []engine.Deployment
+	for _, d := range deploys {
+		if sel.match(d) {
+			kept = append(kept, d)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, nil, nil, fmt.Errorf("no deployment is selected")
+	}
+	return deploys, kept, engine.DependencyGraph(kept), nil
+}
+
+// prepare renders the workspace into the output dir, and gives an engine
+// to apply it with, holding the state.
+func prepare(inv invocation, ws workspace) (*engine.Engine, engine.Rendered, error) {
+	settings := inv.Settings
+	state, err := engine.LoadState(settings.StatePath)
+	if err != nil {
+		return nil, engine.Rendered{}, fmt.Errorf("Can't read state %s: %v", settings.StatePath, err)
+	}
+	e := newEngine(settings, engine.Dir(inv.OutPath), state)
+	// Render failures are logged, and failed again by Apply, Plan and Prune
+	// so the rest still goes ahead
+	rendered, _ := e.RenderSelected(context.Background(), ws.all, ws.deploys)
+	writeMetrics(settings.MetricsPath)
+	return e, rendered, nil
+}
+
+func runRender(inv invocation) error {
+	ws, err := loadWorkspace(inv)
+	if err != nil {
+		return err
+	}
+	_, err = newEngine(inv.Settings, engine.Dir(inv.OutPath), nil).RenderSelected(context.Background(), ws.all, ws.deploys)
+	writeMetrics(inv.Settings.MetricsPath)
+	return err
+}
+
+func runPlan(inv invocation) error {
+	ws, err := loadWorkspace(inv)
+	if err != nil {
+		return err
+	}
+	e, rendered, err := prepare(inv, ws)
+	if err != nil {
+		return err
+	}
+	// Resources of deployments left out of the selection are not orphans
+	changes, err := e.Plan(context.Background(), rendered, inv.Settings.Select.empty())
+	for _, change := range changes {
+		fmt.Fprintln(os.Stdout, change)
+	}
+	return err
+}
+
+func runPrune(inv invocation) error {
+	if !inv.Settings.Select.empty() {
+		return fmt.Errorf("prune works on the whole config, drop -target and -select")
+	}
+	ws, err := loadWorkspace(inv)
+	if err != nil {
+		return err
+	}
+	e, rendered, err := prepare(inv, ws)
+	if err != nil {
+		return err
+	}
+	changes, err := e.Prune(context.Background(), ws.conf, rendered)
+	for _, change := range changes {
+		fmt.Fprintln(os.Stdout, change)
+	}
+	if serr := e.State().Save(inv.Settings.StatePath); serr != nil {
+		logger.Error("Failed to save state", "path", inv.Settings.StatePath, "err", serr)
+	}
+	return err
+}
+
+func runApply(inv invocation) error {
+	if inv.Settings.Prune && !inv.Settings.Select.empty() {
+		return fmt.Errorf("-prune works on the whole config, drop -target and -select")
+	}
+	ws, err := loadWorkspace(inv)
+	if err != nil {
+		return err
+	}
+	settings := inv.Settings
+	e, rendered, err := prepare(inv, ws)
+	if err != nil {
+		return err
+	}
+	hashes := rendered.Hashes()
+	manifest, err := reconcile.LoadManifest(settings.ManifestPath)
+	if err != nil {
+		return fmt.Errorf("Can't read manifest %s: %v", settings.ManifestPath, err)
+	}
+	ctx := context.Background()
+	if settings.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.Timeout)
+		defer cancel()
+	}
+	observeDrift(manifest.Changed(hashes))
+	started := time.Now()
+	results, err := execute(ctx, e, ws.conf, rendered, rendered, settings)
+	recordApplied(manifest, rendered, rendered.Graph, results, err, started)
+	if merr := manifest.Save(settings.ManifestPath); merr != nil {
+		logger.Error("Failed to save manifest", "path", settings.ManifestPath, "err", merr)
+	}
+	report := submission.NewReport(started, results)
+	if settings.ReportPath != "" {
+		if werr := writeReport(settings.ReportPath, report.WriteJSON); werr != nil {
+			logger.Error("Failed to write report", "path", settings.ReportPath, "err", werr)
+		}
+	}
+	if settings.JUnitPath != "" {
+		if werr := writeReport(settings.JUnitPath, report.WriteJUnit); werr != nil {
+			logger.Error("Failed to write JUnit report", "path", settings.JUnitPath, "err", werr)
+		}
+	}
+	logger.Info("Submission done",
+		"passed", report.Count(submission.StatusPassed), "failed", report.Count(submission.StatusFailed), "skipped", report.Count(submission.StatusSkipped),
+		"duration", time.Since(started))
+	if err == nil {
+		observeSuccess(time.Now())
+	}
+	writeMetrics(settings.MetricsPath)
+	return err
+}
+
+func runGraph(inv invocation) error {
+	ws, err := loadWorkspace(inv)
+	if err != nil {
+		return err
+	}
+	rendered, _, _ := renderMemory(inv, ws, ws.deploys)
+	if _, err := rendered.Graph.Waves(); err != nil {
+		return err
+	}
+	return rendered.Graph.WriteDOT(os.Stdout)
+}
+
+func runServe(inv invocation) error {
+	return serve(inv.ConfFile, inv.OutPath, inv.Settings)
+}
+
+// renderMemory renders the deployments without writing them anywhere. Its
+// graph holds the dependencies templates add by reading other jobs, which
+// the config alone doesn't show. The files of each are keyed by their path
+// below its own output dir, with their secret values redacted, as redact
+// does for anything else shown.
+func renderMemory(inv invocation, ws workspace, deploys []engine.Deployment) (rendered engine.Rendered, files map[string]map[string][]byte, redact func(string) string) {
+	e := newEngine(inv.Settings, nil, nil)
+	rendered, _ = e.RenderSelected(context.Background(), ws.all, deploys)
+	files = make(map[string]map[string][]byte, len(rendered.Jobs))
+	for _, job := range rendered.Jobs {
+		own := make(map[string][]byte, len(job.Files))
+		for name, contents := range job.Files {
+			own[strings.TrimPrefix(name, job.Name()+"/")] = []byte(e.Redact(string(contents)))
+		}
+		files[job.Name()] = own
+	}
+	return rendered, files, e.Redact
+}
+
+// readTree reads every file below dir, keyed by its slash separated path
+// relative to dir. A missing dir is empty.
+func readTree(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		files[filepath.ToSlash(rel)] = data
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return files, nil
+	}
+	return files, err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func runValidate(inv invocation) error {
+	ws, err := loadWorkspace(inv)
+	if err != nil {
+		return err
+	}
+	if _, err := ws.graph.Waves(); err != nil {
+		return err
+	}
+	rendered, _ := newEngine(inv.Settings, nil, nil).RenderSelected(context.Background(), ws.all, ws.deploys)
+
+	var problems []string
+	// Reading other jobs adds dependencies, which may close a cycle
+	if _, err := rendered.Graph.Waves(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	renderErrs := rendered.Errors()
+	for _, name := range sortedKeys(renderErrs) {
+		problems = append(problems, fmt.Sprintf("%s: %v", name, renderErrs[name]))
+	}
+	for _, job := range rendered.Jobs {
+		if job.Err != nil {
+			continue
+		}
+		for _, name := range sortedKeys(job.Files) {
+			if err := checkRendered(name, job.Files[name]); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+		if _, err := resources.DiscoverFiles(job.OwnFiles(), job.Name(), job.Target.Name); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) found", len(problems))
+	}
+	fmt.Printf("%d deployment(s) are valid\n", len(ws.deploys))
+	return nil
+}
+
+// checkRendered parses a rendered file the way it is formatted when
+// written, since a file that fails to is still written as is.
+func checkRendered(rel string, data []byte) error {
+	switch {
+	case strings.HasSuffix(rel, ".nomad") || strings.HasSuffix(rel, ".hcl"):
+		if _, diags := hclparse.NewParser().ParseHCL(data, rel); diags.HasErrors() {
+			return diags
+		}
+	case kube.IsManifest(rel):
+		if _, err := kube.Parse(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errDiffers is what diff gives with --exit-code when the output dir is not
+// what a fresh render would write. It exits with 1 without being logged as a
+// failure.
+var errDiffers = errors.New("the output differs from a fresh render")
+
+func runDiff(inv invocation) error {
+	ws, err := loadWorkspace(inv)
+	if err != nil {
+		return err
+	}
+	out, rendered, redact := renderMemory(inv, ws, ws.deploys)
+	renderErrs := out.Errors()
+	changed := false
+	for _, d := range ws.deploys {
+		if renderErrs[d.Name()] != nil {
+			continue
+		}
+		have, err := readTree(filepath.Join(inv.OutPath, d.Name()))
+		if err != nil {
+			return err
+		}
+		want := rendered[d.Name()]
+		all := make(map[string]bool)
+		for rel := range have {
+			have[rel] = []byte(redact(string(have[rel])))
+			all[rel] = true
+		}
+		for rel := range want {
+			all[rel] = true
+		}
+		for _, rel := range sortedKeys(all) {
+			name := path.Join(d.Name(), rel)
+			oldName, newName := "a/"+name, "b/"+name
+			if _, ok := have[rel]; !ok {
+				oldName = "/dev/null"
+			}
+			if _, ok := want[rel]; !ok {
+				newName = "/dev/null"
+			}
+			if diff := textdiff.Unified(oldName, newName, have[rel], want[rel]); diff != "" {
+				fmt.Print(diff)
+				changed = true
+			}
+		}
+	}
+	if len(renderErrs) > 0 {
+		return fmt.Errorf("%d job(s) failed to render", len(renderErrs))
+	}
+	if changed && inv.ExitCode {
+		return errDiffers
+	}
+	return nil
+}
+
+func runList(inv invocation) error {
+	ws, err := loadWorkspace(inv)
+	if err != nil {
+		return err
+	}
+	rendered, _, _ := renderMemory(inv, ws, ws.deploys)
+	e := newEngine(inv.Settings, nil, nil)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEPLOYMENT\tPACK\tTARGET\tORIGIN\tDEPENDS ON")
+	for _, d := range ws.deploys {
+		origin, err := e.Origin(d.Job)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Name(), d.Pack(), orDash(d.Target.Name), origins.Redact(origin), orDash(strings.Join(rendered.Graph[d.Name()], ",")))
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func runShow(inv invocation) error {
+	if len(inv.Args) == 0 {
+		return fmt.Errorf("show needs the name of a job")
+	}
+	ws, err := loadWorkspace(inv)
+	if err != nil {
+		return err
+	}
+	var shown []engine.Deployment
+	for _, name := range inv.Args {
+		found := false
+		for _, d := range ws.deploys {
+			if d.Name() == name || d.Job.JobName == name {
+				shown = append(shown, d)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no deployment or job named %s", name)
+		}
+	}
+	out, rendered, redact := renderMemory(inv, ws, shown)
+	renderErrs := out.Errors()
+	e := newEngine(inv.Settings, nil, nil)
+
+	for i := range shown {
+		// Rendering found what the templates read, besides _depends_on
+		d := out.Jobs[i].Deployment
+		if i > 0 {
+			fmt.Println()
+		}
+		origin, err := e.Origin(d.Job)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deployment: %s\nPack:       %s\nOrigin:     %s\nTarget:     %s\nDepends on: %s\n",
+			d.Name(), d.Pack(), origins.Redact(origin), orDash(d.Target.Name), orDash(strings.Join(d.DependsOn, ", ")))
+		fmt.Println("Settings:")
+		for _, key := range sortedKeys(d.Job.Args) {
+			fmt.Printf("  %s\n", redact(fmt.Sprintf("%s = %v", key, d.Job.Args[key])))
+		}
+		if err := renderErrs[d.Name()]; err != nil {
+			fmt.Printf("Failed to render: %s\n", redact(err.Error()))
+			continue
+		}
+		files := rendered[d.Name()]
+		for _, rel := range sortedKeys(files) {
+			fmt.Printf("\n--- %s\n%s", rel, files[rel])
+			if !strings.HasSuffix(string(files[rel]), "\n") {
+				fmt.Println()
+			}
+		}
+	}
+	return nil
+}
+
+func runTest(inv invocation) error {
+	packs := inv.Args
+	if len(packs) == 0 {
+		found, err := filepath.Glob(filepath.Join(engine.DefaultOrigin, "*", "tests"))
+		if err != nil {
+			return err
+		}
+		for _, tests := range found {
+			packs = append(packs, filepath.Dir(tests))
+		}
+		if len(packs) == 0 {
+			return fmt.Errorf("no pack in %s has tests", engine.DefaultOrigin)
+		}
+	}
+	e := newEngine(inv.Settings, nil, nil)
+	failed := 0
+	for _, pack := range packs {
+		cases, err := e.TestPack(context.Background(), pack, inv.Update)
+		if err != nil {
+			return err
+		}
+		for _, c := range cases {
+			name := path.Join(filepath.Base(pack), c.Name)
+			switch {
+			case c.Err != nil:
+				fmt.Printf("FAIL %s: %v\n", name, c.Err)
+				failed++
+			case !c.Passed():
+				fmt.Printf("FAIL %s\n%s", name, c.Diff())
+				failed++
+			case inv.Update:
+				fmt.Printf("updated %s\n", name)
+			default:
+				fmt.Printf("ok   %s\n", name)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d case(s) failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+)
+
+func runKeygen(inv invocation) error {
+	key, err := confparse.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Print(key)
+	return nil
+}
+
+// readValue reads a value to encrypt from stdin, less a trailing newline.
+func readValue() (string, error) {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// writeInPlace replaces the file at path, keeping its permissions.
+func writeInPlace(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func runEncrypt(inv invocation) error {
+	if len(inv.Args) == 0 || len(inv.Args) > 2 || (inv.Args[0] == "-" && len(inv.Args) != 1) {
+		return fmt.Errorf("encrypt takes a file and maybe a key of it, or -")
+	}
+	recipients, err := confparse.LoadRecipients()
+	if err != nil {
+		return err
+	}
+	if inv.Args[0] == "-" {
+		value, err := readValue()
+		if err != nil {
+			return err
+		}
+		sealed, err := confparse.EncryptValue(recipients, value)
+		if err != nil {
+			return err
+		}
+		fmt.Println(sealed)
+		return nil
+	}
+
+	file := inv.Args[0]
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if confparse.IsEncryptedFile(data) {
+		return fmt.Errorf("%s is already encrypted, use edit to change it", file)
+	}
+	if len(inv.Args) == 1 {
+		sealed, err := confparse.EncryptFile(recipients, data)
+		if err != nil {
+			return err
+		}
+		return writeInPlace(file, sealed)
+	}
+	value, err := readValue()
+	if err != nil {
+		return err
+	}
+	sealed, err := confparse.EncryptValue(recipients, value)
+	if err != nil {
+		return err
+	}
+	edited, err := confparse.SetValue(data, inv.Args[1], sealed)
+	if err != nil {
+		return err
+	}
+	return writeInPlace(file, edited)
+}
+
+func runDecrypt(inv invocation) error {
+	if len(inv.Args) != 1 {
+		return fmt.Errorf("decrypt takes a file, or - for a value")
+	}
+	identities, err := confparse.LoadIdentities()
+	if err != nil {
+		return err
+	}
+	if inv.Args[0] == "-" {
+		value, err := readValue()
+		if err != nil {
+			return err
+		}
+		plaintext, err := confparse.DecryptValue(identities, value)
+		if err != nil {
+			return err
+		}
+		fmt.Println(plaintext)
+		return nil
+	}
+	data, err := os.ReadFile(inv.Args[0])
+	if err != nil {
+		return err
+	}
+	plaintext, err := confparse.DecryptFile(identities, data)
+	if err != nil {
+		return fmt.Errorf("Can't decrypt %s: %v", inv.Args[0], err)
+	}
+	_, err = os.Stdout.Write(plaintext)
+	return err
+}
+
+// runEdit opens the plaintext of an encrypted file in $EDITOR, and encrypts
+// it again in place when it was changed and still parses.
+func runEdit(inv invocation) error {
+	if len(inv.Args) != 1 {
+		return fmt.Errorf("edit needs the encrypted file to change")
+	}
+	file := inv.Args[0]
+	identities, err := confparse.LoadIdentities()
+	if err != nil {
+		return err
+	}
+	recipients, err := confparse.LoadRecipients()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	plaintext, err := confparse.DecryptFile(identities, data)
+	if err != nil {
+		return fmt.Errorf("Can't decrypt %s: %v", file, err)
+	}
+
+	dir, err := os.MkdirTemp("", "nomad-declarative-edit-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, filepath.Base(file))
+	if err := os.WriteFile(tmp, plaintext, 0600); err != nil {
+		return err
+	}
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "editor", tmp)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed, %s is unchanged: %v", editor, file, err)
+	}
+	edited, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, plaintext) {
+		return nil
+	}
+	if _, err := confparse.ParseTOML(bytes.NewReader(edited)); err != nil {
+		return fmt.Errorf("the edit does not parse, %s is unchanged: %v", file, err)
+	}
+	sealed, err := confparse.EncryptFile(recipients, edited)
+	if err != nil {
+		return err
+	}
+	return writeInPlace(file, sealed)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Vaelatern/nomad-declarative/engine"
+	"github.com/Vaelatern/nomad-declarative/internal/metrics"
+	"github.com/Vaelatern/nomad-declarative/internal/origins"
+	"github.com/Vaelatern/nomad-declarative/internal/submission"
+)
+
+var (
+	renderDuration = metrics.Default.Histogram("nomad_declarative_render_duration_seconds",
+		"How long rendering a job took.", metrics.DurationBuckets...)
+	templateFailures = metrics.Default.Counter("nomad_declarative_template_failures_total",
+		"Times a job failed to render.")
+	originFetchDuration = metrics.Default.Histogram("nomad_declarative_origin_fetch_duration_seconds",
+		"How long fetching an origin took.", metrics.DurationBuckets...)
+	originLookups = metrics.Default.Counter("nomad_declarative_origin_lookups_total",
+		"Origin lookups, by whether the cache held the origin.")
+	jobSubmissions = metrics.Default.Counter("nomad_declarative_job_submissions_total",
+		"Jobs submitted, by outcome: passed, failed or skipped.")
+	driftDetected = metrics.Default.Counter("nomad_declarative_drift_detected_total",
+		"Times a job's rendered output differed from what was last applied.")
+	driftedJobs = metrics.Default.Gauge("nomad_declarative_drifted_jobs",
+		"Jobs whose rendered output differed from what was last applied, at the last check.")
+	lastSuccess = metrics.Default.Gauge("nomad_declarative_last_successful_sync_timestamp_seconds",
+		"When the last sync or run that fully succeeded ended, in Unix time.")
+)
+
+func init() {
+	// Origins come and go with the config, so they are logged rather than
+	// kept as labels
+	originCache.Observe = func(origin string, hit bool, took time.Duration) {
+		origin = origins.Redact(origin)
+		if hit {
+			logger.Debug("Origin cached", "origin", origin)
+			originLookups.Inc("cache", "hit")
+			return
+		}
+		logger.Debug("Fetched origin", "origin", origin, "duration", took)
+		originLookups.Inc("cache", "miss")
+		originFetchDuration.Observe(took.Seconds())
+	}
+}
+
+// observeRender records how rendering a deployment went.
+func observeRender(r engine.RenderedJob, took time.Duration) {
+	renderDuration.Observe(took.Seconds(), "pack", r.Pack())
+	if r.Err != nil {
+		templateFailures.Inc("job", r.Name(), "pack", r.Pack())
+	}
+}
+
+// observeResults counts every job in graph by how its submission went. A
+// job that ran nothing passed.
+func observeResults(graph submission.Graph, results []submission.CmdReturn) {
+	outcome := make(map[string]string, len(graph))
+	for job := range graph {
+		outcome[job] = submission.StatusPassed
+	}
+	for _, res := range results {
+		switch {
+		case errors.Is(res.Err, submission.ErrDependencyFailed):
+			outcome[res.Job] = submission.StatusSkipped
+		case res.Err != nil:
+			outcome[res.Job] = submission.StatusFailed
+		}
+	}
+	for job, status := range outcome {
+		jobSubmissions.Inc("job", job, "outcome", status)
+	}
+}
+
+func observeDrift(changed []string) {
+	for _, job := range changed {
+		driftDetected.Inc("job", job)
+	}
+	driftedJobs.Set(float64(len(changed)))
+}
+
+func observeSuccess(at time.Time) {
+	lastSuccess.Set(float64(at.Unix()))
+}
+
+// writeMetrics writes the metrics for a textfile collector, if asked to.
+func writeMetrics(path string) {
+	if path == "" {
+		return
+	}
+	if err := metrics.Default.WriteFile(path); err != nil {
+		logger.Error("Failed to write metrics", "path", path, "err", err)
+	}
+}
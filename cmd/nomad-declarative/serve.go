@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Vaelatern/nomad-declarative/engine"
+	"github.com/Vaelatern/nomad-declarative/internal/metrics"
+	"github.com/Vaelatern/nomad-declarative/internal/origins"
+	"github.com/Vaelatern/nomad-declarative/internal/reconcile"
+	"github.com/Vaelatern/nomad-declarative/internal/webhook"
+)
+
+// serve keeps the clusters converged on the config until interrupted. Every
+// sync reads the config and renders again, which fetches remote origins
+// again, and only deployments whose output changed since they were last
+// applied are submitted. Changes to local config and packs trigger a sync
+// straight away.
+func serve(confFile string, outPath string, settings execSettings) error {
+	if settings.Interval <= 0 {
+		return fmt.Errorf("-interval must be more than zero")
+	}
+	if settings.Prune && !settings.Select.empty() {
+		return fmt.Errorf("-prune works on the whole config, drop -target and -select")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// A failed status endpoint stops serving the way a signal does, so the
+	// sync under way winds down and saves what it did
+	ctx, fail := context.WithCancelCause(ctx)
+	defer fail(nil)
+
+	manifest, err := reconcile.LoadManifest(settings.ManifestPath)
+	if err != nil {
+		return fmt.Errorf("Can't read manifest %s: %v", settings.ManifestPath, err)
+	}
+	state, err := engine.LoadState(settings.StatePath)
+	if err != nil {
+		return fmt.Errorf("Can't read state %s: %v", settings.StatePath, err)
+	}
+
+	// Origins older than half an interval are fetched again, so every
+	// periodic sync sees what was pushed since the one before
+	originCache.MaxAge = settings.Interval / 2
+
+	// Syncs and webhook runs share the output dir, state and manifest, so
+	// only one happens at a time
+	var mu sync.Mutex
+
+	status := &reconcile.Status{}
+	r := &reconcile.Reconciler{
+		Interval:   settings.Interval,
+		MaxBackoff: settings.MaxBackoff,
+		Status:     status,
+		Sync: func(ctx context.Context) (reconcile.Result, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return syncOnce(ctx, confFile, outPath, settings, manifest, state)
+		},
+		OnSync: func(res reconcile.Result, err error) {
+			if err != nil {
+				logger.Error("Sync failed", "revision", res.Revision, "err", err)
+				return
+			}
+			logger.Info("Synced", "revision", res.Revision)
+		},
+	}
+
+	if settings.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/status", status)
+		mux.HandleFunc("/healthz", status.Health)
+		mux.Handle("/metrics", metrics.Default)
+		if settings.WebhookSecretFile != "" {
+			if settings.WebhookMode != webhook.ModePlan && settings.WebhookMode != webhook.ModeApply {
+				return fmt.Errorf("-webhook-mode must be plan or apply")
+			}
+			secret, err := os.ReadFile(settings.WebhookSecretFile)
+			if err != nil {
+				return fmt.Errorf("Can't read webhook secret: %v", err)
+			}
+			if len(bytes.TrimSpace(secret)) == 0 {
+				return fmt.Errorf("webhook secret %s is empty", settings.WebhookSecretFile)
+			}
+			hook := &webhook.Handler{
+				Secret:      bytes.TrimSpace(secret),
+				DefaultMode: settings.WebhookMode,
+				Do: func(ctx context.Context, push webhook.Push, mode string, out io.Writer) ([]string, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					return pushRun(ctx, confFile, outPath, settings, manifest, state, push, mode, out)
+				},
+			}
+			go hook.Start(ctx)
+			mux.Handle("/webhook", hook)
+			mux.HandleFunc("/runs/", hook.Runs)
+		}
+		ln, err := net.Listen("tcp", settings.Listen)
+		if err != nil {
+			return fmt.Errorf("Can't listen on %s: %v", settings.Listen, err)
+		}
+		srv := &http.Server{Handler: mux}
+		go func() {
+			if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				fail(fmt.Errorf("Status endpoint on %s failed: %v", settings.Listen, err))
+			}
+		}()
+		defer srv.Close()
+	}
+
+	watched := []string{confFile, engine.DefaultOrigin}
+	if confFile == "" {
+		watched = []string{"config.toml", "config.d", engine.DefaultOrigin}
+	}
+	go reconcile.Watch(ctx, 2*time.Second, func() string {
+		return fingerprint(watched...)
+	}, r.Trigger)
+
+	err = r.Run(ctx)
+	if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// syncOnce renders everything and submits the deployments that changed.
+func syncOnce(ctx context.Context, confFile string, outPath string, settings execSettings, manifest *reconcile.Manifest, state *engine.State) (reconcile.Result, error) {
+	conf, err := loadConfig(confFile, settings)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("Can't open and process config %v", err)
+	}
+	all, deploys, graph, err := selectedDeployments(conf, settings.Select)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if _, err := graph.Waves(); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	e := newEngine(settings, engine.Dir(outPath), state)
+	rendered, _ := e.RenderSelected(ctx, all, deploys)
+	hashes, renderErrs := rendered.Hashes(), rendered.Errors()
+	res := reconcile.Result{Revision: reconcile.Revision(hashes), Jobs: make(map[string]reconcile.JobStatus)}
+	for name, err := range renderErrs {
+		res.Jobs[name] = reconcile.JobStatus{Status: reconcile.JobFailed, Error: err.Error()}
+	}
+
+	changed := manifest.Changed(hashes)
+	var removed []string
+	if settings.Select.empty() {
+		// Jobs left out of the selection are not gone
+		removed = manifest.Removed(hashes)
+	}
+	observeDrift(changed)
+	var syncErr error
+	if len(changed) > 0 || (len(removed) > 0 && settings.Prune) {
+		if settings.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, settings.Timeout)
+			defer cancel()
+		}
+		started := time.Now()
+		sub := rendered.Only(changed)
+		results, err := execute(ctx, e, conf, rendered, sub, settings)
+		failed := recordApplied(manifest, rendered, sub.Graph, results, err, started)
+		for job, ferr := range failed {
+			res.Jobs[job] = reconcile.JobStatus{Status: reconcile.JobFailed, Hash: hashes[job], Error: ferr.Error()}
+		}
+		syncErr = err
+	}
+	if syncErr == nil {
+		for _, name := range removed {
+			manifest.Forget(name)
+		}
+	}
+	if len(renderErrs) > 0 && syncErr == nil {
+		syncErr = fmt.Errorf("%d job(s) failed to render", len(renderErrs))
+	}
+	if err := manifest.Save(settings.ManifestPath); err != nil && syncErr == nil {
+		syncErr = fmt.Errorf("Failed to save manifest: %v", err)
+	}
+
+	if syncErr == nil {
+		observeSuccess(time.Now())
+	}
+	for name, hash := range hashes {
+		if _, ok := res.Jobs[name]; ok {
+			continue
+		}
+		applied := manifest.Jobs[name]
+		status := reconcile.JobUnchanged
+		if slices.Contains(changed, name) {
+			status = reconcile.JobApplied
+		}
+		res.Jobs[name] = reconcile.JobStatus{Status: status, Hash: hash, LastApplied: applied.AppliedAt}
+	}
+	return res, syncErr
+}
+
+// pushRun renders again the deployments whose pack comes from the pushed
+// repository, then plans or applies only those. It never prunes, as it
+// does not look at the rest of the config.
+func pushRun(ctx context.Context, confFile string, outPath string, settings execSettings, manifest *reconcile.Manifest, state *engine.State, push webhook.Push, mode string, out io.Writer) ([]string, error) {
+	for _, u := range push.URLs {
+		if u != "" {
+			originCache.Invalidate(u)
+		}
+	}
+	conf, err := loadConfig(confFile, settings)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open and process config %v", err)
+	}
+	all, deploys, _, err := selectedDeployments(conf, settings.Select)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.Options.Output != nil {
+		settings.Options.Output = io.MultiWriter(settings.Options.Output, out)
+	} else {
+		settings.Options.Output = out
+	}
+	e := newEngine(settings, engine.Dir(outPath), state)
+	var selected []engine.Deployment
+	var names []string
+	for _, d := range deploys {
+		origin, err := e.Origin(d.Job)
+		if err != nil {
+			return nil, err
+		}
+		if origins.Matches(origin, push.URLs, push.Ref, push.DefaultBranch) {
+			selected = append(selected, d)
+			names = append(names, d.Name())
+		}
+	}
+	if len(selected) == 0 {
+		fmt.Fprintf(out, "No job uses %s at %s\n", push.Repo(), push.Ref)
+		return nil, nil
+	}
+
+	rendered, err := e.RenderSelected(ctx, all, selected)
+	if err != nil {
+		return names, err
+	}
+	hashes := rendered.Hashes()
+
+	if mode == webhook.ModePlan {
+		for _, name := range manifest.Changed(hashes) {
+			fmt.Fprintf(out, "~ %s (rendered output changed)\n", name)
+		}
+		changes, err := e.Plan(ctx, rendered, false)
+		for _, change := range changes {
+			fmt.Fprintln(out, change)
+		}
+		return names, err
+	}
+
+	if settings.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.Timeout)
+		defer cancel()
+	}
+	settings.Prune = false
+	started := time.Now()
+	results, err := execute(ctx, e, conf, rendered, rendered, settings)
+	recordApplied(manifest, rendered, rendered.Graph, results, err, started)
+	if merr := manifest.Save(settings.ManifestPath); merr != nil && err == nil {
+		err = fmt.Errorf("Failed to save manifest: %v", merr)
+	}
+	return names, err
+}
+
+// fingerprint sums up the modification times and sizes of every file below
+// the given local paths, so a change to any of them is noticed.
+func fingerprint(paths ...string) string {
+	var b strings.Builder
+	for _, root := range paths {
+		filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info, err := d.Info(); err == nil && !d.IsDir() {
+				fmt.Fprintf(&b, "%s %d %d\n", p, info.Size(), info.ModTime().UnixNano())
+			}
+			return nil
+		})
+	}
+	return b.String()
+}
@@ -0,0 +1,304 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+	"github.com/Vaelatern/nomad-declarative/internal/consulapi"
+	"github.com/Vaelatern/nomad-declarative/internal/kube"
+	"github.com/Vaelatern/nomad-declarative/internal/nomadapi"
+	"github.com/Vaelatern/nomad-declarative/internal/resources"
+	"github.com/Vaelatern/nomad-declarative/internal/submission"
+)
+
+// Apply applies the typed resources of every rendered deployment, then
+// runs its scripts, one wave of the graph at a time. Quotas, namespaces and
+// node pools of every deployment are applied before the first wave, so jobs
+// can be placed in those another deployment declares; a failure still fails
+// the deployment declaring it. Every resource applied is added to the
+// State. A deployment that failed to render is not applied and fails, so
+// those depending on it are skipped. Every script run and failed or skipped
+// job is returned, along with the joined failures.
+func (e *Engine) Apply(ctx context.Context, rendered Rendered) ([]Result, error) {
+	dir, done, err := e.dir(rendered)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	deploys := rendered.Deployments()
+	opts := e.opts.Submit
+	opts.Jobs, opts.Secrets, err = e.jobOptions(ctx, deploys, opts.Retries)
+	if err != nil {
+		return nil, err
+	}
+	opts.Secrets = append(opts.Secrets, e.secrets.Values()...)
+	early := e.applyClusterScoped(ctx, dir, rendered, opts.Jobs)
+	opts.Resources = e.resourceStep(rendered, opts.Jobs, early)
+	opts.Failed = rendered.Errors()
+	return submission.ExecuteGraph(ctx, dir, rendered.Graph, opts)
+}
+
+// Plan describes what applying the rendered deployments' resources would
+// change. With prune, resources in the State no longer declared by them are
+// described as deleted too. Deployments that failed to render are left out,
+// and nothing is described as pruned then; the render failures are
+// returned.
+func (e *Engine) Plan(ctx context.Context, rendered Rendered, prune bool) ([]Change, error) {
+	opts, _, err := e.jobOptions(ctx, rendered.Deployments(), 0)
+	if err != nil {
+		return nil, err
+	}
+	failed := rendered.Errors()
+	var changes []Change
+	var declared []resources.Resource
+	for _, job := range rendered.Jobs {
+		if job.Err != nil {
+			continue
+		}
+		found, applier, err := deploymentResources(ctx, job, opts[job.Name()])
+		if err != nil {
+			return changes, err
+		}
+		for _, r := range found {
+			if !applier.Configured(r.Kind) {
+				continue
+			}
+			change, err := applier.Plan(ctx, r)
+			if err != nil {
+				return changes, fmt.Errorf("can't plan %s: %v", r.Ref, err)
+			}
+			changes = append(changes, change)
+		}
+		declared = append(declared, found...)
+	}
+	if prune && len(failed) == 0 {
+		for _, ref := range e.opts.State.Orphans(declared) {
+			changes = append(changes, Change{Ref: ref, Action: resources.ActionDelete, Diff: []string{"(prune)"}})
+		}
+	}
+	return changes, renderFailures(failed)
+}
+
+// Prune deletes every resource in the State that the rendered deployments
+// no longer declare, as found in their rendered files rather than whatever
+// is left in the output dir. Each is deleted with the environment of the
+// deployment that applied it, its own `_env` included, or with that of its
+// target in conf when that deployment is gone. It returns what was deleted,
+// and goes on past failures. Nothing is pruned when any deployment failed
+// to render, as what it declares is not known.
+func (e *Engine) Prune(ctx context.Context, conf Config, rendered Rendered) ([]Change, error) {
+	if failed := rendered.Errors(); len(failed) > 0 {
+		return nil, fmt.Errorf("not pruning, %v", renderFailures(failed))
+	}
+	opts, _, err := e.jobOptions(ctx, rendered.Deployments(), 0)
+	if err != nil {
+		return nil, err
+	}
+	var declared []resources.Resource
+	for _, job := range rendered.Jobs {
+		found, _, err := deploymentResources(ctx, job, opts[job.Name()])
+		if err != nil {
+			return nil, err
+		}
+		declared = append(declared, found...)
+	}
+	var changes []Change
+	var failures error
+	for _, ref := range e.opts.State.Orphans(declared) {
+		var applier resources.Applier
+		if jobOpts, ok := opts[e.opts.State.Owner(ref)]; ok {
+			applier, err = applierFor(jobOpts.Env)
+		} else {
+			applier, err = e.targetApplier(ctx, conf, ref.Target)
+		}
+		if err != nil {
+			return changes, err
+		}
+		change, err := applier.Delete(ctx, ref)
+		if err != nil {
+			failures = errors.Join(failures, fmt.Errorf("can't prune %s: %v", ref, err))
+			continue
+		}
+		e.opts.State.Remove(ref)
+		e.log.Info("Pruned", "resource", ref.String())
+		changes = append(changes, change)
+	}
+	return changes, failures
+}
+
+// renderFailures joins the failures of Rendered.Errors, sorted by name.
+func renderFailures(failed map[string]error) error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(failed)) {
+		errs = append(errs, fmt.Errorf("%s failed to render: %v", name, failed[name]))
+	}
+	return errors.Join(errs...)
+}
+
+// dir is where the rendered files are on disk. When the Sink is not a Dir
+// they are written to a temporary one, which done removes.
+func (e *Engine) dir(rendered Rendered) (string, func(), error) {
+	if rendered.Dir != "" {
+		return rendered.Dir, func() {}, nil
+	}
+	tmp, err := os.MkdirTemp("", "nomad-declarative-")
+	if err != nil {
+		return "", nil, err
+	}
+	done := func() { os.RemoveAll(tmp) }
+	for _, job := range rendered.Jobs {
+		for name, contents := range job.Files {
+			write := Dir(tmp).WriteFile
+			if slices.Contains(job.SecretFiles, name) {
+				write = Dir(tmp).WriteSecretFile
+			}
+			if err := write(name, contents); err != nil {
+				done()
+				return "", nil, err
+			}
+		}
+	}
+	return tmp, done, nil
+}
+
+// applierFor talks to the cluster the environment env points at, as the
+// scripts run with env would. Consul and Kubernetes are only talked to when
+// their address is set.
+func applierFor(env []string) (resources.Applier, error) {
+	var applier resources.Applier
+	client, err := nomadapi.NewClient(nomadapi.ConfigFromEnv(env))
+	if err != nil {
+		return applier, err
+	}
+	applier.Nomad = client
+	if cfg, ok := consulapi.ConfigFromEnv(env); ok {
+		client, err := consulapi.NewClient(cfg)
+		if err != nil {
+			return applier, err
+		}
+		applier.Consul = client
+	}
+	if cfg, ok := kube.ConfigFromEnv(env); ok {
+		client, err := kube.NewClient(cfg)
+		if err != nil {
+			return applier, err
+		}
+		applier.Kube = client
+	}
+	return applier, nil
+}
+
+// targetApplier talks to the cluster of a target, "" being the one the
+// process environment points at.
+func (e *Engine) targetApplier(ctx context.Context, conf Config, target string) (resources.Applier, error) {
+	t, ok := conf.Targets[target]
+	if !ok {
+		return applierFor(nil)
+	}
+	vars, err := t.Env()
+	if err == nil {
+		err = e.resolveEnv(ctx, vars)
+	}
+	if err != nil {
+		return resources.Applier{}, err
+	}
+	env, _ := confparse.EnvList(vars)
+	return applierFor(env)
+}
+
+// deploymentResources finds the typed resources among the files rendered for
+// a deployment. Consul and Kubernetes outputs are found even when there is
+// nowhere to apply them to, so they are still declared; the Applier says
+// which it can apply.
+func deploymentResources(ctx context.Context, job RenderedJob, opts submission.JobOptions) ([]resources.Resource, resources.Applier, error) {
+	applier, err := applierFor(opts.Env)
+	if err != nil {
+		return nil, applier, err
+	}
+	found, err := resources.DiscoverFiles(job.OwnFiles(), job.Name(), job.Target.Name)
+	if err != nil {
+		return nil, applier, err
+	}
+	for i := range found {
+		if err := applier.Normalize(ctx, &found[i]); err != nil {
+			return nil, applier, fmt.Errorf("%s: %v", found[i].Ref, err)
+		}
+	}
+	return found, applier, nil
+}
+
+// applyClusterScoped applies the cluster scoped resources of every
+// deployment rendered, in the order of their kinds, recording each in the
+// State. The results are kept by deployment, for its resource step.
+func (e *Engine) applyClusterScoped(ctx context.Context, dir string, rendered Rendered, opts map[string]submission.JobOptions) map[string][]Result {
+	var all []resources.Resource
+	appliers := make(map[string]resources.Applier)
+	for _, job := range rendered.Jobs {
+		if job.Err != nil {
+			continue
+		}
+		// A deployment whose resources can't be read fails at its own step
+		found, applier, err := deploymentResources(ctx, job, opts[job.Name()])
+		if err != nil {
+			continue
+		}
+		appliers[job.Name()] = applier
+		for _, r := range found {
+			if r.Kind.ClusterScoped() && applier.Configured(r.Kind) {
+				all = append(all, r)
+			}
+		}
+	}
+	resources.Sort(all)
+	early := make(map[string][]Result)
+	for _, r := range all {
+		res := e.applyResource(ctx, appliers[r.Job], r, filepath.Join(dir, r.Job))
+		early[r.Job] = append(early[r.Job], res)
+	}
+	return early
+}
+
+// resourceStep applies the typed resources of a deployment before its
+// scripts run, recording each in the State. The results of its cluster
+// scoped resources, already applied, come first.
+func (e *Engine) resourceStep(rendered Rendered, opts map[string]submission.JobOptions, early map[string][]Result) func(context.Context, string, string) []Result {
+	byName := make(map[string]RenderedJob, len(rendered.Jobs))
+	for _, job := range rendered.Jobs {
+		byName[job.Name()] = job
+	}
+	return func(ctx context.Context, job string, jobDir string) []Result {
+		found, applier, err := deploymentResources(ctx, byName[job], opts[job])
+		if err != nil {
+			return []Result{{ProgName: jobDir, Job: job, ExitCode: 1, Err: err}}
+		}
+		results := early[job]
+		for _, r := range found {
+			if !r.Kind.ClusterScoped() && applier.Configured(r.Kind) {
+				results = append(results, e.applyResource(ctx, applier, r, jobDir))
+			}
+		}
+		return results
+	}
+}
+
+// applyResource applies r, rendered into jobDir, adding it to the State
+// when it was.
+func (e *Engine) applyResource(ctx context.Context, applier resources.Applier, r resources.Resource, jobDir string) Result {
+	res := Result{ProgName: filepath.Join(jobDir, r.File), Job: r.Job, Attempts: 1}
+	change, err := applier.Apply(ctx, r)
+	if err != nil {
+		res.ExitCode = 1
+		res.Stderr = []byte(err.Error())
+		res.Err = err
+	} else {
+		res.Stdout = []byte(change.String() + "\n")
+		e.opts.State.Add(r.Ref, r.Job)
+	}
+	return res
+}
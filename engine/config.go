@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+)
+
+// ConfigTemplateOptions tune how config files are templated.
+type ConfigTemplateOptions = confparse.TemplateOptions
+
+// LoadConfig reads a config from workDir, as Engine.LoadConfig does. Files
+// of a config dir are read in name order, later ones winning.
+func LoadConfig(workDir fs.FS, confFile string) (Config, error) {
+	return LoadConfigWith(workDir, confFile, ConfigTemplateOptions{})
+}
+
+// LoadConfigWith is LoadConfig templating the config files with opts.
+func LoadConfigWith(workDir fs.FS, confFile string, opts ConfigTemplateOptions) (Config, error) {
+	if confFile == "" {
+		confFile = "config.d" // just in case, the error should guide people this way
+		_, err := fs.Stat(workDir, "config.toml")
+		if err == nil {
+			// Should default to this file if it exists
+			confFile = "config.toml"
+		}
+	}
+	info, err := fs.Stat(workDir, confFile)
+	if err != nil {
+		return confparse.Config{}, fmt.Errorf("can't stat path %s: %v", confFile, err)
+	}
+
+	if !info.IsDir() {
+		// Handle single file
+		parsed, err := confparse.ParseTOMLFile(workDir, confFile, opts)
+		if err != nil {
+			return confparse.Config{}, fmt.Errorf("can't process config %s: %v", confFile, err)
+		}
+		return parsed, nil
+	}
+
+	// Am a directory. Let's go a bit more complicated.
+	conf := confparse.Config{Jobs: make(confparse.Jobs), Targets: make(confparse.Targets)}
+
+	entries, err := fs.ReadDir(workDir, confFile)
+	if err != nil {
+		return confparse.Config{}, fmt.Errorf("can't read directory %s: %v", confFile, err)
+	}
+	var tomlFiles []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".toml") {
+			tomlFiles = append(tomlFiles, entry.Name())
+		}
+	}
+	sort.Strings(tomlFiles) // just make sure because last one wins the merge
+	for _, name := range tomlFiles {
+		parsed, err := confparse.ParseTOMLFile(workDir, path.Join(confFile, name), opts)
+		if err != nil {
+			return confparse.Config{}, fmt.Errorf("can't process config file %s: %v", name, err)
+		}
+		conf = confparse.MergeConfig(conf, parsed)
+	}
+	return conf, nil
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+	"github.com/Vaelatern/nomad-declarative/internal/secrets"
+	"github.com/Vaelatern/nomad-declarative/internal/submission"
+)
+
+// Deployment is one job rendered for one target. A job without targets has
+// a single deployment with an empty target.
+type Deployment struct {
+	Job    Job
+	Target Target
+	// DependsOn names the deployments this one waits for, from its
+	// `_depends_on`
+	DependsOn []string
+}
+
+// Name is where the deployment is written below the output dir, and what it
+// is called in the dependency graph: `<job>` or `<target>/<job>`.
+func (d Deployment) Name() string {
+	if d.Target.Name == "" {
+		return d.Job.JobName
+	}
+	return path.Join(d.Target.Name, d.Job.JobName)
+}
+
+// Pack is the name the config gives the deployment's pack.
+func (d Deployment) Pack() string {
+	pack, _ := d.Job.Pack["name"].(string)
+	return pack
+}
+
+// Deployments expands every job of conf into its deployments, sorted by
+// name. A dependency is looked for on the same target first, then among the
+// jobs deployed without a target. Unknown dependencies are an error, cycles
+// are left for Graph.Waves to find.
+func Deployments(conf Config) ([]Deployment, error) {
+	var out []Deployment
+	for _, job := range conf.Jobs {
+		names, err := job.Targets()
+		if err != nil {
+			return nil, fmt.Errorf("bad _targets for job %s: %v", job.JobName, err)
+		}
+		if len(names) == 0 {
+			if _, clash := conf.Targets[job.JobName]; clash {
+				return nil, fmt.Errorf("job %s has no _targets and shares its name with a target, their outputs would overlap", job.JobName)
+			}
+			out = append(out, Deployment{Job: job})
+			continue
+		}
+		for _, name := range names {
+			target, ok := conf.Targets[name]
+			if !ok {
+				return nil, fmt.Errorf("job %s wants unknown target %s", job.JobName, name)
+			}
+			out = append(out, Deployment{Job: job, Target: target})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+
+	known := make(map[string]bool, len(out))
+	for _, d := range out {
+		known[d.Name()] = true
+	}
+	for i, d := range out {
+		deps, err := d.Job.DependsOn()
+		if err != nil {
+			return nil, fmt.Errorf("bad _depends_on for job %s: %v", d.Job.JobName, err)
+		}
+		for _, dep := range deps {
+			node := dep
+			if d.Target.Name != "" {
+				sameTarget := path.Join(d.Target.Name, dep)
+				if known[sameTarget] || !known[dep] {
+					node = sameTarget // when not found either way, reported below
+				}
+			}
+			out[i].DependsOn = append(out[i].DependsOn, node)
+		}
+	}
+	return out, graphOf(out).Validate()
+}
+
+func graphOf(deploys []Deployment) Graph {
+	graph := make(Graph, len(deploys))
+	for _, d := range deploys {
+		graph[d.Name()] = d.DependsOn
+	}
+	return graph
+}
+
+// DependencyGraph is the graph between deploys. Dependencies on deployments
+// not among them are left out, as already done.
+func DependencyGraph(deploys []Deployment) Graph {
+	names := make([]string, 0, len(deploys))
+	for _, d := range deploys {
+		names = append(names, d.Name())
+	}
+	return graphOf(deploys).Subgraph(names)
+}
+
+// jobOptions collects the per-deployment submission settings, and every
+// secret value found in them. The job's `_env` wins over its target's.
+// `secret://` references among the values are resolved, and kept secret.
+func (e *Engine) jobOptions(ctx context.Context, deploys []Deployment, defaultRetries int) (map[string]submission.JobOptions, []string, error) {
+	opts := make(map[string]submission.JobOptions)
+	var found []string
+	for _, d := range deploys {
+		e.keepDecrypted(d)
+		jobOpts := submission.JobOptions{Retries: defaultRetries}
+		retries, ok, err := d.Job.Retries()
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad setting for job %s: %v", d.Job.JobName, err)
+		}
+		if ok {
+			jobOpts.Retries = retries
+		}
+		vars, err := d.Target.Env()
+		if err != nil {
+			return nil, nil, err
+		}
+		jobVars, err := d.Job.Env()
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad setting for job %s: %v", d.Job.JobName, err)
+		}
+		for k, v := range jobVars {
+			vars[k] = v
+		}
+		if err := e.resolveEnv(ctx, vars); err != nil {
+			return nil, nil, fmt.Errorf("bad _env for job %s: %v", d.Name(), err)
+		}
+		env, jobSecrets := confparse.EnvList(vars)
+		jobOpts.Env = env
+		found = append(found, jobSecrets...)
+		opts[d.Name()] = jobOpts
+	}
+	return opts, found, nil
+}
+
+// keepDecrypted makes the values decrypted from the config for d secret,
+// redacted and kept out of plain files like resolved references are.
+func (e *Engine) keepDecrypted(d Deployment) {
+	e.secrets.Add(d.Job.Decrypted...)
+	e.secrets.Add(d.Target.Decrypted...)
+}
+
+// resolveEnv replaces the `secret://` references among vars with their
+// values, kept secret.
+func (e *Engine) resolveEnv(ctx context.Context, vars map[string]confparse.EnvVar) error {
+	for k, v := range vars {
+		if !secrets.IsRef(v.Value) {
+			continue
+		}
+		value, err := e.secrets.Resolve(ctx, v.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+		vars[k] = confparse.EnvVar{Value: value, Secret: true}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Package engine renders nomad-declarative configs and applies what they
+// render, for tools that embed it rather than run the command. The command
+// is a thin wrapper around it.
+//
+//	e := engine.New(engine.Options{Sink: engine.Dir("output")})
+//	conf, err := e.LoadConfig("config.toml")
+//	deploys, err := engine.Deployments(conf)
+//	rendered, err := e.Render(ctx, deploys)
+//	results, err := e.Apply(ctx, rendered)
+//
+// # Stability
+//
+// From v1 what this package defines follows semantic versioning: within a
+// major version nothing it defines is removed or changes meaning, though
+// fields, methods and functions may be added. The types aliased from
+// internal packages, like Config, Graph and Result, are only promised to
+// keep their names, so values can be passed between this package's
+// functions; their fields and methods may change in any release. Nothing
+// below internal/ carries any promise.
+package engine
+
+import (
+	"log/slog"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+	"github.com/Vaelatern/nomad-declarative/internal/origins"
+	"github.com/Vaelatern/nomad-declarative/internal/resources"
+	"github.com/Vaelatern/nomad-declarative/internal/secrets"
+	"github.com/Vaelatern/nomad-declarative/internal/submission"
+)
+
+type (
+	// Config is a whole config, as read by LoadConfig.
+	Config = confparse.Config
+	Job    = confparse.Job
+	Target = confparse.Target
+	// Graph maps each deployment to those it depends on.
+	Graph = submission.Graph
+	// SubmitOptions tune how Apply runs scripts. Jobs and Secrets are
+	// filled in from the config.
+	SubmitOptions = submission.Options
+	// Result is one script run, or resource applied, by Apply.
+	Result = submission.CmdReturn
+	// State remembers the resources applied, so they can be pruned.
+	State = resources.State
+	// Change is what applying or pruning a resource does.
+	Change = resources.Change
+	// OriginCache keeps pack origins fetched.
+	OriginCache = origins.Cache
+	// SecretProvider looks up the `secret://<provider>/...` references of
+	// one provider.
+	SecretProvider = secrets.Provider
+	// SecretRef is a parsed `secret://<provider>/<path>#<key>`.
+	SecretRef = secrets.Ref
+)
+
+// DefaultOrigin is where packs are looked for when they have no _origin.
+const DefaultOrigin = "./packs"
+
+// NewOriginCache keeps each origin fetched for maxAge, or for as long as it
+// is used when maxAge is zero.
+func NewOriginCache(maxAge time.Duration) *OriginCache {
+	return origins.NewCache(maxAge)
+}
+
+// LoadState reads the state file at path, empty if there is none.
+func LoadState(path string) (*State, error) {
+	return resources.LoadState(path)
+}
+
+// Options configure an Engine. The zero value works.
+type Options struct {
+	// WorkDir is where relative config paths and local origins are
+	// resolved. Empty means the process's working directory.
+	WorkDir string
+	// Origins caches pack origins. Nil gives the engine its own cache,
+	// keeping each origin for the life of the engine.
+	Origins *OriginCache
+	// Sink receives every rendered file. Nil keeps them in memory only,
+	// and Apply, Plan and Prune write them to a temporary dir.
+	Sink Sink
+	// Logger receives events about rendering and applying. Nil discards
+	// them.
+	Logger *slog.Logger
+	// Parallelism is how many deployments Render renders at once. Zero
+	// means one per CPU.
+	Parallelism int
+	// Funcs are added to the template functions of every pack, winning
+	// over the built in ones of the same name.
+	Funcs template.FuncMap
+	// Submit tunes how Apply runs scripts.
+	Submit SubmitOptions
+	// State has every resource applied added to it, and is what Prune
+	// deletes from. Nil starts an empty one.
+	State *State
+	// OnRender, when set, is called after each deployment is rendered.
+	OnRender func(r RenderedJob, took time.Duration)
+	// SecretProviders are added to the built in file, env and vault ones,
+	// winning over those of the same name.
+	SecretProviders map[string]SecretProvider
+	// ConfigTemplate tunes how LoadConfig templates config files.
+	ConfigTemplate ConfigTemplateOptions
+}
+
+// Engine renders and applies deployments. It is safe to use from one
+// goroutine at a time, though Render runs several itself.
+type Engine struct {
+	opts    Options
+	log     *slog.Logger
+	secrets *secrets.Resolver
+}
+
+func New(opts Options) *Engine {
+	if opts.Origins == nil {
+		opts.Origins = NewOriginCache(0)
+	}
+	if opts.State == nil {
+		opts.State = resources.NewState()
+	}
+	resolver := secrets.NewResolver(opts.SecretProviders)
+	log := slog.New(slog.DiscardHandler)
+	if opts.Logger != nil {
+		log = slog.New(secrets.NewRedactingHandler(opts.Logger.Handler(), resolver))
+	}
+	if opts.Submit.Logger == nil {
+		opts.Submit.Logger = log
+	} else {
+		opts.Submit.Logger = slog.New(secrets.NewRedactingHandler(opts.Submit.Logger.Handler(), resolver))
+	}
+	return &Engine{opts: opts, log: log, secrets: resolver}
+}
+
+// Redact replaces every secret value the engine resolved so far in s, for
+// showing rendered files.
+func (e *Engine) Redact(s string) string {
+	return e.secrets.Redact(s)
+}
+
+// State is the state the engine adds applied resources to.
+func (e *Engine) State() *State {
+	return e.opts.State
+}
+
+func (e *Engine) workDir() (string, error) {
+	if e.opts.WorkDir != "" {
+		return e.opts.WorkDir, nil
+	}
+	return os.Getwd()
+}
+
+// LoadConfig reads the config file, or every .toml file of the config dir,
+// at path. An empty path means config.toml, or else config.d.
+func (e *Engine) LoadConfig(path string) (Config, error) {
+	dir, err := e.workDir()
+	if err != nil {
+		return Config{}, err
+	}
+	return LoadConfigWith(os.DirFS(dir), path, e.opts.ConfigTemplate)
+}
@@ -0,0 +1,868 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+	"github.com/Vaelatern/nomad-declarative/internal/resources"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeployments(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"config.toml": `
+[_targets.east]
+[_targets.west]
+
+[db]
+[db.postgres]
+_targets = ["east", "west"]
+
+[web]
+[web.frontend]
+_targets = ["east", "west"]
+_depends_on = ["postgres", "cdn"]
+[web.cdn]
+`})
+	conf, err := New(Options{WorkDir: dir}).LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	var names []string
+	for _, d := range deploys {
+		names = append(names, d.Name())
+		got[d.Name()] = d.DependsOn
+	}
+	if want := []string{"cdn", "east/frontend", "east/postgres", "west/frontend", "west/postgres"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %v, want %v", names, want)
+	}
+	want := map[string][]string{
+		"cdn":           nil,
+		"east/frontend": {"east/postgres", "cdn"},
+		"east/postgres": nil,
+		"west/frontend": {"west/postgres", "cdn"},
+		"west/postgres": nil,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DependsOn = %v, want %v", got, want)
+	}
+
+	conf.Jobs["cdn"].Args["_depends_on"] = "nowhere"
+	if _, err := Deployments(conf); err == nil {
+		t.Errorf("an unknown dependency should be an error")
+	}
+}
+
+func TestRender(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml": `
+[web]
+[web.frontend]
+msg = "hello"
+[missing]
+[missing.gone]
+`,
+		"packs/web/templates/run.sh.tpl": "#!/bin/sh\necho [[ .Args.msg | shout ]]\n",
+	})
+	e := New(Options{
+		WorkDir: dir,
+		Funcs:   template.FuncMap{"shout": strings.ToUpper},
+	})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := e.Render(context.Background(), deploys)
+	if err == nil || !strings.Contains(err.Error(), "gone") {
+		t.Errorf("Render() error = %v, want the missing pack reported", err)
+	}
+	if rendered.Dir != "" {
+		t.Errorf("Dir = %q without a Dir sink", rendered.Dir)
+	}
+	if errs := rendered.Errors(); len(errs) != 1 || errs["gone"] == nil {
+		t.Errorf("Errors() = %v", errs)
+	}
+	hashes := rendered.Hashes()
+	if len(hashes) != 1 || hashes["frontend"] == "" {
+		t.Errorf("Hashes() = %v", hashes)
+	}
+	only := rendered.Only([]string{"frontend"})
+	if len(only.Jobs) != 1 {
+		t.Fatalf("Only() kept %d jobs", len(only.Jobs))
+	}
+	if got := string(only.Jobs[0].Files["frontend/run.sh"]); got != "#!/bin/sh\necho HELLO\n" {
+		t.Errorf("run.sh = %q", got)
+	}
+}
+
+func TestRenderSecrets(t *testing.T) {
+	t.Setenv("ENGINE_TEST_PASSWORD", "hunter2")
+	key, err := confparse.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(confparse.KeyEnv, key)
+	t.Setenv(confparse.RecipientsEnv, "")
+	recipients, err := confparse.LoadRecipients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := confparse.EncryptValue(recipients, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, password := range map[string]string{
+		"reference": "secret://env/ENGINE_TEST_PASSWORD",
+		"encrypted": encrypted,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{
+				"config.toml": `
+[db]
+[db.postgres]
+password = "` + password + `"
+`,
+				"packs/db/templates/run.sh.tpl":     "#!/bin/sh\nexec psql\n",
+				"packs/db/templates/db.nomad.tpl":   "job \"db\" { password = \"[[ .Args.password ]]\" \n",
+				"packs/db/templates/README.md.tpl":  "nothing secret here\n",
+				"packs/db/templates/creds.conf.tpl": "password=[[ .Args.password ]]\n",
+			})
+			var logs bytes.Buffer
+			out := filepath.Join(dir, "output")
+			e := New(Options{
+				WorkDir: dir,
+				Sink:    Dir(out),
+				Logger:  slog.New(slog.NewTextHandler(&logs, nil)),
+			})
+			conf, err := e.LoadConfig("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(password, "secret://") && conf.Jobs["postgres"].Args["password"] != password {
+				t.Errorf("secret resolved on loading the config")
+			}
+			deploys, err := Deployments(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rendered, err := e.Render(context.Background(), deploys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job := rendered.Jobs[0]
+			if got := string(job.Files["postgres/creds.conf"]); got != "password=hunter2\n" {
+				t.Errorf("creds.conf = %q", got)
+			}
+			if want := []string{"postgres/creds.conf", "postgres/db.nomad"}; !slices.Equal(job.SecretFiles, want) {
+				t.Errorf("SecretFiles = %v, want %v", job.SecretFiles, want)
+			}
+			info, err := os.Stat(filepath.Join(out, "postgres", "creds.conf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("creds.conf is %v, want only its owner to read it", info.Mode().Perm())
+			}
+			if !strings.Contains(logs.String(), "Failed to parse HCL") || strings.Contains(logs.String(), "hunter2") {
+				t.Errorf("the secret is not redacted from the logs:\n%s", logs.String())
+			}
+			if got := e.Redact("password=hunter2"); got != "password=[redacted]" {
+				t.Errorf("Redact() = %q", got)
+			}
+		})
+	}
+}
+
+// recordSink keeps the order files are written in.
+type recordSink struct{ names []string }
+
+func (s *recordSink) WriteFile(name string, _ []byte) error {
+	s.names = append(s.names, name)
+	return nil
+}
+
+func TestRenderParallel(t *testing.T) {
+	dir := t.TempDir()
+	config := "[web]\n"
+	for i := 0; i < 60; i++ {
+		config += fmt.Sprintf("[web.job%02d]\nmsg = \"%d\"\n", i, i)
+	}
+	writeFiles(t, dir, map[string]string{
+		"config.toml":                     config,
+		"packs/web/templates/a.sh.tpl":    "#!/bin/sh\necho [[ .Args.msg ]]\n",
+		"packs/web/templates/b.txt.tpl":   "[[ .JobName ]]\n",
+		"packs/web/templates/c.nomad.tpl": "job \"[[ .JobName ]]\" {\n",
+	})
+	render := func() ([]string, string, Rendered) {
+		var logs bytes.Buffer
+		sink := &recordSink{}
+		e := New(Options{
+			WorkDir:     dir,
+			Sink:        sink,
+			Parallelism: 8,
+			Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{
+				Level: slog.LevelDebug,
+				ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+					if a.Key == slog.TimeKey || a.Key == "duration" {
+						return slog.Attr{}
+					}
+					return a
+				},
+			})),
+		})
+		conf, err := e.LoadConfig("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		deploys, err := Deployments(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rendered, err := e.Render(context.Background(), deploys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sink.names, logs.String(), rendered
+	}
+
+	names, logs, rendered := render()
+	if len(names) != 180 || !slices.IsSorted(names) {
+		t.Errorf("files written out of order: %v", names)
+	}
+	if !strings.Contains(logs, "Failed to parse HCL") {
+		t.Errorf("events logged while rendering are missing:\n%s", logs)
+	}
+	for i, job := range rendered.Jobs {
+		if want := fmt.Sprintf("job%02d", i); job.Name() != want || job.Hash == "" {
+			t.Errorf("job %d is %s with hash %q, want %s", i, job.Name(), job.Hash, want)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		again, againLogs, _ := render()
+		if !slices.Equal(again, names) || againLogs != logs {
+			t.Fatalf("rendering again gave different output")
+		}
+	}
+}
+
+func TestTestPack(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"web/templates/run.sh.tpl": "#!/bin/sh\necho [[ .Args.msg ]] [[ .Target.name ]]\n",
+		"web/tests/east.toml":      "msg = \"hi\"\n[_target]\nname = \"east\"\n",
+		"web/tests/east/run.sh":    "#!/bin/sh\necho hello east\n",
+		"web/tests/new.toml":       "msg = \"new\"\n",
+	})
+	e := New(Options{})
+	cases, err := e.TestPack(context.Background(), filepath.Join(dir, "web"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 2 || cases[0].Name != "east" || cases[1].Name != "new" {
+		t.Fatalf("cases = %v", cases)
+	}
+	if cases[0].Passed() || !strings.Contains(cases[0].Diff(), "-echo hello east\n+echo hi east\n") {
+		t.Errorf("a changed file should fail with a diff, got:\n%s", cases[0].Diff())
+	}
+	if cases[1].Err == nil {
+		t.Errorf("a case without goldens should fail")
+	}
+
+	if _, err := e.TestPack(context.Background(), filepath.Join(dir, "web"), true); err != nil {
+		t.Fatal(err)
+	}
+	cases, _ = e.TestPack(context.Background(), filepath.Join(dir, "web"), false)
+	for _, c := range cases {
+		if !c.Passed() {
+			t.Errorf("%s fails after updating: %v\n%s", c.Name, c.Err, c.Diff())
+		}
+	}
+}
+
+func TestRenderOverrides(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml": `
+[web]
+_overrides = "./overrides/web"
+[web.frontend]
+[web.plain]
+_overrides = ""
+`,
+		"packs/web/templates/run.sh.tpl":  "[[ define \"greeting\" ]]hello[[ end ]]#!/bin/sh\necho [[ template \"greeting\" ]]\n",
+		"packs/web/templates/stop.sh.tpl": "#!/bin/sh\nstop\n",
+		"overrides/web/_greeting.tpl":     "[[ define \"greeting\" ]]howdy[[ end ]]",
+		"overrides/web/stop.sh.tpl":       "#!/bin/sh\nstop now\n",
+		"overrides/web/extra/notes.txt":   "local\n",
+	})
+	e := New(Options{WorkDir: dir})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := e.Render(context.Background(), deploys)
+	if err == nil || !strings.Contains(err.Error(), "plain") {
+		t.Errorf("an empty _overrides should fail, got %v", err)
+	}
+	job := rendered.Jobs[0]
+	want := map[string]string{
+		"frontend/run.sh":          "#!/bin/sh\necho howdy\n",
+		"frontend/stop.sh":         "#!/bin/sh\nstop now\n",
+		"frontend/extra/notes.txt": "local\n",
+	}
+	got := make(map[string]string)
+	for name, contents := range job.Files {
+		got[name] = string(contents)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Files = %v, want %v", got, want)
+	}
+	if want := []string{"_greeting.tpl", "extra/notes.txt", "stop.sh.tpl"}; !reflect.DeepEqual(job.Overrides, want) {
+		t.Errorf("Overrides = %v, want %v", job.Overrides, want)
+	}
+}
+
+func TestRenderExtends(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml": `
+[web]
+[web.frontend]
+image = "nginx"
+[web.bare]
+[loop]
+[loop.spin]
+`,
+		"base/service/pack.toml":              "required = [\"image\"]\n[defaults]\nport = 80\nreplicas = 1\n",
+		"base/service/templates/_helpers.tpl": "[[ define \"labels\" ]]base[[ end ]]",
+		"base/service/templates/svc.txt.tpl":  "[[ .Args.image ]]:[[ .Args.port ]]x[[ .Args.replicas ]] [[ template \"labels\" ]]\n",
+		"base/service/templates/health.txt":   "base\n",
+		"packs/http/pack.toml":                "extends = \"service\"\norigin = \"./base\"\n[defaults]\nport = 8080\n",
+		"packs/http/templates/_labels.tpl":    "[[ define \"labels\" ]]http[[ end ]]",
+		"packs/web/pack.toml":                 "extends = \"http\"\n[defaults]\nreplicas = 3\n",
+		"packs/web/templates/health.txt":      "web\n",
+		"packs/loop/pack.toml":                "extends = \"spin\"\n",
+		"packs/spin/pack.toml":                "extends = \"loop\"\n",
+	})
+	e := New(Options{WorkDir: dir})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, _ := e.Render(context.Background(), deploys)
+	errs := rendered.Errors()
+	if err := errs["bare"]; err == nil || !strings.Contains(err.Error(), "image") {
+		t.Errorf("a missing required setting should fail, got %v", err)
+	}
+	if err := errs["spin"]; err == nil || !strings.Contains(err.Error(), "loop -> spin -> loop") {
+		t.Errorf("a cycle should fail, got %v", err)
+	}
+	var files map[string][]byte
+	for _, job := range rendered.Jobs {
+		if job.Name() == "frontend" {
+			files = job.Files
+		}
+	}
+	if got := string(files["frontend/svc.txt"]); got != "nginx:8080x3 http\n" {
+		t.Errorf("svc.txt = %q", got)
+	}
+	if got := string(files["frontend/health.txt"]); got != "web\n" {
+		t.Errorf("health.txt = %q", got)
+	}
+}
+
+func TestRenderDelims(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml": `
+[consul]
+[consul.app]
+name = "app"
+[mixed]
+[mixed.clash]
+[leaky]
+[leaky.drip]
+lost = "[[ .Args.lost ]]"
+table = "[[inputs.cpu]]"
+`,
+		"packs/consul/pack.toml":                     "delims = [\"<%\", \"%>\"]\n",
+		"packs/consul/templates/app.txt.tpl":         "name=<% .Args.name %> kv={{ key \"app\" }}\n<% verbatim \"_consul/extra.ctmpl\" %>",
+		"packs/consul/templates/_consul/extra.ctmpl": "{{ with secret \"db\" }}{{ .Data.password }}{{ end }}\n",
+		"packs/mixed/pack.toml":                      "extends = \"consul\"\ndelims = [\"((\", \"))\"]\n",
+		"packs/leaky/templates/out.txt.tpl":          "[[ .Args.lost ]]\n[[ raw `[[ .Args.kept ]]` ]]\n[[ .Args.table ]]\n",
+	})
+	var logs bytes.Buffer
+	e := New(Options{WorkDir: dir, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, _ := e.Render(context.Background(), deploys)
+	errs := rendered.Errors()
+	if err := errs["clash"]; err == nil || !strings.Contains(err.Error(), "delimiters") {
+		t.Errorf("packs of a chain with different delimiters should fail, got %v", err)
+	}
+	for _, job := range rendered.Jobs {
+		if job.Name() != "app" {
+			continue
+		}
+		want := "name=app kv={{ key \"app\" }}\n{{ with secret \"db\" }}{{ .Data.password }}{{ end }}\n"
+		if got := string(job.Files["app/app.txt"]); got != want {
+			t.Errorf("app.txt = %q, want %q", got, want)
+		}
+	}
+	if !strings.Contains(logs.String(), "unrendered delimiters") || !strings.Contains(logs.String(), "file=out.txt delims=\"[[ ]]\" lines=[1]") {
+		t.Errorf("unrendered delimiters are not warned of:\n%s", logs.String())
+	}
+	if strings.Count(logs.String(), "unrendered delimiters") != 1 {
+		t.Errorf("only the leaky job should be warned of:\n%s", logs.String())
+	}
+}
+
+func TestRenderReferences(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml": `
+[_targets.east]
+
+[db]
+[db.postgres]
+_targets = ["east"]
+port = 5432
+
+[web]
+[web.frontend]
+_targets = ["east"]
+[web.docs]
+[web.lost]
+[web.loop]
+`,
+		"packs/db/pack.toml":              "[defaults]\nuser = \"app\"\n",
+		"packs/db/templates/conn.txt.tpl": "[[ .Target.name ]]:[[ .Args.port ]]\n",
+		"packs/web/templates/out.txt.tpl": `[[ if eq .JobName "frontend" ]][[ jobarg "postgres" "port" ]] [[ (job "postgres").Args.user ]] [[ jobfile "postgres" "conn.txt" ]]` +
+			`[[ else if eq .JobName "docs" ]][[ jobarg "east/postgres" "port" ]]` +
+			`[[ else if eq .JobName "lost" ]][[ job "postgres" ]]` +
+			`[[ else ]][[ jobfile "loop" "out.txt" ]][[ end ]]`,
+	})
+	e := New(Options{WorkDir: dir})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var selected []Deployment
+	for _, d := range all {
+		if d.Pack() == "web" {
+			selected = append(selected, d)
+		}
+	}
+	rendered, _ := e.RenderSelected(context.Background(), all, selected)
+	errs := rendered.Errors()
+	if err := errs["lost"]; err == nil || !strings.Contains(err.Error(), "east/postgres") {
+		t.Errorf("an ambiguous reference should name the targets, got %v", err)
+	}
+	if err := errs["loop"]; err == nil || !strings.Contains(err.Error(), "references itself") {
+		t.Errorf("a job reading itself should fail, got %v", err)
+	}
+	got := make(map[string]string)
+	deps := make(map[string][]string)
+	for _, job := range rendered.Jobs {
+		for _, contents := range job.Files {
+			got[job.Name()] = string(contents)
+		}
+		deps[job.Name()] = job.DependsOn
+	}
+	if want := "5432 app east:5432\n"; got["east/frontend"] != want {
+		t.Errorf("east/frontend rendered %q, want %q", got["east/frontend"], want)
+	}
+	if got["docs"] != "5432" {
+		t.Errorf("docs rendered %q", got["docs"])
+	}
+	if !reflect.DeepEqual(deps["east/frontend"], []string{"east/postgres"}) || !reflect.DeepEqual(deps["docs"], []string{"east/postgres"}) {
+		t.Errorf("reads should add dependencies, got %v", deps)
+	}
+	if len(rendered.Graph["east/frontend"]) != 0 {
+		t.Errorf("dependencies outside the selection should be left out of the graph, got %v", rendered.Graph)
+	}
+}
+
+func TestRenderReferenceCycle(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml":                 "[p]\n[p.a]\nother = \"b\"\n[p.b]\nother = \"a\"\n",
+		"packs/p/templates/f.txt.tpl": `[[ jobarg .Args.other "other" ]]`,
+	})
+	e := New(Options{WorkDir: dir})
+	conf, _ := e.LoadConfig("")
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Render(context.Background(), deploys); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("jobs reading each other should be a dependency cycle, got %v", err)
+	}
+}
+
+func TestApplySkipsFailedRenders(t *testing.T) {
+	dir := t.TempDir()
+	ran := filepath.Join(dir, "ran")
+	writeFiles(t, dir, map[string]string{
+		"config.toml": `
+[web]
+[web.broken]
+[web.app]
+_depends_on = "broken"
+[web.other]
+`,
+		"packs/web/templates/run.sh.tpl": "#!/bin/sh\ntouch " + ran + "-[[ .Args.jobname ]]\n",
+		"packs/web/templates/z.tpl":      "[[ if eq .Args.jobname \"broken\" ]][[ fail \"boom\" ]][[ end ]]\n",
+	})
+	e := New(Options{WorkDir: dir, Sink: Dir(filepath.Join(dir, "output"))})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := e.Render(context.Background(), deploys)
+	if err == nil {
+		t.Fatal("broken rendered")
+	}
+	if _, err := e.Apply(context.Background(), rendered); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Apply() error = %v, want the render failure", err)
+	}
+	for job, want := range map[string]bool{"broken": false, "app": false, "other": true} {
+		if _, err := os.Stat(ran + "-" + job); (err == nil) != want {
+			t.Errorf("%s ran = %v, want %v", job, err == nil, want)
+		}
+	}
+	if _, err := e.Prune(context.Background(), conf, rendered); err == nil {
+		t.Errorf("Prune() went ahead with a failed render")
+	}
+}
+
+func TestRenderClearsOutput(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml":                        "[web]\n[web.frontend]\n",
+		"packs/web/templates/web.nomad.tpl":  "job \"web\" {}\n",
+		"packs/web/templates/old.nv.hcl.tpl": "path = \"old\"\n",
+	})
+	out := filepath.Join(dir, "output")
+	render := func() Rendered {
+		e := New(Options{WorkDir: dir, Sink: Dir(out)})
+		conf, err := e.LoadConfig("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		deploys, err := Deployments(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rendered, err := e.Render(context.Background(), deploys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rendered
+	}
+	render()
+	if err := os.Remove(filepath.Join(dir, "packs/web/templates/old.nv.hcl.tpl")); err != nil {
+		t.Fatal(err)
+	}
+	rendered := render()
+	if _, err := os.Stat(filepath.Join(out, "frontend", "old.nv.hcl")); err == nil {
+		t.Errorf("a file no longer rendered is left in the output")
+	}
+	if _, ok := rendered.Jobs[0].OwnFiles()["web.nomad"]; !ok {
+		t.Errorf("OwnFiles() = %v", rendered.Jobs[0].OwnFiles())
+	}
+}
+
+func TestDirScripts(t *testing.T) {
+	out := t.TempDir()
+	scripts := map[string]bool{
+		"web/run.sh":                  true,
+		"web/consul/kv/app/hook":      false,
+		"east/web/deploy.sh":          true,
+		"east/web/consul/kv/app/hook": false,
+		"web/notes.txt":               false,
+	}
+	for name, script := range scripts {
+		contents := "#!/bin/sh\necho hi\n"
+		if !script && strings.HasSuffix(name, ".txt") {
+			contents = "notes\n"
+		}
+		if err := Dir(out).WriteFile(name, []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, script := range scripts {
+		info, err := os.Stat(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode()&0111 != 0; got != script {
+			t.Errorf("%s is executable: %v, want %v", name, got, script)
+		}
+	}
+}
+
+func TestRenderSubdirTemplates(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml": "[web]\n[web.frontend]\n",
+		"packs/web/templates/variables/app.hcl.tpl": "items { job = \"[[ .Args.jobname ]]\" }\n",
+	})
+	e := New(Options{WorkDir: dir})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := e.Render(context.Background(), deploys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(rendered.Jobs[0].Files["frontend/variables/app.hcl"]); got != "items { job = \"frontend\" }\n" {
+		t.Errorf("variables/app.hcl = %q", got)
+	}
+}
+
+func TestApplyClusterScopedFirst(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		io.Copy(w, r.Body)
+	}))
+	defer srv.Close()
+	t.Setenv("NOMAD_ADDR", srv.URL)
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml":                                  "[web]\n[web.app]\n[platform]\n[platform.platform]\n",
+		"packs/web/templates/variables/cfg.hcl":        "namespace = \"apps\"\nitems { a = \"b\" }\n",
+		"packs/platform/templates/namespaces/apps.hcl": "description = \"Apps\"\n",
+	})
+	e := New(Options{WorkDir: dir, Sink: Dir(filepath.Join(dir, "output"))})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := e.Render(context.Background(), deploys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Apply(context.Background(), rendered); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"POST /v1/namespace/apps", "PUT /v1/var/cfg"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want the namespace app's variable is in first", calls)
+	}
+}
+
+func TestPruneUsesDeploymentEnv(t *testing.T) {
+	var mu sync.Mutex
+	tokens := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens[r.Method+" "+r.URL.Path] = r.Header.Get("X-Nomad-Token")
+		mu.Unlock()
+		if r.Method == http.MethodGet {
+			io.WriteString(w, `{"Items": {"a": "b"}, "ModifyIndex": 1}`)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("NOMAD_ADDR", srv.URL)
+	t.Setenv("NOMAD_TOKEN", "process-token")
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml":                       "[web]\n[web.app]\n_env.NOMAD_TOKEN = \"app-token\"\n",
+		"packs/web/templates/web.nomad.tpl": "job \"web\" {}\n",
+	})
+	state := resources.NewState()
+	state.Add(resources.Ref{Kind: resources.KindVariable, Namespace: "default", Name: "old"}, "app")
+	state.Add(resources.Ref{Kind: resources.KindVariable, Namespace: "default", Name: "orphan"}, "gone")
+	e := New(Options{WorkDir: dir, State: state})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := e.Render(context.Background(), deploys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Prune(context.Background(), conf, rendered); err != nil {
+		t.Fatal(err)
+	}
+	if got := tokens["DELETE /v1/var/old"]; got != "app-token" {
+		t.Errorf("pruned with token %q, want the one of the deployment that applied it", got)
+	}
+	if got := tokens["DELETE /v1/var/orphan"]; got != "process-token" {
+		t.Errorf("pruned with token %q, want the target's when the deployment is gone", got)
+	}
+}
+
+func TestPruneKeepsUnconfiguredKinds(t *testing.T) {
+	t.Setenv("CONSUL_HTTP_ADDR", "")
+	t.Setenv("KUBE_API_SERVER", "")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.toml":                             "[web]\n[web.app]\n",
+		"packs/web/templates/consul/kv/app/db":    "postgres\n",
+		"packs/web/templates/kubernetes/web.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: web\n",
+	})
+	state := resources.NewState()
+	state.Add(resources.Ref{Kind: resources.KindConsulKV, Name: "app/db"}, "app")
+	state.Add(resources.Ref{Kind: resources.KindKubernetes, Namespace: "default", Name: "v1/ConfigMap/web"}, "app")
+	e := New(Options{WorkDir: dir, State: state})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := e.Render(context.Background(), deploys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := e.Plan(context.Background(), rendered, true)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Plan() = %v, %v, want nothing to do without Consul or Kubernetes", changes, err)
+	}
+	changes, err = e.Prune(context.Background(), conf, rendered)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Prune() = %v, %v, want what is still declared kept", changes, err)
+	}
+	if len(state.Refs()) != 2 {
+		t.Errorf("State = %v", state.Refs())
+	}
+}
+
+func TestApplyTargetCACert(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		io.Copy(w, r.Body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	writeFiles(t, dir, map[string]string{
+		"ca.pem": string(ca),
+		"config.toml": `
+[_targets.east]
+address = "` + srv.URL + `"
+ca_cert = "` + filepath.Join(dir, "ca.pem") + `"
+
+[web]
+[web.app]
+_targets = ["east"]
+`,
+		"packs/web/templates/variables/cfg.hcl": "items { a = \"b\" }\n",
+	})
+	e := New(Options{WorkDir: dir, Sink: Dir(filepath.Join(dir, "output"))})
+	conf, err := e.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := Deployments(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := e.Render(context.Background(), deploys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Apply(context.Background(), rendered); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"PUT /v1/var/cfg"}; !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want the variable applied trusting the target's CA", calls)
+	}
+}
@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"context"
+	"log/slog"
+)
+
+// logBuffer is a slog.Handler holding records back, so a deployment
+// rendered alongside others logs in turn rather than interleaved with them.
+type logBuffer struct {
+	handler slog.Handler
+	records *[]bufferedRecord
+}
+
+type bufferedRecord struct {
+	handler slog.Handler
+	record  slog.Record
+}
+
+func newLogBuffer(h slog.Handler) *logBuffer {
+	return &logBuffer{handler: h, records: new([]bufferedRecord)}
+}
+
+func (b *logBuffer) Enabled(ctx context.Context, level slog.Level) bool {
+	return b.handler.Enabled(ctx, level)
+}
+
+func (b *logBuffer) Handle(_ context.Context, r slog.Record) error {
+	*b.records = append(*b.records, bufferedRecord{handler: b.handler, record: r.Clone()})
+	return nil
+}
+
+func (b *logBuffer) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logBuffer{handler: b.handler.WithAttrs(attrs), records: b.records}
+}
+
+func (b *logBuffer) WithGroup(name string) slog.Handler {
+	return &logBuffer{handler: b.handler.WithGroup(name), records: b.records}
+}
+
+// flush hands every record held to the handlers they were logged through.
+func (b *logBuffer) flush(ctx context.Context) {
+	for _, rec := range *b.records {
+		rec.handler.Handle(ctx, rec.record)
+	}
+	*b.records = nil
+}
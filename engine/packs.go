@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+	"github.com/Vaelatern/nomad-declarative/internal/origins"
+	"github.com/Vaelatern/nomad-declarative/internal/templating"
+)
+
+// packManifest is the optional pack.toml at the root of a pack:
+//
+//	extends = "base-service"
+//	origin = "git+https://github.com/example/packs.git" # where base-service is, this pack's origin by default
+//	required = ["image"]
+//	delims = ["<<", ">>"]
+//
+//	[defaults]
+//	port = 8080
+type packManifest struct {
+	// Extends names the pack this one inherits templates, defaults and
+	// required settings from
+	Extends string `toml:"extends"`
+	Origin  string `toml:"origin"`
+	// Required are settings every job using the pack must have
+	Required []string `toml:"required"`
+	// Defaults are settings a job gets when it does not set them
+	Defaults map[string]interface{} `toml:"defaults"`
+	// Delims are the action delimiters of the templates, `[[ ]]` when not
+	// set
+	Delims []string `toml:"delims"`
+}
+
+// packLayer is one pack of an inheritance chain.
+type packLayer struct {
+	name   string
+	origin string
+	// templates is nil for a pack extending another without any of its own
+	templates fs.FS
+	manifest  packManifest
+}
+
+// loadPack reads the pack called name below root.
+func loadPack(root fs.FS, origin, name string) (packLayer, error) {
+	layer := packLayer{name: name, origin: origin}
+	packRoot, err := fs.Sub(root, name)
+	if err != nil {
+		return layer, fmt.Errorf("Error grabbing pack named %s: %v", name, err)
+	}
+
+	if _, err := fs.Stat(packRoot, "."); err != nil {
+		return layer, fmt.Errorf("Seems like our specific pack root \"%s\" does not exist", packRoot)
+	}
+
+	data, err := fs.ReadFile(packRoot, "pack.toml")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return layer, fmt.Errorf("Can't read pack.toml of %s: %v", name, err)
+	}
+	if err == nil {
+		if _, err := toml.Decode(string(data), &layer.manifest); err != nil {
+			return layer, fmt.Errorf("Can't parse pack.toml of %s: %v", name, err)
+		}
+	}
+
+	templates, err := fs.Sub(packRoot, "templates")
+	if err != nil {
+		return layer, fmt.Errorf("Error grabbing pack templates for %s: %v", name, err)
+	}
+	if _, err := fs.Stat(templates, "."); err == nil {
+		layer.templates = templates
+	} else if layer.manifest.Extends == "" {
+		return layer, fmt.Errorf("Seems like we can't find the \"templates\" dir inside our pack root \"%s\"", packRoot)
+	}
+	return layer, nil
+}
+
+// packChain resolves the pack called name below root, and every pack it
+// extends, starting from the one extending no other.
+func (e *Engine) packChain(root fs.FS, origin, name string) ([]packLayer, error) {
+	var chain []packLayer
+	seen := make(map[string]bool)
+	for {
+		key := origin + "#" + name
+		if seen[key] {
+			var names []string
+			for _, layer := range chain {
+				names = append(names, layer.name)
+			}
+			return nil, fmt.Errorf("pack inheritance cycle: %s -> %s", strings.Join(names, " -> "), name)
+		}
+		seen[key] = true
+		layer, err := loadPack(root, origin, name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, layer)
+		if layer.manifest.Extends == "" {
+			break
+		}
+		if layer.manifest.Origin != "" {
+			if origin, err = e.originURL(layer.manifest.Origin); err != nil {
+				return nil, err
+			}
+			if root, err = e.opts.Origins.Lookup(origin); err != nil {
+				return nil, fmt.Errorf("Can't grab origin %s of pack %s: %v", origins.Redact(origin), layer.manifest.Extends, err)
+			}
+		}
+		name = layer.manifest.Extends
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// packDelims are the delimiters the templates of a chain are parsed with,
+// as every pack of it must use the same ones.
+func packDelims(chain []packLayer) (templating.Delims, error) {
+	var delims templating.Delims
+	from := ""
+	for _, layer := range chain {
+		if layer.manifest.Delims == nil {
+			continue
+		}
+		d, err := templating.ParseDelims(layer.manifest.Delims)
+		if err != nil {
+			return d, fmt.Errorf("bad pack.toml of %s: %v", layer.name, err)
+		}
+		if from != "" && d != delims {
+			return d, fmt.Errorf("pack %s uses delimiters %s, but %s extending it uses %s", from, delims, layer.name, d)
+		}
+		delims, from = d, layer.name
+	}
+	return delims, nil
+}
+
+// packArgs are a job's settings over the defaults of its packs, the
+// packs extending others winning. Settings any of them requires must be
+// there.
+func packArgs(chain []packLayer, job Job) (confparse.JobArgs, error) {
+	args := make(confparse.JobArgs)
+	var required []string
+	for _, layer := range chain {
+		for k, v := range layer.manifest.Defaults {
+			args[k] = v
+		}
+		required = append(required, layer.manifest.Required...)
+	}
+	for k, v := range job.Args {
+		args[k] = v
+	}
+	sort.Strings(required)
+	var missing []string
+	for _, key := range slices.Compact(required) {
+		if _, ok := args[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("job %s lacks settings its pack requires: %s", job.JobName, strings.Join(missing, ", "))
+	}
+	return args, nil
+}
+
+// jobArgs are packArgs with every `secret://` reference among them
+// resolved, which is left until a job is rendered.
+func (e *Engine) jobArgs(chain []packLayer, job Job) (confparse.JobArgs, error) {
+	args, err := packArgs(chain, job)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := e.secrets.ResolveAll(context.Background(), map[string]interface{}(args))
+	if err != nil {
+		return nil, fmt.Errorf("job %s: %v", job.JobName, err)
+	}
+	return confparse.JobArgs(resolved.(map[string]interface{})), nil
+}
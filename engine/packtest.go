@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+	"github.com/Vaelatern/nomad-declarative/internal/textdiff"
+)
+
+// PackCase is one test case of a pack: the settings in `tests/<case>.toml`
+// rendered as a job of that name, against the goldens in `tests/<case>/`.
+type PackCase struct {
+	Name string
+	// Files are those rendered, keyed by their path below the job's dir
+	Files map[string][]byte
+	// Golden are those expected, keyed the same way
+	Golden map[string][]byte
+	// Err is why the case could not be rendered or its goldens read
+	Err error
+}
+
+// Passed reports if the case rendered exactly its goldens.
+func (c PackCase) Passed() bool {
+	if c.Err != nil || len(c.Files) != len(c.Golden) {
+		return false
+	}
+	for name, contents := range c.Files {
+		golden, ok := c.Golden[name]
+		if !ok || !bytes.Equal(golden, contents) {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff is a unified diff from the goldens to what was rendered.
+func (c PackCase) Diff() string {
+	names := make(map[string]bool)
+	for name := range c.Files {
+		names[name] = true
+	}
+	for name := range c.Golden {
+		names[name] = true
+	}
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		oldName, newName := "golden/"+name, "rendered/"+name
+		if _, ok := c.Golden[name]; !ok {
+			oldName = "/dev/null"
+		}
+		if _, ok := c.Files[name]; !ok {
+			newName = "/dev/null"
+		}
+		b.WriteString(textdiff.Unified(oldName, newName, c.Golden[name], c.Files[name]))
+	}
+	return b.String()
+}
+
+// TestPack renders every case in the `tests/` dir of the pack at packDir,
+// a local path, and compares each with its goldens. With update, the
+// goldens are written from what was rendered instead, and every case that
+// rendered passes.
+//
+// A case file holds the settings of a job, as under `[pack.job]` in a
+// config. A `[_target]` table renders it as if deployed to the target it
+// describes, `name` defaulting to "test".
+func (e *Engine) TestPack(ctx context.Context, packDir string, update bool) ([]PackCase, error) {
+	abs, err := filepath.Abs(packDir)
+	if err != nil {
+		return nil, err
+	}
+	testsDir := filepath.Join(abs, "tests")
+	files, err := filepath.Glob(filepath.Join(testsDir, "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("pack %s has no tests/*.toml", packDir)
+	}
+	sort.Strings(files)
+
+	pack := confparse.PackSettings{
+		"name":   filepath.Base(abs),
+		"origin": "file://" + filepath.ToSlash(filepath.Dir(abs)),
+	}
+	var cases []PackCase
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return cases, err
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".toml")
+		c := PackCase{Name: name}
+		d, err := packCaseDeployment(file, name, pack)
+		if err != nil {
+			c.Err = err
+			cases = append(cases, c)
+			continue
+		}
+		job := e.renderOne(d, []Deployment{d}, newFileCache())
+		job.logs.flush(ctx)
+		if job.Err != nil {
+			c.Err = job.Err
+			cases = append(cases, c)
+			continue
+		}
+		c.Files = make(map[string][]byte, len(job.Files))
+		for path, contents := range job.Files {
+			c.Files[strings.TrimPrefix(path, d.Name()+"/")] = contents
+		}
+		goldenDir := filepath.Join(testsDir, name)
+		if update {
+			c.Err = writeGoldens(goldenDir, c.Files)
+			c.Golden = c.Files
+		} else {
+			c.Golden, c.Err = readGoldens(goldenDir)
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+func packCaseDeployment(file string, name string, pack confparse.PackSettings) (Deployment, error) {
+	args := make(map[string]interface{})
+	if _, err := toml.DecodeFile(file, &args); err != nil {
+		return Deployment{}, fmt.Errorf("Can't read case %s: %v", file, err)
+	}
+	if _, ok := args["jobname"]; !ok {
+		args["jobname"] = name
+	}
+	d := Deployment{Job: Job{JobName: name, Args: args, Pack: pack}}
+	if raw, ok := args["_target"]; ok {
+		settings, ok := raw.(map[string]interface{})
+		if !ok {
+			return d, fmt.Errorf("case %s: expected a table for _target, got %T", file, raw)
+		}
+		delete(args, "_target")
+		d.Target = Target{Name: "test", Settings: settings}
+		if n, ok := settings["name"].(string); ok && n != "" {
+			d.Target.Name = n
+		}
+	}
+	return d, nil
+}
+
+func readGoldens(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		files[filepath.ToSlash(rel)] = data
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no goldens in %s, run with update to write them", dir)
+	}
+	return files, err
+}
+
+// writeGoldens replaces the goldens in dir with files.
+func writeGoldens(dir string, files map[string][]byte) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, contents := range files {
+		if err := Dir(dir).WriteFile(name, contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
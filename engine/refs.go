@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+)
+
+// references give a deployment's templates what other jobs of the config
+// are, through `job`, `jobarg` and `jobfile`, and note the deployments read
+// so they are applied first.
+type references struct {
+	e    *Engine
+	all  []Deployment
+	self Deployment
+	// stack holds the deployments being rendered for their files to get
+	// here, self last
+	stack []string
+	files *fileCache
+	// deps are the deployments referenced, in the order first read
+	deps []string
+}
+
+// fileCache keeps the files of deployments rendered for `jobfile`, for the
+// length of a Render.
+type fileCache struct {
+	mu    sync.Mutex
+	files map[string]map[string][]byte
+}
+
+func newFileCache() *fileCache {
+	return &fileCache{files: make(map[string]map[string][]byte)}
+}
+
+func (r *references) funcs() template.FuncMap {
+	return template.FuncMap{
+		"job":     r.job,
+		"jobarg":  r.jobArg,
+		"jobfile": r.jobFile,
+	}
+}
+
+// resolve finds the deployment a template means by name: the job of that
+// name on the same target, else the one deployed without a target, as for
+// `_depends_on`. A `<target>/<job>` name is taken as is.
+func (r *references) resolve(name string) (Deployment, error) {
+	want := []string{name}
+	if r.self.Target.Name != "" && !strings.Contains(name, "/") {
+		want = []string{path.Join(r.self.Target.Name, name), name}
+	}
+	for _, n := range want {
+		for _, d := range r.all {
+			if d.Name() != n {
+				continue
+			}
+			if n == r.self.Name() {
+				return d, fmt.Errorf("job %s references itself", name)
+			}
+			if !slices.Contains(r.deps, n) {
+				r.deps = append(r.deps, n)
+			}
+			return d, nil
+		}
+	}
+	var names []string
+	for _, d := range r.all {
+		if d.Job.JobName == name {
+			names = append(names, d.Name())
+		}
+	}
+	if len(names) > 0 {
+		return Deployment{}, fmt.Errorf("job %s is only deployed to targets, reference one of %s", name, strings.Join(names, ", "))
+	}
+	return Deployment{}, fmt.Errorf("no job %s to reference", name)
+}
+
+// job is what another job's templates see as `.`: its name, its settings
+// over its pack's defaults, its pack settings and its target.
+func (r *references) job(name string) (confparse.JobAsArgs, error) {
+	d, err := r.resolve(name)
+	if err != nil {
+		return confparse.JobAsArgs{}, err
+	}
+	args, err := r.e.resolvedArgs(d)
+	if err != nil {
+		return confparse.JobAsArgs{}, fmt.Errorf("Can't resolve job %s: %v", name, err)
+	}
+	return confparse.JobAsArgs{
+		JobName: d.Job.JobName,
+		Args:    args,
+		Pack:    d.Job.Pack,
+		Target:  d.Target.TemplateArgs(),
+	}, nil
+}
+
+func (r *references) jobArg(name string, key string) (interface{}, error) {
+	j, err := r.job(name)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := j.Args[key]
+	if !ok {
+		return nil, fmt.Errorf("job %s has no setting %s", name, key)
+	}
+	return v, nil
+}
+
+// jobFile is a file another job renders, by its path below that job's dir.
+func (r *references) jobFile(name string, file string) (string, error) {
+	d, err := r.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if slices.Contains(r.stack, d.Name()) {
+		return "", fmt.Errorf("jobfile reference cycle: %s -> %s", strings.Join(r.stack, " -> "), d.Name())
+	}
+	files, err := r.renderedFiles(d)
+	if err != nil {
+		return "", err
+	}
+	contents, ok := files[path.Join(d.Name(), file)]
+	if !ok {
+		return "", fmt.Errorf("job %s renders no file %s", name, file)
+	}
+	return string(contents), nil
+}
+
+func (r *references) renderedFiles(d Deployment) (map[string][]byte, error) {
+	r.files.mu.Lock()
+	files, ok := r.files.files[d.Name()]
+	r.files.mu.Unlock()
+	if ok {
+		return files, nil
+	}
+	// Rendering the same deployment twice at once gives the same files, so
+	// it is not worth waiting on another goroutine for them
+	files = make(map[string][]byte)
+	refs := &references{e: r.e, all: r.all, self: d, stack: append(slices.Clone(r.stack), d.Name()), files: r.files}
+	overrides, err := r.e.overrides(d.Job)
+	if err == nil {
+		err = r.e.renderJob(d, overrides, refs, slog.New(slog.DiscardHandler), func(name string, contents []byte) error {
+			files[name] = contents
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't render job %s for its files: %v", d.Name(), err)
+	}
+	r.files.mu.Lock()
+	r.files.files[d.Name()] = files
+	r.files.mu.Unlock()
+	return files, nil
+}
+
+// resolvedArgs are a deployment's settings over its packs' defaults.
+func (e *Engine) resolvedArgs(d Deployment) (confparse.JobArgs, error) {
+	origin, err := e.Origin(d.Job)
+	if err != nil {
+		return nil, err
+	}
+	root, err := e.opts.Origins.Lookup(origin)
+	if err != nil {
+		return nil, fmt.Errorf("Can't grab fsimpl filesystem: %v", err)
+	}
+	chain, err := e.packChain(root, origin, packName(d.Job))
+	if err != nil {
+		return nil, err
+	}
+	return e.jobArgs(chain, d.Job)
+}
+
+// packName is the name of a job's pack in its origin.
+func packName(job Job) string {
+	pack := job.Pack["name"].(string)
+	if job.Pack["origin-name"] != nil && job.Pack["origin-name"].(string) != "" {
+		pack = job.Pack["origin-name"].(string)
+	}
+	return pack
+}
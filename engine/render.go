@@ -0,0 +1,594 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+
+	"github.com/Vaelatern/nomad-declarative/internal/confparse"
+	"github.com/Vaelatern/nomad-declarative/internal/kube"
+	"github.com/Vaelatern/nomad-declarative/internal/origins"
+	"github.com/Vaelatern/nomad-declarative/internal/reconcile"
+	"github.com/Vaelatern/nomad-declarative/internal/resources"
+	"github.com/Vaelatern/nomad-declarative/internal/templating"
+)
+
+// Sink receives rendered files, named by their slash separated path below
+// the output: `<deployment>/<file>`.
+type Sink interface {
+	WriteFile(name string, contents []byte) error
+}
+
+// SecretSink is a Sink that keeps the files holding secret values apart.
+type SecretSink interface {
+	Sink
+	WriteSecretFile(name string, contents []byte) error
+}
+
+// ClearingSink is a Sink that drops what it holds for a deployment before
+// the deployment is written again, so files no longer rendered don't linger.
+type ClearingSink interface {
+	Sink
+	Clear(deployment string) error
+}
+
+// Dir is a Sink writing below a local dir. Files starting with a shebang are
+// made executable, as they are scripts to run, unless they are typed
+// resources. Files holding secrets are only readable by their owner. A
+// deployment's dir is emptied before it is written again.
+type Dir string
+
+func (d Dir) WriteFile(name string, contents []byte) error {
+	return d.write(name, contents, false)
+}
+
+func (d Dir) WriteSecretFile(name string, contents []byte) error {
+	return d.write(name, contents, true)
+}
+
+func (d Dir) Clear(deployment string) error {
+	return os.RemoveAll(filepath.Join(string(d), filepath.FromSlash(deployment)))
+}
+
+func (d Dir) write(name string, contents []byte, secret bool) error {
+	tgtPath := filepath.Join(string(d), filepath.FromSlash(name))
+	tgtDirPath := filepath.Dir(tgtPath)
+	err := os.MkdirAll(tgtDirPath, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(tgtPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := f.Write(contents)
+	if err != nil {
+		return err
+	}
+	// Make executable if a shebang
+	script := n >= 2 && contents[0] == '#' && contents[1] == '!' && !typedResource(name)
+	switch {
+	case secret && script:
+		return os.Chmod(tgtPath, 0700)
+	case secret:
+		return os.Chmod(tgtPath, 0600)
+	case script:
+		return os.Chmod(tgtPath, 0755)
+	}
+	return nil
+}
+
+// typedResource reports if the file name, `<deployment>/<file>`, is applied
+// through an API rather than run, even when it starts with a shebang, like a
+// Consul key holding a script. A deployment is `<job>` or `<target>/<job>`,
+// so the file is looked for below either.
+func typedResource(name string) bool {
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) > 1 && resources.Recognized(path.Join(parts[1:]...)) {
+		return true
+	}
+	return len(parts) > 2 && resources.Recognized(parts[2])
+}
+
+// RenderedJob is what rendering one deployment gave.
+type RenderedJob struct {
+	Deployment
+	// Files holds every file rendered, keyed by its path below the output:
+	// `<deployment>/<file>`
+	Files map[string][]byte
+	// Hash sums up Files, to tell when the output changed
+	Hash string
+	// Overrides lists the files of the job's `_overrides` dir, layered over
+	// its pack's templates
+	Overrides []string
+	// SecretFiles are those of Files holding a value resolved from a
+	// `secret://` reference, sorted
+	SecretFiles []string
+	// Err is why the deployment failed to render, Files is then partial
+	Err error
+}
+
+// OwnFiles are Files keyed by their path below the deployment's dir.
+func (j RenderedJob) OwnFiles() map[string][]byte {
+	out := make(map[string][]byte, len(j.Files))
+	for name, contents := range j.Files {
+		out[strings.TrimPrefix(name, j.Name()+"/")] = contents
+	}
+	return out
+}
+
+// Rendered is what Render gave for a set of deployments.
+type Rendered struct {
+	Jobs []RenderedJob
+	// Graph holds the dependencies between the deployments rendered
+	Graph Graph
+	// Dir is where the files were written, when the Sink is a Dir
+	Dir string
+}
+
+// Deployments are those rendered, failed or not.
+func (r Rendered) Deployments() []Deployment {
+	out := make([]Deployment, len(r.Jobs))
+	for i, job := range r.Jobs {
+		out[i] = job.Deployment
+	}
+	return out
+}
+
+// Hashes maps every deployment rendered without error to its hash.
+func (r Rendered) Hashes() map[string]string {
+	out := make(map[string]string, len(r.Jobs))
+	for _, job := range r.Jobs {
+		if job.Err == nil {
+			out[job.Name()] = job.Hash
+		}
+	}
+	return out
+}
+
+// Errors maps every deployment that failed to render to why.
+func (r Rendered) Errors() map[string]error {
+	out := make(map[string]error)
+	for _, job := range r.Jobs {
+		if job.Err != nil {
+			out[job.Name()] = job.Err
+		}
+	}
+	return out
+}
+
+// Only keeps the deployments named, and the dependencies between them.
+func (r Rendered) Only(names []string) Rendered {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	out := Rendered{Graph: r.Graph.Subgraph(names), Dir: r.Dir}
+	for _, job := range r.Jobs {
+		if keep[job.Name()] {
+			out.Jobs = append(out.Jobs, job)
+		}
+	}
+	return out
+}
+
+// Render renders the deployments, handing every file to the Sink. Up to
+// Options.Parallelism deployments render at once, but files are handed over,
+// events logged and OnRender called in the order of deploys, each
+// deployment's files sorted by name. A deployment that fails to render does
+// not stop the others; the error returned joins their failures.
+//
+// Templates may read other jobs among deploys with `job`, `jobarg` and
+// `jobfile`, which makes the reading deployment depend on the one read.
+func (e *Engine) Render(ctx context.Context, deploys []Deployment) (Rendered, error) {
+	return e.RenderSelected(ctx, deploys, deploys)
+}
+
+// RenderSelected renders the deployments selected as Render does, with
+// templates reading other jobs among all of them. Dependencies on
+// deployments not selected are left out of the graph, as already done.
+func (e *Engine) RenderSelected(ctx context.Context, all, deploys []Deployment) (Rendered, error) {
+	var out Rendered
+	for _, d := range all {
+		e.keepDecrypted(d)
+	}
+	for _, d := range deploys {
+		e.keepDecrypted(d)
+	}
+	if dir, ok := e.opts.Sink.(Dir); ok {
+		out.Dir = string(dir)
+	}
+	jobs := make([]renderedJob, len(deploys))
+	files := newFileCache()
+	workers := e.opts.Parallelism
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(deploys)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				jobs[i] = e.renderOne(deploys[i], all, files)
+			}
+		}()
+	}
+feed:
+	for i := range deploys {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return out, err
+	}
+
+	var failures error
+	for _, job := range jobs {
+		e.finish(ctx, &job)
+		if job.Err != nil {
+			failures = errors.Join(failures, fmt.Errorf("Failed to parse job %s: %v", job.Name(), job.Err))
+		}
+		out.Jobs = append(out.Jobs, job.RenderedJob)
+	}
+	out.Graph = DependencyGraph(out.Deployments())
+	if _, err := out.Graph.Waves(); err != nil {
+		failures = errors.Join(failures, err)
+	}
+	return out, failures
+}
+
+// renderedJob is a deployment rendered in memory, with what it logged
+// held back until its turn comes.
+type renderedJob struct {
+	RenderedJob
+	logs *logBuffer
+	took time.Duration
+}
+
+// renderOne renders a deployment in memory, its templates reading other
+// jobs among all. Those read are added to its dependencies.
+func (e *Engine) renderOne(d Deployment, all []Deployment, files *fileCache) renderedJob {
+	job := renderedJob{
+		RenderedJob: RenderedJob{Deployment: d, Files: make(map[string][]byte)},
+		logs:        newLogBuffer(e.log.Handler()),
+	}
+	started := time.Now()
+	refs := &references{e: e, all: all, self: d, stack: []string{d.Name()}, files: files}
+	overrides, err := e.overrides(d.Job)
+	if err == nil {
+		err = e.renderJob(d, overrides, refs, slog.New(job.logs), func(name string, contents []byte) error {
+			job.Files[name] = contents
+			return nil
+		})
+	}
+	if err == nil && overrides != nil {
+		job.Overrides, err = templating.Files(overrides)
+	}
+	for _, name := range slices.Sorted(maps.Keys(job.Files)) {
+		if e.secrets.Contains(job.Files[name]) {
+			job.SecretFiles = append(job.SecretFiles, name)
+		}
+	}
+	for _, dep := range refs.deps {
+		if !slices.Contains(job.DependsOn, dep) {
+			job.DependsOn = append(slices.Clone(job.DependsOn), dep)
+		}
+	}
+	job.Err = err
+	job.took = time.Since(started)
+	return job
+}
+
+// overrides are the local templates a job's `_overrides` layers over its
+// pack's, nil when it has none. A relative path is below the WorkDir.
+func (e *Engine) overrides(job Job) (fs.FS, error) {
+	raw, ok := job.Setting("overrides")
+	if !ok {
+		return nil, nil
+	}
+	dir, ok := raw.(string)
+	if !ok || dir == "" {
+		return nil, fmt.Errorf("bad _overrides for job %s: expected a path, got %v", job.JobName, raw)
+	}
+	if !filepath.IsAbs(dir) {
+		cwd, err := e.workDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(cwd, dir)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("Can't find overrides dir %s for job %s", dir, job.JobName)
+	}
+	return os.DirFS(dir), nil
+}
+
+// finish logs what rendering a deployment logged, then hands its files to
+// the Sink.
+func (e *Engine) finish(ctx context.Context, job *renderedJob) {
+	job.logs.flush(ctx)
+	log := e.log.With("job", job.Name(), "pack", job.Pack())
+	if sink, ok := e.opts.Sink.(ClearingSink); ok {
+		if err := sink.Clear(job.Name()); err != nil {
+			job.Err = errors.Join(job.Err, fmt.Errorf("Can't clear %s: %v", job.Name(), err))
+		}
+	}
+	if e.opts.Sink != nil {
+		for _, name := range slices.Sorted(maps.Keys(job.Files)) {
+			secret := slices.Contains(job.SecretFiles, name)
+			log.Debug("Writing file", "file", name, "secret", secret)
+			write := e.opts.Sink.WriteFile
+			if sink, ok := e.opts.Sink.(SecretSink); ok && secret {
+				write = sink.WriteSecretFile
+			}
+			if err := write(name, job.Files[name]); err != nil {
+				job.Err = errors.Join(job.Err, fmt.Errorf("Can't write %s: %v", name, err))
+				break
+			}
+		}
+	}
+	if job.Err != nil {
+		log.Error("Failed to parse job", "err", job.Err)
+	} else {
+		job.Hash = reconcile.HashFiles(job.Files)
+		log.Debug("Rendered job", "files", len(job.Files), "duration", job.took)
+	}
+	if e.opts.OnRender != nil {
+		e.opts.OnRender(job.RenderedJob, job.took)
+	}
+}
+
+// Origin is where a job's pack comes from, as a URL. Local paths are made
+// file:// URLs below the engine's WorkDir.
+func (e *Engine) Origin(job Job) (string, error) {
+	origin := DefaultOrigin
+	if job.Pack["origin"] != nil && job.Pack["origin"].(string) != "" {
+		origin = job.Pack["origin"].(string)
+	}
+	return e.originURL(origin)
+}
+
+func (e *Engine) originURL(origin string) (string, error) {
+	if strings.HasPrefix(origin, "./") || !strings.Contains(origin, "://") {
+		cwd, err := e.workDir()
+		if err == nil {
+			origin = "file://" + cwd + "/" + origin
+		} else {
+			return "", fmt.Errorf("Current Working Directory for origin \"%s\" failed: %v", origin, err)
+		}
+	}
+	return origin, nil
+}
+
+// renderJob renders the templates of a deployment's pack, layered over
+// those of the packs it extends and under overrides when not nil, handing
+// each file to fileWrite. Templates read other jobs through refs.
+func (e *Engine) renderJob(d Deployment, overrides fs.FS, refs *references, log *slog.Logger, fileWrite func(string, []byte) error) error {
+	job, target := d.Job, d.Target
+	var jobToPass confparse.JobAsArgs
+	jobToPass.Pack = job.Pack
+	jobToPass.Args = job.Args
+	jobToPass.JobName = job.JobName
+	jobToPass.Target = target.TemplateArgs()
+	outDir := job.JobName
+	if target.Name != "" {
+		outDir = path.Join(target.Name, job.JobName)
+	}
+	pack := packName(job)
+	origin, err := e.Origin(job)
+	if err != nil {
+		return err
+	}
+	log = log.With("job", job.JobName, "pack", pack, "origin", origins.Redact(origin))
+	if target.Name != "" {
+		log = log.With("target", target.Name)
+	}
+
+	root, err := e.opts.Origins.Lookup(origin)
+	if err != nil {
+		return fmt.Errorf("Can't grab fsimpl filesystem: %v", err)
+	}
+
+	if _, err := fs.Stat(root, "."); err != nil {
+		return fmt.Errorf("Seems like our pack root \"%s\" does not exist", root)
+	}
+
+	chain, err := e.packChain(root, origin, pack)
+	if err != nil {
+		return err
+	}
+	if len(chain) > 1 {
+		names := make([]string, len(chain))
+		for i, layer := range chain {
+			names[i] = layer.name
+		}
+		log.Debug("Pack extends others", "chain", strings.Join(names, " <- "))
+	}
+	if jobToPass.Args, err = e.jobArgs(chain, job); err != nil {
+		return err
+	}
+	// The pack extending no other is at the bottom, then each extending
+	// it and the job's overrides layer over it in turn
+	packTemplates := chain[0].templates
+	var layers []fs.FS
+	for _, layer := range chain[1:] {
+		if layer.templates != nil {
+			layers = append(layers, layer.templates)
+		}
+	}
+	if overrides != nil {
+		layers = append(layers, overrides)
+	}
+	for _, layer := range layers {
+		packTemplates = templating.Overlay(layer, packTemplates)
+	}
+
+	var commonTemplates fs.FS
+	commonRoot, _ := fs.Sub(root, "_common")
+	if err != nil {
+		commonTemplates, _ = fs.Sub(commonRoot, "templates")
+	}
+
+	tpls, raws, err := templating.OutputFiles(packTemplates)
+	if err != nil {
+		return fmt.Errorf("Error grabbing template output files: %v", err)
+	}
+
+	delims, err := packDelims(chain)
+	if err != nil {
+		return err
+	}
+
+	var kept templating.Passthrough
+	var tpl *template.Template
+	tpl, err = templating.Template(packTemplates, commonTemplates, delims, templating.VerbatimFuncs(packTemplates, &kept), refs.funcs(), e.opts.Funcs)
+	if err != nil {
+		return fmt.Errorf("Can't get template: %v", err)
+	}
+	for _, layer := range layers {
+		if tpl, err = templating.ParseOverrides(tpl, layer); err != nil {
+			return err
+		}
+	}
+
+	for _, filePath := range tpls {
+		curTpl, _ := tpl.Clone()
+		finalTpl, err := curTpl.ParseFS(packTemplates, filePath)
+		if err != nil {
+			return fmt.Errorf("Can't ParseFS in job %s @ %s, on %s: %v", job.JobName, origin, filePath, err)
+		}
+		// Parsing the file again brought back the defines in it that
+		// layers above replaced
+		for _, layer := range layers {
+			if finalTpl, err = templating.ParseOverrides(finalTpl, layer); err != nil {
+				return err
+			}
+		}
+
+		// Check if the path is to be decoded
+		outPath := filePath[:len(filePath)-len(".tpl")]
+		var nameBuffer *bytes.Buffer
+		if strings.HasPrefix(outPath, "b64(") && strings.HasSuffix(outPath, ")") {
+			encoded := outPath[len("b64(") : len(outPath)-len(")")]
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return fmt.Errorf("failed to decode base64: %v", err)
+			}
+			nameBuffer = bytes.NewBuffer([]byte{})
+			outPath = string(decoded)
+			nameTpl, _ := curTpl.Clone()
+			nameTpl = nameTpl.Funcs(template.FuncMap{"PASS": jobToPass.Append})
+			err = func() (err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						err = fmt.Errorf("Panic parsing template %s: %v", outPath, r)
+					}
+				}()
+				nameTpl, err = nameTpl.Parse(outPath)
+				if err != nil {
+					return fmt.Errorf("Can't Parse name template %s: %v", outPath, err)
+				}
+				if err = nameTpl.Execute(nameBuffer, jobToPass); err != nil {
+					return fmt.Errorf("Can't Execute name template %s: %v", outPath, err)
+				}
+				return nil
+			}()
+			if err != nil {
+				return err
+			}
+		} else {
+			nameBuffer = bytes.NewBufferString(outPath)
+		}
+
+		// Range on newline because it makes it easiest. Scan defaults to ScanLines
+		outNames := bufio.NewScanner(nameBuffer)
+		jobToPass.NameIndex = -1
+		for outNames.Scan() {
+			outName := outNames.Text()
+			if outName == "" { // easy escape for bad templating work
+				continue
+			}
+			// if a real entry continue
+			jobToPass.NameIndex += 1
+			// Parse job into a buffer...
+			var buffer bytes.Buffer
+			err = func() (err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						err = fmt.Errorf("Panic parsing template %s: %v", filePath, r)
+					}
+				}()
+				// ParseFS names templates by their base name, even in subdirectories
+				if err = finalTpl.ExecuteTemplate(&buffer, path.Base(filePath), jobToPass); err != nil {
+					return fmt.Errorf("Can't Execute on %s: %v", filePath, err)
+				}
+				return nil
+			}()
+			if err != nil {
+				return err
+			}
+
+			// Then prepare to write and write it
+			output := buffer.Bytes()
+			if lines := templating.Unrendered(output, delims, &kept); len(lines) > 0 {
+				log.Warn("Rendered output holds unrendered delimiters", "file", outName, "delims", delims.String(), "lines", lines)
+			}
+			if strings.HasSuffix(outName, ".nomad") || strings.HasSuffix(outName, ".hcl") {
+				formatted, diag := hclwrite.ParseConfig(output, "", hcl.Pos{Line: 1, Column: 1})
+				if diag.HasErrors() {
+					log.Error("Failed to parse HCL", "file", outName, "err", diag.Error(), "rendered", buffer.String())
+				} else {
+					output = formatted.Bytes()
+				}
+			} else if kube.IsManifest(outName) {
+				formatted, err := kube.Format(output)
+				if err != nil {
+					log.Error("Failed to parse Kubernetes manifest", "file", outName, "err", err, "rendered", buffer.String())
+				} else {
+					output = formatted
+				}
+			}
+			err = fileWrite(path.Join(outDir, outName), output)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, filePath := range raws {
+		output, err := fs.ReadFile(packTemplates, filePath)
+		if err != nil {
+			return fmt.Errorf("Can't Copy %s: %v", filePath, err)
+		}
+		if err := fileWrite(path.Join(outDir, filePath), output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
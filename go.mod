@@ -3,6 +3,7 @@ module github.com/Vaelatern/nomad-declarative
 go 1.24.1
 
 require (
+	filippo.io/age v1.2.1
 	github.com/BurntSushi/toml v1.4.0
 	github.com/Masterminds/sprig/v3 v3.3.0
 	github.com/hairyhenderson/go-fsimpl v0.2.5
@@ -1,8 +1,11 @@
 package confparse
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
+	"slices"
 
 	"github.com/BurntSushi/toml"
 )
@@ -18,12 +21,16 @@ type Job struct {
 	JobName string
 	Args    JobArgs
 	Pack    PackSettings
+	// Decrypted are the plaintexts of the encrypted values among the job's
+	// and its pack's settings, to be kept as secret as `secret://` ones
+	Decrypted []string
 }
 
 type JobAsArgs struct {
 	JobName   string
 	Args      map[string]interface{}
 	Pack      PackSettings
+	Target    map[string]interface{}
 	FileName  string
 	NameArgs  []interface{}
 	NameIndex int
@@ -36,24 +43,86 @@ func (j *JobAsArgs) Append(in any) (string, error) {
 
 type Jobs map[string]Job
 
+// Config is everything declared in the config: the jobs, and the top-level
+// tables starting with an underscore that configure the tool itself.
+type Config struct {
+	Jobs    Jobs
+	Targets Targets
+}
+
 // ParseTOMLToJobs parses a TOML input from an io.Reader and returns a map of Jobs.
 // It is important for later merging that there are no extra defaults set here.
 func ParseTOMLToJobs(reader io.Reader) (Jobs, error) {
-	wrappedReader, err := TemplateSuperpowers(reader)
+	conf, err := ParseTOML(reader)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to go-template the toml itself: %v", err)
+		return nil, err
+	}
+	return conf.Jobs, nil
+}
+
+// ParseTOML parses a whole config. Top-level tables are packs, except those
+// starting with an underscore like `_targets`. A whole encrypted file, and
+// encrypted string values, are decrypted with the identities from
+// LoadIdentities.
+func ParseTOML(reader io.Reader) (Config, error) {
+	return parseTOML(reader, nil, "config.toml", TemplateOptions{})
+}
+
+// ParseTOMLFile parses the config file name of fsys as ParseTOML does, its
+// template reading the files beside it.
+func ParseTOMLFile(fsys fs.FS, name string, opts TemplateOptions) (Config, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+	return parseTOML(f, fsys, name, opts)
+}
+
+func parseTOML(reader io.Reader, fsys fs.FS, name string, opts TemplateOptions) (Config, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return Config{}, err
+	}
+	var dec decrypter
+	if data, err = dec.file(data); err != nil {
+		return Config{}, err
+	}
+	wrappedReader, err := TemplateSuperpowers(bytes.NewReader(data), fsys, name, opts)
+	if err != nil {
+		return Config{}, fmt.Errorf("Failed to go-template the toml itself: %v", err)
 	}
 
 	// Load the entire TOML data into a generic map
 	var rawConfig map[string]map[string]interface{}
 	if _, err := toml.NewDecoder(wrappedReader).Decode(&rawConfig); err != nil {
-		return nil, fmt.Errorf("failed to decode TOML: %w", err)
+		return Config{}, fmt.Errorf("failed to decode TOML: %w", err)
+	}
+	for name, table := range rawConfig {
+		if _, err := dec.values(table, name); err != nil {
+			return Config{}, err
+		}
 	}
 
 	jobs := make(Jobs)
+	targets := make(Targets)
+
+	if raw, ok := rawConfig["_targets"]; ok {
+		targets, err = parseTargets(map[string]interface{}(raw))
+		if err != nil {
+			return Config{}, err
+		}
+		for name, t := range targets {
+			t.Decrypted = dec.under("_targets." + name + ".")
+			targets[name] = t
+		}
+	}
 
 	// Iterate over the packs and jobs
 	for packName, packContents := range rawConfig {
+		if packName[0] == '_' {
+			continue
+		}
 		// Extract pack-level arguments (if any)
 		packArgs := make(PackSettings)
 		packArgs["name"] = packName
@@ -74,14 +143,28 @@ func ParseTOMLToJobs(reader io.Reader) (Jobs, error) {
 				jobArgsAsDict["jobname"] = jobName
 			}
 			jobs[jobName] = Job{
-				JobName: jobName,
-				Args:    jobArgsAsDict,
-				Pack:    packArgs,
+				JobName:   jobName,
+				Args:      jobArgsAsDict,
+				Pack:      packArgs,
+				Decrypted: dec.under(packName+"."+jobName+".", packName+"._"),
 			}
 		}
 	}
 
-	return jobs, nil
+	return Config{Jobs: jobs, Targets: targets}, nil
+}
+
+// MergeConfig merges the jobs as MergeJobs does. A target in override
+// replaces the one of the same name whole.
+func MergeConfig(a Config, override Config) Config {
+	targets := make(Targets)
+	for name, t := range a.Targets {
+		targets[name] = t
+	}
+	for name, t := range override.Targets {
+		targets[name] = t
+	}
+	return Config{Jobs: MergeJobs(a.Jobs, override.Jobs), Targets: targets}
 }
 
 func MergeJobs(a Jobs, override Jobs) Jobs {
@@ -90,9 +173,10 @@ func MergeJobs(a Jobs, override Jobs) Jobs {
 	// Copy all jobs from 'a' to result
 	for jobName, job := range a {
 		result[jobName] = Job{
-			JobName: job.JobName,
-			Args:    make(JobArgs),
-			Pack:    make(PackSettings),
+			JobName:   job.JobName,
+			Args:      make(JobArgs),
+			Pack:      make(PackSettings),
+			Decrypted: slices.Clone(job.Decrypted),
 		}
 		// Copy Args
 		for k, v := range job.Args {
@@ -131,9 +215,71 @@ func MergeJobs(a Jobs, override Jobs) Jobs {
 			job.Pack[k] = v
 		}
 
+		// A value overridden may still have been seen, keep both
+		job.Decrypted = append(job.Decrypted, overrideJob.Decrypted...)
+
 		// Reassign the modified job back to the map
 		result[jobName] = job
 	}
 
 	return result
 }
+
+// Setting looks up a tool setting for a job. A job can set it with an
+// underscore-prefixed arg, otherwise the pack-level setting is used.
+func (j Job) Setting(key string) (interface{}, bool) {
+	if v, ok := j.Args["_"+key]; ok {
+		return v, true
+	}
+	v, ok := j.Pack[key]
+	return v, ok
+}
+
+// DependsOn returns the names of jobs that must be submitted before this one,
+// as declared by the `_depends_on` setting.
+func (j Job) DependsOn() ([]string, error) {
+	v, ok := j.Setting("depends_on")
+	if !ok {
+		return nil, nil
+	}
+	return stringList(v)
+}
+
+// Retries returns the `_retries` setting, and false if neither the job nor
+// its pack set one.
+func (j Job) Retries() (int, bool, error) {
+	v, ok := j.Setting("retries")
+	if !ok {
+		return 0, false, nil
+	}
+	switch n := v.(type) {
+	case int64:
+		return int(n), true, nil
+	case int:
+		return n, true, nil
+	default:
+		return 0, false, fmt.Errorf("expected a whole number for _retries, got %T", v)
+	}
+}
+
+// stringList accepts either a single string or a list of strings.
+func stringList(v interface{}) ([]string, error) {
+	switch val := v.(type) {
+	case string:
+		return []string{val}, nil
+	case []string:
+		return val, nil
+	case []interface{}:
+		out := make([]string, 0, len(val))
+		for _, item := range val {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a list of strings, found %T in it", item)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("expected a string or list of strings, got %T", v)
+	}
+}
@@ -2,9 +2,11 @@ package confparse
 
 import (
 	"io"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestParseTOMLToJobs(t *testing.T) {
@@ -168,3 +170,69 @@ job_arg_2 = "def"
 		t.Errorf("ParseTOMLToJobs() = %v, want %v", jobsTotal, expectedJobs)
 	}
 }
+
+func TestParseTOMLFileTemplate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"config.d/10-web.toml": {Data: []byte(`
+[web.frontend]
+path = "{{ $ctx.Path }}"
+target = "{{ $ctx.Target }}"
+first = {{ . | trim | splitList "\n" | first | quote }}
+banner = {{ file "banner.txt" | trim | quote }}
+parts = {{ glob "parts/*.txt" | toJson }}
+port = {{ (readToml "ports.toml").web }}
+region = "{{ (readYaml "site.yaml").region }}"
+owner = "{{ (readJson "owner.json").name }}"
+host = "{{ $ctx.Hostname }}"
+{{ define "dir" }}{{ context.Dir }}{{ end }}dir = "{{ template "dir" }}"
+`)},
+		"config.d/banner.txt":    {Data: []byte("hello\n")},
+		"config.d/parts/a.txt":   {},
+		"config.d/parts/b.txt":   {},
+		"config.d/ports.toml":    {Data: []byte("web = 8080\n")},
+		"config.d/site.yaml":     {Data: []byte("region: eu\n")},
+		"config.d/owner.json":    {Data: []byte(`{"name": "ops"}`)},
+		"config.d/20-nomad.toml": {Data: []byte("# nomad-declarative: no-template\n[api.server]\ntpl = \"{{ key \\\"x\\\" }}\"\n")},
+		"escape.toml":            {Data: []byte("[web.frontend]\nx = {{ file \"../secret\" | quote }}\n")},
+	}
+	conf, err := ParseTOMLFile(fsys, "config.d/10-web.toml", TemplateOptions{Targets: []string{"east"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	want := JobArgs{
+		"jobname": "frontend",
+		"path":    "config.d/10-web.toml",
+		"target":  "east",
+		"banner":  "hello",
+		"parts":   []interface{}{"parts/a.txt", "parts/b.txt"},
+		"port":    int64(8080),
+		"region":  "eu",
+		"owner":   "ops",
+		"host":    hostname,
+		"first":   "[web.frontend]",
+		"dir":     "config.d",
+	}
+	if got := conf.Jobs["frontend"].Args; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v\nwant %#v", got, want)
+	}
+
+	conf, err = ParseTOMLFile(fsys, "config.d/20-nomad.toml", TemplateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conf.Jobs["server"].Args["tpl"]; got != `{{ key "x" }}` {
+		t.Errorf("a file with the directive was templated: %v", got)
+	}
+	if _, err := ParseTOMLFile(fsys, "escape.toml", TemplateOptions{}); err == nil {
+		t.Errorf("a file outside the working dir was read")
+	}
+	fsys["plain.toml"] = &fstest.MapFile{Data: []byte("[api.server]\ntpl = \"{{ key \\\"x\\\" }}\"\n")}
+	conf, err = ParseTOMLFile(fsys, "plain.toml", TemplateOptions{Disabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conf.Jobs["server"].Args["tpl"]; got != `{{ key "x" }}` {
+		t.Errorf("templating was not disabled: %v", got)
+	}
+}
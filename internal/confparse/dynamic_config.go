@@ -1,26 +1,81 @@
 package confparse
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
+	"strings"
 	"text/template"
 
 	"github.com/BurntSushi/toml"
 	"github.com/Masterminds/sprig/v3"
+	"gopkg.in/yaml.v3"
 )
 
-func TemplateSuperpowers(r io.Reader) (io.Reader, error) {
+// NoTemplateDirective, among the comments a config file starts with, keeps
+// it from being templated, for files holding literal `{{`.
+const NoTemplateDirective = "# nomad-declarative: no-template"
+
+// TemplateOptions tune how config files are templated.
+type TemplateOptions struct {
+	// Targets are those the command was asked to work on
+	Targets []string
+	// Disabled leaves every config file as written
+	Disabled bool
+}
+
+// TemplateContext is what a config file's template sees as `$ctx`, and gets
+// from `context` in templates it defines. `.` is the file's text, as it
+// always was.
+type TemplateContext struct {
+	// Path is the config file's, Dir the dir holding it, where `file`,
+	// `glob` and the read functions look
+	Path string
+	Dir  string
+	// Hostname is the machine's name, empty when it can't be found
+	Hostname string
+	// Target is the one target asked for, empty unless there is exactly
+	// one in Targets
+	Target  string
+	Targets []string
+}
+
+// contextVar declares $ctx ahead of a config file's own text, without a
+// newline so lines in errors still match the file.
+const contextVar = "{{ $ctx := context }}"
+
+// noTemplate reports if the comments data starts with include the
+// NoTemplateDirective.
+func noTemplate(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == NoTemplateDirective {
+			return true
+		}
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return false
+}
+
+// TemplateSuperpowers runs a config file through text/template with sprig,
+// `env`, `toToml`, and when fsys is given the functions reading files
+// beside it. name is the file's path in fsys.
+func TemplateSuperpowers(r io.Reader, fsys fs.FS, name string, opts TemplateOptions) (io.Reader, error) {
 	// Read input
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-
-	tmpl, err := template.New("config").Parse(string(data))
-	if err != nil {
-		return nil, err
+	if opts.Disabled || noTemplate(data) {
+		return bytes.NewReader(data), nil
 	}
 
 	// Build function map
@@ -47,10 +102,29 @@ func TemplateSuperpowers(r io.Reader) (io.Reader, error) {
 		return buf.String()
 	}
 
-	// Apply functions to template
-	tmpl = tmpl.Funcs(funcMap)
+	ctx := TemplateContext{
+		Path:    name,
+		Dir:     path.Dir(name),
+		Targets: opts.Targets,
+	}
+	ctx.Hostname, _ = os.Hostname()
+	if len(opts.Targets) == 1 {
+		ctx.Target = opts.Targets[0]
+	}
+	files := siblingFiles{fsys: fsys, dir: ctx.Dir}
+	funcMap["file"] = files.file
+	funcMap["glob"] = files.glob
+	funcMap["readToml"] = files.readToml
+	funcMap["readYaml"] = files.readYaml
+	funcMap["readJson"] = files.readJSON
+	funcMap["context"] = func() TemplateContext { return ctx }
+
+	// Functions must be known before parsing
+	tmpl, err := template.New("config").Funcs(funcMap).Parse(contextVar + string(data))
+	if err != nil {
+		return nil, err
+	}
 
-	// Execute template with input data as string (or keep as []byte if preferred)
 	var out bytes.Buffer
 	if err := tmpl.Execute(&out, string(data)); err != nil {
 		return nil, err
@@ -58,3 +132,77 @@ func TemplateSuperpowers(r io.Reader) (io.Reader, error) {
 
 	return bytes.NewReader(out.Bytes()), nil
 }
+
+// siblingFiles reads files relative to a config file's dir, never outside
+// of fsys.
+type siblingFiles struct {
+	fsys fs.FS
+	dir  string
+}
+
+func (s siblingFiles) path(name string) (string, error) {
+	if s.fsys == nil {
+		return "", fmt.Errorf("no files can be read from this config")
+	}
+	p := path.Join(s.dir, name)
+	if path.IsAbs(name) || !fs.ValidPath(p) {
+		return "", fmt.Errorf("%s is outside of the working dir", name)
+	}
+	return p, nil
+}
+
+// file is the contents of a file.
+func (s siblingFiles) file(name string) (string, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := fs.ReadFile(s.fsys, p)
+	return string(data), err
+}
+
+// glob lists the files matching pattern, relative to the config file's dir
+// as they are given to the other functions.
+func (s siblingFiles) glob(pattern string) ([]string, error) {
+	p, err := s.path(pattern)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := fs.Glob(s.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range matches {
+		matches[i] = strings.TrimPrefix(m, strings.TrimPrefix(s.dir+"/", "./"))
+	}
+	return matches, nil
+}
+
+func (s siblingFiles) readToml(name string) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	err := s.decode(name, func(data []byte) error { return toml.Unmarshal(data, &out) })
+	return out, err
+}
+
+func (s siblingFiles) readYaml(name string) (interface{}, error) {
+	var out interface{}
+	err := s.decode(name, func(data []byte) error { return yaml.Unmarshal(data, &out) })
+	return out, err
+}
+
+func (s siblingFiles) readJSON(name string) (interface{}, error) {
+	var out interface{}
+	err := s.decode(name, func(data []byte) error { return json.Unmarshal(data, &out) })
+	return out, err
+}
+
+func (s siblingFiles) decode(name string, decode func([]byte) error) error {
+	contents, err := s.file(name)
+	if err != nil {
+		return err
+	}
+	if err := decode([]byte(contents)); err != nil {
+		return fmt.Errorf("Can't parse %s: %v", name, err)
+	}
+	return nil
+}
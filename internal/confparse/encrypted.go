@@ -0,0 +1,357 @@
+package confparse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/BurntSushi/toml"
+)
+
+// Config fragments are encrypted with age. The identities decrypting them,
+// as age-keygen writes them, are in KeyEnv or in the file KeyFileEnv names;
+// that may be the same file sops reads. They are encrypted to the
+// recipients in RecipientsEnv, or to those of the identities.
+const (
+	KeyEnv        = "NOMAD_DECLARATIVE_AGE_KEY"
+	KeyFileEnv    = "NOMAD_DECLARATIVE_AGE_KEY_FILE"
+	RecipientsEnv = "NOMAD_DECLARATIVE_AGE_RECIPIENTS"
+)
+
+// encryptedValue is a string setting encrypted on its own, the base64 of
+// the binary age file.
+var encryptedValue = regexp.MustCompile(`^ENC\[age,([A-Za-z0-9+/=]+)\]$`)
+
+// LoadIdentities reads the age identities from the environment.
+func LoadIdentities() ([]age.Identity, error) {
+	keys := os.Getenv(KeyEnv)
+	if keys == "" {
+		path := os.Getenv(KeyFileEnv)
+		if path == "" {
+			return nil, fmt.Errorf("the config is encrypted, set %s or %s", KeyEnv, KeyFileEnv)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read key file: %v", err)
+		}
+		keys = string(data)
+	}
+	identities, err := age.ParseIdentities(strings.NewReader(keys))
+	if err != nil {
+		return nil, fmt.Errorf("Can't read the age identities: %v", err)
+	}
+	return identities, nil
+}
+
+// LoadRecipients reads the age recipients to encrypt to from RecipientsEnv,
+// separated by commas, spaces or newlines, or else takes those of the
+// identities.
+func LoadRecipients() ([]age.Recipient, error) {
+	if listed := os.Getenv(RecipientsEnv); listed != "" {
+		fields := strings.FieldsFunc(listed, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' })
+		recipients, err := age.ParseRecipients(strings.NewReader(strings.Join(fields, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", RecipientsEnv, err)
+		}
+		return recipients, nil
+	}
+	identities, err := LoadIdentities()
+	if err != nil {
+		return nil, fmt.Errorf("no recipients to encrypt to, set %s or the identities: %v", RecipientsEnv, err)
+	}
+	var recipients []age.Recipient
+	for _, id := range identities {
+		if x, ok := id.(*age.X25519Identity); ok {
+			recipients = append(recipients, x.Recipient())
+		}
+	}
+	return recipients, nil
+}
+
+// GenerateKey makes a new age identity, in the format of age-keygen with
+// its recipient as a comment.
+func GenerateKey() (string, error) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("# public key: %s\n%s\n", id.Recipient(), id), nil
+}
+
+func encrypt(w io.Writer, recipients []age.Recipient, plaintext []byte) error {
+	enc, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := enc.Write(plaintext); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func decrypt(r io.Reader, identities []age.Identity) ([]byte, error) {
+	dec, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("Can't decrypt: %v", err)
+	}
+	plaintext, err := io.ReadAll(dec)
+	if err != nil {
+		return nil, fmt.Errorf("Can't decrypt: %v", err)
+	}
+	return plaintext, nil
+}
+
+// IsEncryptedFile reports if data is a whole age encrypted file, armored
+// or not.
+func IsEncryptedFile(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return bytes.HasPrefix(data, []byte(armor.Header)) || bytes.HasPrefix(data, []byte("age-encryption.org/v1\n"))
+}
+
+// EncryptFile encrypts a whole file to recipients, armored as `age -a`
+// does.
+func EncryptFile(recipients []age.Recipient, plaintext []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := armor.NewWriter(&b)
+	if err := encrypt(w, recipients, plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	b.WriteString("\n")
+	return b.Bytes(), nil
+}
+
+// DecryptFile decrypts an age encrypted file, armored or not.
+func DecryptFile(identities []age.Identity, data []byte) ([]byte, error) {
+	if !IsEncryptedFile(data) {
+		return nil, fmt.Errorf("not an encrypted file")
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); bytes.HasPrefix(trimmed, []byte(armor.Header)) {
+		r = armor.NewReader(bytes.NewReader(trimmed))
+	}
+	return decrypt(r, identities)
+}
+
+// IsEncryptedValue reports if s is a value EncryptValue encrypted.
+func IsEncryptedValue(s string) bool {
+	return encryptedValue.MatchString(s)
+}
+
+// EncryptValue encrypts one string setting to recipients as
+// `ENC[age,...]`, the base64 of what `age -r` would write.
+func EncryptValue(recipients []age.Recipient, plaintext string) (string, error) {
+	var b bytes.Buffer
+	if err := encrypt(&b, recipients, []byte(plaintext)); err != nil {
+		return "", err
+	}
+	return "ENC[age," + base64.StdEncoding.EncodeToString(b.Bytes()) + "]", nil
+}
+
+// DecryptValue decrypts what EncryptValue encrypted.
+func DecryptValue(identities []age.Identity, s string) (string, error) {
+	m := encryptedValue.FindStringSubmatch(s)
+	if m == nil {
+		return "", fmt.Errorf("not an encrypted value")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := decrypt(bytes.NewReader(sealed), identities)
+	return string(plaintext), err
+}
+
+// decrypter loads the identities the first time something needs
+// decrypting, so configs without anything encrypted need none.
+type decrypter struct {
+	identities []age.Identity
+	// found holds the plaintext of each value decrypted, by its path
+	found map[string]string
+}
+
+func (d *decrypter) loadIdentities() ([]age.Identity, error) {
+	if d.identities == nil {
+		identities, err := LoadIdentities()
+		if err != nil {
+			return nil, err
+		}
+		d.identities = identities
+	}
+	return d.identities, nil
+}
+
+func (d *decrypter) file(data []byte) ([]byte, error) {
+	if !IsEncryptedFile(data) {
+		return data, nil
+	}
+	identities, err := d.loadIdentities()
+	if err != nil {
+		return nil, err
+	}
+	return DecryptFile(identities, data)
+}
+
+// values decrypts every encrypted string below v in place, where being the
+// path to v.
+func (d *decrypter) values(v interface{}, where string) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		if !IsEncryptedValue(val) {
+			return val, nil
+		}
+		identities, err := d.loadIdentities()
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := DecryptValue(identities, val)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", where, err)
+		}
+		if d.found == nil {
+			d.found = make(map[string]string)
+		}
+		d.found[where] = plaintext
+		return plaintext, nil
+	case map[string]interface{}:
+		for k, item := range val {
+			decrypted, err := d.values(item, where+"."+k)
+			if err != nil {
+				return nil, err
+			}
+			val[k] = decrypted
+		}
+	case []interface{}:
+		for i, item := range val {
+			decrypted, err := d.values(item, fmt.Sprintf("%s[%d]", where, i))
+			if err != nil {
+				return nil, err
+			}
+			val[i] = decrypted
+		}
+	case []map[string]interface{}:
+		for i, item := range val {
+			if _, err := d.values(item, fmt.Sprintf("%s[%d]", where, i)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// under are the plaintexts of the values decrypted at paths starting with
+// any of prefixes.
+func (d *decrypter) under(prefixes ...string) []string {
+	var out []string
+	for where, plaintext := range d.found {
+		for _, p := range prefixes {
+			if strings.HasPrefix(where, p) {
+				out = append(out, plaintext)
+				break
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// SetValue sets the string at a dotted path, like `pack.job.password`, in
+// the TOML of data, keeping the rest of it as it is. The key is replaced on
+// its line when found in its table, else added at the top of the table,
+// which is added at the end when missing.
+func SetValue(data []byte, path string, value string) ([]byte, error) {
+	parts := strings.Split(path, ".")
+	if len(parts) < 2 || slices.Contains(parts, "") {
+		return nil, fmt.Errorf("expected a path like pack.job.key, got %q", path)
+	}
+	table := strings.Join(parts[:len(parts)-1], ".")
+	key := parts[len(parts)-1]
+	keyText := key
+	if !bareKey.MatchString(key) {
+		keyText = fmt.Sprintf("%q", key)
+	}
+	line := fmt.Sprintf("%s = %q", keyText, value)
+
+	lines := strings.SplitAfter(string(data), "\n")
+	current, header := "", -1
+	for i, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, "[") {
+			current = tableName(trimmed)
+			if current == table {
+				header = i
+			}
+			continue
+		}
+		if current != table || header < 0 {
+			continue
+		}
+		name, rest, ok := strings.Cut(trimmed, "=")
+		if !ok || strings.Trim(strings.TrimSpace(name), `"'`) != key {
+			continue
+		}
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, `"""`) || strings.HasPrefix(rest, "'''") || (strings.HasPrefix(rest, "[") && !strings.HasSuffix(rest, "]")) {
+			return nil, fmt.Errorf("%s spans several lines, change it by hand", path)
+		}
+		indent := l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+		lines[i] = indent + line + "\n"
+		return checkSet(strings.Join(lines, ""), parts, value)
+	}
+	if header >= 0 {
+		lines = append(lines[:header+1], append([]string{line + "\n"}, lines[header+1:]...)...)
+		return checkSet(strings.Join(lines, ""), parts, value)
+	}
+	out := string(data)
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	return checkSet(out+"\n["+table+"]\n"+line+"\n", parts, value)
+}
+
+// tableName is the name in a `[table]` header, without spaces around dots
+// or quotes.
+func tableName(header string) string {
+	if strings.HasPrefix(header, "[[") {
+		return ""
+	}
+	name, _, _ := strings.Cut(strings.TrimPrefix(header, "["), "]")
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(p), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// checkSet makes sure the edit gave valid TOML with value at its path.
+func checkSet(out string, parts []string, value string) ([]byte, error) {
+	var parsed map[string]interface{}
+	if _, err := toml.Decode(out, &parsed); err != nil {
+		return nil, fmt.Errorf("Can't set %s, the file would not parse: %v", strings.Join(parts, "."), err)
+	}
+	var cur interface{} = parsed
+	for _, p := range parts {
+		table, ok := cur.(map[string]interface{})
+		if !ok {
+			cur = nil
+			break
+		}
+		cur = table[p]
+	}
+	if cur != value {
+		return nil, fmt.Errorf("Can't set %s in place, change it by hand", strings.Join(parts, "."))
+	}
+	return []byte(out), nil
+}
@@ -0,0 +1,179 @@
+package confparse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func testKey(t *testing.T) []age.Recipient {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(KeyEnv, key)
+	t.Setenv(RecipientsEnv, "")
+	recipients, err := LoadRecipients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recipients
+}
+
+func TestParseTOMLEncrypted(t *testing.T) {
+	recipients := testKey(t)
+	password, err := EncryptValue(recipients, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := EncryptValue(recipients, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := EncryptValue(recipients, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := `
+[db.postgres]
+password = "` + password + `"
+users = ["app", "` + user + `"]
+_env = { NOMAD_TOKEN = "` + token + `" }
+`
+	sealed, err := EncryptFile(recipients, []byte(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("postgres")) || !bytes.HasPrefix(sealed, []byte("-----BEGIN AGE ENCRYPTED FILE-----\n")) {
+		t.Errorf("the encrypted file is not an armored age file:\n%s", sealed)
+	}
+	for name, data := range map[string][]byte{"values": []byte(plain), "file": sealed} {
+		conf, err := ParseTOML(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		args := conf.Jobs["postgres"].Args
+		if args["password"] != "hunter2" || args["users"].([]interface{})[1] != "hunter2" {
+			t.Errorf("%s: values not decrypted: %v", name, args)
+		}
+		env, err := conf.Jobs["postgres"].Env()
+		if err != nil || env["NOMAD_TOKEN"].Value != "s3cret" {
+			t.Errorf("%s: _env not decrypted: %v %v", name, env, err)
+		}
+		if !env["NOMAD_TOKEN"].Secret {
+			t.Errorf("%s: a decrypted _env value is not secret", name)
+		}
+		if want := []string{"hunter2", "hunter2", "s3cret"}; name == "values" && !slices.Equal(conf.Jobs["postgres"].Decrypted, want) {
+			t.Errorf("%s: Decrypted = %v, want %v", name, conf.Jobs["postgres"].Decrypted, want)
+		}
+	}
+
+	testKey(t)
+	if _, err := ParseTOML(bytes.NewReader(sealed)); err == nil || !strings.Contains(err.Error(), "no identity matched") {
+		t.Errorf("decrypting with the wrong key gave %v", err)
+	}
+	t.Setenv(KeyEnv, "")
+	if _, err := ParseTOML(bytes.NewReader([]byte(plain))); err == nil || !strings.Contains(err.Error(), KeyEnv) {
+		t.Errorf("decrypting without a key gave %v", err)
+	}
+	if _, err := ParseTOML(strings.NewReader("[web.frontend]\nmsg = \"no key needed\"\n")); err != nil {
+		t.Errorf("a config without anything encrypted needs a key: %v", err)
+	}
+}
+
+func TestEncryptedValueIsAge(t *testing.T) {
+	recipients := testKey(t)
+	value, err := EncryptValue(recipients, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What age -d would be given after base64 -d
+	m := encryptedValue.FindStringSubmatch(value)
+	if m == nil {
+		t.Fatalf("EncryptValue() = %q", value)
+	}
+	identities, err := LoadIdentities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, _ := base64.StdEncoding.DecodeString(m[1])
+	r, err := age.Decrypt(bytes.NewReader(binary), identities...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, _ := io.ReadAll(r); string(plaintext) != "hunter2" {
+		t.Errorf("age decrypted %q", plaintext)
+	}
+}
+
+func TestLoadIdentitiesFile(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := age.GenerateX25519Identity()
+	path := filepath.Join(t.TempDir(), "keys.txt")
+	if err := os.WriteFile(path, []byte(key+"\n"+other.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(KeyEnv, "")
+	t.Setenv(KeyFileEnv, path)
+	identities, err := LoadIdentities()
+	if err != nil || len(identities) != 2 {
+		t.Errorf("LoadIdentities() = %v, %v", identities, err)
+	}
+	t.Setenv(KeyEnv, "AGE-SECRET-KEY-1NOTAKEY")
+	if _, err := LoadIdentities(); err == nil {
+		t.Errorf("a bad identity was taken")
+	}
+
+	t.Setenv(RecipientsEnv, other.Recipient().String()+", "+other.Recipient().String())
+	recipients, err := LoadRecipients()
+	if err != nil || len(recipients) != 2 {
+		t.Errorf("LoadRecipients() = %v, %v", recipients, err)
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	in := `# the databases
+[db]
+_origin = "./packs"
+
+[db . "postgres"]
+  password = "old" # rotated yearly
+port = 5432
+
+[web.frontend]
+msg = "hi"
+`
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"db.postgres.password", strings.Replace(in, `  password = "old" # rotated yearly`, `  password = "new"`, 1)},
+		{"db.postgres.user", strings.Replace(in, "[db . \"postgres\"]\n", "[db . \"postgres\"]\nuser = \"new\"\n", 1)},
+		{"cache.redis.password", in + "\n[cache.redis]\npassword = \"new\"\n"},
+	}
+	for _, c := range cases {
+		got, err := SetValue([]byte(in), c.path, "new")
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+		} else if string(got) != c.want {
+			t.Errorf("%s gave:\n%s\nwant:\n%s", c.path, got, c.want)
+		}
+	}
+	if _, err := SetValue([]byte("[a.b]\nkey = \"\"\"\nmulti\n\"\"\"\n"), "a.b.key", "new"); err == nil {
+		t.Errorf("a multi-line value was replaced")
+	}
+	if _, err := SetValue([]byte(in), "password", "new"); err == nil {
+		t.Errorf("a path without a table was taken")
+	}
+}
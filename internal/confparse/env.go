@@ -0,0 +1,102 @@
+package confparse
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// EnvVar is one resolved entry of an `_env` setting.
+type EnvVar struct {
+	Value string
+	// Secret values are not to be shown in logs or reports.
+	Secret bool
+}
+
+// Env resolves the `_env` settings of the pack and then the job, the job
+// winning on a clash. Each value is either a plain string, or a table naming
+// where to find it:
+//
+//	_env = { NOMAD_NAMESPACE = "apps", NOMAD_TOKEN = { env = "APPS_TOKEN" } }
+//	_env.NOMAD_TOKEN = { file = "/run/secrets/apps-token" }
+//
+// Values read from the environment or a file are treated as secrets unless
+// the table says `secret = false`, as are those that were encrypted.
+func (j Job) Env() (map[string]EnvVar, error) {
+	out := make(map[string]EnvVar)
+	for _, src := range []interface{}{j.Pack["env"], j.Args["_env"]} {
+		if src == nil {
+			continue
+		}
+		table, ok := src.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a table for _env, got %T", src)
+		}
+		for name, raw := range table {
+			v, err := resolveEnvVar(raw)
+			if err != nil {
+				return nil, fmt.Errorf("_env.%s: %v", name, err)
+			}
+			out[name] = markDecrypted(v, j.Decrypted)
+		}
+	}
+	return out, nil
+}
+
+// markDecrypted makes v secret when its value was encrypted in the config.
+func markDecrypted(v EnvVar, decrypted []string) EnvVar {
+	if v.Value != "" && slices.Contains(decrypted, v.Value) {
+		v.Secret = true
+	}
+	return v
+}
+
+func resolveEnvVar(raw interface{}) (EnvVar, error) {
+	switch val := raw.(type) {
+	case string:
+		return EnvVar{Value: val}, nil
+	case map[string]interface{}:
+		v := EnvVar{Secret: true}
+		if secret, ok := val["secret"].(bool); ok {
+			v.Secret = secret
+		}
+		if name, ok := val["env"].(string); ok {
+			found, ok := os.LookupEnv(name)
+			if !ok {
+				return v, fmt.Errorf("environment variable %s is not set", name)
+			}
+			v.Value = found
+			return v, nil
+		}
+		if path, ok := val["file"].(string); ok {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return v, err
+			}
+			v.Value = strings.TrimRight(string(data), "\r\n")
+			return v, nil
+		}
+		return v, fmt.Errorf("expected an env or file key")
+	default:
+		return EnvVar{}, fmt.Errorf("expected a string or table, got %T", raw)
+	}
+}
+
+// EnvList formats the variables as KEY=value pairs, sorted by key, along
+// with the values that are secret.
+func EnvList(vars map[string]EnvVar) (env []string, secrets []string) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+vars[name].Value)
+		if vars[name].Secret && vars[name].Value != "" {
+			secrets = append(secrets, vars[name].Value)
+		}
+	}
+	return env, secrets
+}
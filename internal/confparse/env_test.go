@@ -0,0 +1,56 @@
+package confparse
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJob_Env(t *testing.T) {
+	t.Setenv("APPS_TOKEN", "s3cret")
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := ParseTOMLToJobs(strings.NewReader(`
+[apps]
+_env = { NOMAD_NAMESPACE = "apps", NOMAD_REGION = "global" }
+
+[apps.web]
+_env.NOMAD_REGION = "east"
+_env.NOMAD_TOKEN = { env = "APPS_TOKEN" }
+_env.EXTRA = { file = "` + tokenFile + `", secret = false }
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := jobs["web"].Env()
+	if err != nil {
+		t.Fatalf("Env() error = %v", err)
+	}
+	want := map[string]EnvVar{
+		"NOMAD_NAMESPACE": {Value: "apps"},
+		"NOMAD_REGION":    {Value: "east"},
+		"NOMAD_TOKEN":     {Value: "s3cret", Secret: true},
+		"EXTRA":           {Value: "from-file"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Env() = %v, want %v", got, want)
+	}
+
+	env, secrets := EnvList(got)
+	wantEnv := []string{"EXTRA=from-file", "NOMAD_NAMESPACE=apps", "NOMAD_REGION=east", "NOMAD_TOKEN=s3cret"}
+	if !reflect.DeepEqual(env, wantEnv) || !reflect.DeepEqual(secrets, []string{"s3cret"}) {
+		t.Errorf("EnvList() = %v, %v", env, secrets)
+	}
+}
+
+func TestJob_EnvMissingVariable(t *testing.T) {
+	job := Job{Args: JobArgs{"_env": map[string]interface{}{"X": map[string]interface{}{"env": "SURELY_NOT_SET_ANYWHERE"}}}}
+	if _, err := job.Env(); err == nil {
+		t.Errorf("Env() should fail when the variable is not set")
+	}
+}
@@ -0,0 +1,128 @@
+package confparse
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Target is a named cluster jobs can be deployed to. The settings come from
+// a `[_targets.<name>]` table at the top level of the config:
+//
+//	[_targets.east]
+//	address = "https://nomad.east.example:4646"
+//	region = "east"
+//	namespace = "apps"
+//	token = { env = "EAST_NOMAD_TOKEN" }
+//	env = { CONSUL_HTTP_ADDR = "https://consul.east.example:8501" }
+type Target struct {
+	Name     string
+	Settings map[string]interface{}
+	// Decrypted are the plaintexts of the encrypted settings
+	Decrypted []string
+}
+
+type Targets map[string]Target
+
+// targetEnvNames maps target settings onto the variables the nomad CLI reads.
+var targetEnvNames = map[string]string{
+	"address":   "NOMAD_ADDR",
+	"region":    "NOMAD_REGION",
+	"namespace": "NOMAD_NAMESPACE",
+	"token":     "NOMAD_TOKEN",
+	"ca_cert":   "NOMAD_CACERT",
+
+	"consul_address":   "CONSUL_HTTP_ADDR",
+	"consul_token":     "CONSUL_HTTP_TOKEN",
+	"consul_namespace": "CONSUL_NAMESPACE",
+	"consul_ca_cert":   "CONSUL_CACERT",
+
+	"kube_server":    "KUBE_API_SERVER",
+	"kube_token":     "KUBE_TOKEN",
+	"kube_namespace": "KUBE_NAMESPACE",
+	"kube_ca_file":   "KUBE_CA_FILE",
+}
+
+// secretSettings are the target settings that are always secrets.
+var secretSettings = map[string]bool{"token": true, "consul_token": true, "kube_token": true}
+
+// Env resolves the target into the environment its scripts run with. Values
+// take the same forms as `_env`, and tokens are always secrets.
+func (t Target) Env() (map[string]EnvVar, error) {
+	out := make(map[string]EnvVar)
+	if extra, ok := t.Settings["env"]; ok {
+		table, ok := extra.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("target %s: expected a table for env, got %T", t.Name, extra)
+		}
+		for name, raw := range table {
+			v, err := resolveEnvVar(raw)
+			if err != nil {
+				return nil, fmt.Errorf("target %s: env.%s: %v", t.Name, name, err)
+			}
+			out[name] = markDecrypted(v, t.Decrypted)
+		}
+	}
+	for key, envName := range targetEnvNames {
+		raw, ok := t.Settings[key]
+		if !ok {
+			continue
+		}
+		v, err := resolveEnvVar(raw)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %s: %v", t.Name, key, err)
+		}
+		if secretSettings[key] {
+			v.Secret = true
+		}
+		out[envName] = markDecrypted(v, t.Decrypted)
+	}
+	return out, nil
+}
+
+// TemplateArgs is what templates see as `.Target`: the name and the plain
+// string settings. Credentials and anything resolved from elsewhere are left
+// out so they never end up in rendered files.
+func (t Target) TemplateArgs() map[string]interface{} {
+	if t.Name == "" {
+		return nil
+	}
+	out := map[string]interface{}{"name": t.Name}
+	for k, v := range t.Settings {
+		if s, ok := v.(string); ok && !secretSettings[k] {
+			out[k] = s
+		}
+	}
+	return out
+}
+
+// Targets returns the names of the targets a job is deployed to, from the
+// `_targets` setting. No targets means the job is deployed once, to whatever
+// cluster the environment points at.
+func (j Job) Targets() ([]string, error) {
+	v, ok := j.Setting("targets")
+	if !ok {
+		return nil, nil
+	}
+	names, err := stringList(v)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func parseTargets(raw interface{}) (Targets, error) {
+	table, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a table for _targets, got %T", raw)
+	}
+	targets := make(Targets)
+	for name, settings := range table {
+		s, ok := settings.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a table for target %s, got %T", name, settings)
+		}
+		targets[name] = Target{Name: name, Settings: s}
+	}
+	return targets, nil
+}
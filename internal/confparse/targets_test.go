@@ -0,0 +1,65 @@
+package confparse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML_Targets(t *testing.T) {
+	t.Setenv("EAST_TOKEN", "tok")
+	conf, err := ParseTOML(strings.NewReader(`
+[_targets.east]
+address = "http://east:4646"
+region = "east"
+token = { env = "EAST_TOKEN" }
+env = { CONSUL_HTTP_ADDR = "http://consul.east:8500" }
+
+[_targets.west]
+address = "http://west:4646"
+
+[web]
+_targets = ["west", "east"]
+
+[web.frontend]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conf.Jobs["east"]; ok || len(conf.Jobs) != 1 {
+		t.Fatalf("targets leaked into jobs: %v", conf.Jobs)
+	}
+
+	names, err := conf.Jobs["frontend"].Targets()
+	if err != nil || !reflect.DeepEqual(names, []string{"east", "west"}) {
+		t.Errorf("Targets() = %v, %v", names, err)
+	}
+
+	env, err := conf.Targets["east"].Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]EnvVar{
+		"NOMAD_ADDR":       {Value: "http://east:4646"},
+		"NOMAD_REGION":     {Value: "east"},
+		"NOMAD_TOKEN":      {Value: "tok", Secret: true},
+		"CONSUL_HTTP_ADDR": {Value: "http://consul.east:8500"},
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("Env() = %v, want %v", env, want)
+	}
+
+	args := conf.Targets["east"].TemplateArgs()
+	if _, ok := args["token"]; ok || args["name"] != "east" || args["region"] != "east" {
+		t.Errorf("TemplateArgs() = %v", args)
+	}
+}
+
+func TestMergeConfig_Targets(t *testing.T) {
+	a := Config{Jobs: Jobs{}, Targets: Targets{"east": {Name: "east", Settings: map[string]interface{}{"region": "a"}}}}
+	b := Config{Jobs: Jobs{}, Targets: Targets{"east": {Name: "east", Settings: map[string]interface{}{"address": "b"}}}}
+	got := MergeConfig(a, b).Targets["east"].Settings
+	if !reflect.DeepEqual(got, map[string]interface{}{"address": "b"}) {
+		t.Errorf("MergeConfig() target = %v, want the later one whole", got)
+	}
+}
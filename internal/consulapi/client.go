@@ -0,0 +1,99 @@
+// Package consulapi is a small client for the parts of the Consul HTTP API
+// this tool manages directly: config entries and KV.
+package consulapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Vaelatern/nomad-declarative/internal/httpapi"
+)
+
+// ErrNotFound is returned when the API answers 404.
+var ErrNotFound = httpapi.ErrNotFound
+
+// ErrCASConflict means the key changed since it was read.
+var ErrCASConflict = errors.New("check-and-set conflict, the key was changed by someone else")
+
+// Config says which Consul to talk to, as the consul CLI would.
+type Config struct {
+	Address   string
+	Token     string
+	Namespace string
+	CACert    string
+	// HTTPClient, when set, is used as is and CACert is ignored
+	HTTPClient *http.Client
+}
+
+// ConfigFromEnv reads CONSUL_HTTP_ADDR, CONSUL_HTTP_TOKEN, CONSUL_NAMESPACE
+// and CONSUL_CACERT from env, a list of KEY=value pairs, falling back to the
+// process environment. It reports false when no address is set, in which
+// case Consul outputs are only rendered.
+func ConfigFromEnv(env []string) (Config, bool) {
+	lookup := func(key string) string { return httpapi.Lookup(env, key) }
+	cfg := Config{
+		Address:   lookup("CONSUL_HTTP_ADDR"),
+		Token:     lookup("CONSUL_HTTP_TOKEN"),
+		Namespace: lookup("CONSUL_NAMESPACE"),
+		CACert:    lookup("CONSUL_CACERT"),
+	}
+	return cfg, cfg.Address != ""
+}
+
+// APIError is any answer from Consul that isn't a success.
+type APIError = httpapi.APIError
+
+type Client struct {
+	cfg  Config
+	http *http.Client
+}
+
+func NewClient(cfg Config) (*Client, error) {
+	// Like the consul CLI, a bare host:port means plain http
+	if !strings.Contains(cfg.Address, "://") {
+		cfg.Address = "http://" + cfg.Address
+	}
+	c := &Client{cfg: cfg, http: cfg.HTTPClient}
+	if c.http == nil {
+		var err error
+		if c.http, err = httpapi.CAClient(cfg.CACert); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Namespace is the namespace requests default to. It is empty outside
+// Consul Enterprise.
+func (c *Client) Namespace() string {
+	return c.cfg.Namespace
+}
+
+// do sends in, raw when it is a []byte and as JSON otherwise, and decodes
+// the answer into out, when not nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.cfg.Namespace != "" && query.Get("ns") == "" {
+		query.Set("ns", c.cfg.Namespace)
+	}
+	var body []byte
+	if raw, ok := in.([]byte); ok {
+		body = raw
+	} else {
+		var err error
+		if body, err = httpapi.JSON(in); err != nil {
+			return err
+		}
+	}
+	header := http.Header{}
+	if c.cfg.Token != "" {
+		header.Set("X-Consul-Token", c.cfg.Token)
+	}
+	req := httpapi.Request{Method: method, Path: path, Query: query, Header: header, Body: body}
+	return httpapi.Do(ctx, c.http, c.cfg.Address, req, out)
+}
@@ -0,0 +1,65 @@
+package consulapi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// ConfigKinds are the config entry kinds Consul accepts.
+var ConfigKinds = []string{
+	"api-gateway",
+	"control-plane-request-limit",
+	"exported-services",
+	"http-route",
+	"ingress-gateway",
+	"inline-certificate",
+	"jwt-provider",
+	"mesh",
+	"proxy-defaults",
+	"sameness-group",
+	"service-defaults",
+	"service-intentions",
+	"service-resolver",
+	"service-router",
+	"service-splitter",
+	"tcp-route",
+	"terminating-gateway",
+}
+
+// ConfigEntry is a config entry as Consul's API takes it, with the fields
+// in their CamelCase form.
+type ConfigEntry map[string]interface{}
+
+func (e ConfigEntry) str(key string) string {
+	s, _ := e[key].(string)
+	return s
+}
+
+func (e ConfigEntry) Kind() string      { return e.str("Kind") }
+func (e ConfigEntry) Name() string      { return e.str("Name") }
+func (e ConfigEntry) Namespace() string { return e.str("Namespace") }
+
+func nsQuery(namespace string) url.Values {
+	query := url.Values{}
+	if namespace != "" {
+		query.Set("ns", namespace)
+	}
+	return query
+}
+
+func (c *Client) GetConfigEntry(ctx context.Context, kind, namespace, name string) (ConfigEntry, error) {
+	var e ConfigEntry
+	if err := c.do(ctx, http.MethodGet, "/v1/config/"+kind+"/"+url.PathEscape(name), nsQuery(namespace), nil, &e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (c *Client) PutConfigEntry(ctx context.Context, e ConfigEntry) error {
+	return c.do(ctx, http.MethodPut, "/v1/config", nsQuery(e.Namespace()), e, nil)
+}
+
+func (c *Client) DeleteConfigEntry(ctx context.Context, kind, namespace, name string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/config/"+kind+"/"+url.PathEscape(name), nsQuery(namespace), nil, nil)
+}
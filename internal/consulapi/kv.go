@@ -0,0 +1,55 @@
+package consulapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type KVPair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+// GetKV reads a single key, returning ErrNotFound if there is none.
+func (c *Client) GetKV(ctx context.Context, namespace, key string) (*KVPair, error) {
+	var pairs []KVPair
+	if err := c.do(ctx, http.MethodGet, "/v1/kv/"+key, nsQuery(namespace), nil, &pairs); err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return &pairs[0], nil
+}
+
+// PutKV writes a key only if its ModifyIndex is still cas. A cas of zero
+// only succeeds if the key does not exist yet.
+func (c *Client) PutKV(ctx context.Context, namespace, key string, value []byte, cas uint64) error {
+	query := nsQuery(namespace)
+	query.Set("cas", strconv.FormatUint(cas, 10))
+	var ok bool
+	if err := c.do(ctx, http.MethodPut, "/v1/kv/"+key, query, value, &ok); err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s: %w", key, ErrCASConflict)
+	}
+	return nil
+}
+
+// DeleteKV removes a key only if its ModifyIndex is still cas.
+func (c *Client) DeleteKV(ctx context.Context, namespace, key string, cas uint64) error {
+	query := nsQuery(namespace)
+	query.Set("cas", strconv.FormatUint(cas, 10))
+	var ok bool
+	if err := c.do(ctx, http.MethodDelete, "/v1/kv/"+key, query, nil, &ok); err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s: %w", key, ErrCASConflict)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Package httpapi holds what the small API clients of this tool share:
+// reading their settings from an environment, sending a request, and making
+// an error of an answer that isn't a success.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ErrNotFound is returned when an API answers 404.
+var ErrNotFound = errors.New("not found")
+
+// Lookup finds key in env, a list of KEY=value pairs where the last one
+// wins, falling back to the process environment when it is not there.
+func Lookup(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if k, v, ok := strings.Cut(env[i], "="); ok && k == key {
+			return v
+		}
+	}
+	return os.Getenv(key)
+}
+
+// APIError is any answer that isn't a success.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s: Unexpected response code: %d (%s)", e.Method, e.Path, e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+func (e *APIError) Unwrap() error {
+	if e.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CAClient trusts only the certificates in the PEM file caFile. With no
+// file it is http.DefaultClient.
+func CAClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return http.DefaultClient, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}, nil
+}
+
+// Request is one call to an API, its Path below the address the API is at.
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// Do sends req to the API at address, and decodes the answer into out as
+// JSON when out is not nil.
+func Do(ctx context.Context, client *http.Client, address string, req Request, out interface{}) error {
+	u := strings.TrimRight(address, "/") + req.Path
+	if len(req.Query) > 0 {
+		u += "?" + req.Query.Encode()
+	}
+	var body io.Reader
+	if req.Body != nil {
+		body = bytes.NewReader(req.Body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, u, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range req.Header {
+		httpReq.Header[k] = v
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &APIError{Method: req.Method, Path: req.Path, StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("%s %s: can't decode answer: %v", req.Method, req.Path, err)
+		}
+	}
+	return nil
+}
+
+// JSON encodes in as a request body, nil when in is.
+func JSON(in interface{}) ([]byte, error) {
+	if in == nil {
+		return nil, nil
+	}
+	return json.Marshal(in)
+}
@@ -0,0 +1,50 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	t.Setenv("HTTPAPI_TEST", "process")
+	env := []string{"HTTPAPI_TOKEN=first", "HTTPAPI_TOKEN=last", "NOEQUALS"}
+	if got := Lookup(env, "HTTPAPI_TOKEN"); got != "last" {
+		t.Errorf("Lookup() = %q, want the last one set", got)
+	}
+	if got := Lookup(env, "HTTPAPI_TEST"); got != "process" {
+		t.Errorf("Lookup() = %q, want the process environment's", got)
+	}
+}
+
+func TestDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.Error(w, "no such thing", http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(`{"token": "` + r.Header.Get("X-Token") + `", "q": "` + r.URL.Query().Get("q") + `", "body": ` + string(body) + `}`))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	var out struct{ Token, Q, Body string }
+	req := Request{Method: http.MethodPut, Path: "/echo", Query: url.Values{"q": {"x"}}, Header: http.Header{"X-Token": {"t"}}, Body: []byte(`"hi"`)}
+	if err := Do(ctx, http.DefaultClient, srv.URL+"/", req, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Token != "t" || out.Q != "x" || out.Body != "hi" {
+		t.Errorf("Do() sent %+v", out)
+	}
+
+	err := Do(ctx, http.DefaultClient, srv.URL, Request{Method: http.MethodGet, Path: "/missing"}, nil)
+	var apiErr *APIError
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &apiErr) || apiErr.Body != "no such thing\n" {
+		t.Errorf("Do() of a missing path = %v, want an APIError that is ErrNotFound", err)
+	}
+}
@@ -0,0 +1,186 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Vaelatern/nomad-declarative/internal/httpapi"
+)
+
+// FieldManager is who server-side apply records as owning the fields set.
+const FieldManager = "nomad-declarative"
+
+// ErrNotFound is returned when the API answers 404.
+var ErrNotFound = httpapi.ErrNotFound
+
+// Config says which Kubernetes API to talk to.
+type Config struct {
+	Server    string
+	Token     string
+	Namespace string
+	CAFile    string
+	// HTTPClient, when set, is used as is and CAFile is ignored
+	HTTPClient *http.Client
+}
+
+// ConfigFromEnv reads KUBE_API_SERVER, KUBE_TOKEN, KUBE_NAMESPACE and
+// KUBE_CA_FILE from env, a list of KEY=value pairs, falling back to the
+// process environment. It reports false when no API server is set, in
+// which case manifests are only rendered.
+func ConfigFromEnv(env []string) (Config, bool) {
+	lookup := func(key string) string { return httpapi.Lookup(env, key) }
+	cfg := Config{
+		Server:    lookup("KUBE_API_SERVER"),
+		Token:     lookup("KUBE_TOKEN"),
+		Namespace: lookup("KUBE_NAMESPACE"),
+		CAFile:    lookup("KUBE_CA_FILE"),
+	}
+	return cfg, cfg.Server != ""
+}
+
+// APIError is any answer from the API server that isn't a success.
+type APIError = httpapi.APIError
+
+// Client speaks just enough of the Kubernetes API to read, server-side
+// apply and delete objects of any kind the server knows.
+type Client struct {
+	cfg  Config
+	http *http.Client
+
+	mu        sync.Mutex
+	discovery map[string]map[string]apiResource // apiVersion -> kind -> resource
+}
+
+type apiResource struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Namespaced bool   `json:"namespaced"`
+}
+
+func NewClient(cfg Config) (*Client, error) {
+	c := &Client{cfg: cfg, http: cfg.HTTPClient, discovery: make(map[string]map[string]apiResource)}
+	if c.http == nil {
+		var err error
+		if c.http, err = httpapi.CAClient(cfg.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Namespace is where namespaced objects without one go.
+func (c *Client) Namespace() string {
+	if c.cfg.Namespace == "" {
+		return "default"
+	}
+	return c.cfg.Namespace
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, contentType string, body []byte, out interface{}) error {
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if c.cfg.Token != "" {
+		header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	req := httpapi.Request{Method: method, Path: path, Query: query, Header: header, Body: body}
+	return httpapi.Do(ctx, c.http, c.cfg.Server, req, out)
+}
+
+// resource finds the plural name of a kind, and if it is namespaced.
+func (c *Client) resource(ctx context.Context, apiVersion, kind string) (apiResource, error) {
+	c.mu.Lock()
+	kinds, ok := c.discovery[apiVersion]
+	c.mu.Unlock()
+	if !ok {
+		path := "/apis/" + apiVersion
+		if !strings.Contains(apiVersion, "/") {
+			path = "/api/" + apiVersion // the core group
+		}
+		var list struct {
+			Resources []apiResource `json:"resources"`
+		}
+		if err := c.do(ctx, http.MethodGet, path, nil, "", nil, &list); err != nil {
+			return apiResource{}, fmt.Errorf("can't discover %s: %w", apiVersion, err)
+		}
+		kinds = make(map[string]apiResource)
+		for _, r := range list.Resources {
+			if !strings.Contains(r.Name, "/") { // skip subresources like pods/log
+				kinds[r.Kind] = r
+			}
+		}
+		c.mu.Lock()
+		c.discovery[apiVersion] = kinds
+		c.mu.Unlock()
+	}
+	r, ok := kinds[kind]
+	if !ok {
+		return apiResource{}, fmt.Errorf("the API server has no kind %s in %s", kind, apiVersion)
+	}
+	return r, nil
+}
+
+func (c *Client) objectPath(ctx context.Context, apiVersion, kind, namespace, name string) (string, error) {
+	r, err := c.resource(ctx, apiVersion, kind)
+	if err != nil {
+		return "", err
+	}
+	p := "/apis/" + apiVersion
+	if !strings.Contains(apiVersion, "/") {
+		p = "/api/" + apiVersion
+	}
+	if r.Namespaced {
+		if namespace == "" {
+			namespace = c.Namespace()
+		}
+		p += "/namespaces/" + url.PathEscape(namespace)
+	}
+	return p + "/" + r.Name + "/" + url.PathEscape(name), nil
+}
+
+// Namespaced reports if objects of the kind live in a namespace.
+func (c *Client) Namespaced(ctx context.Context, apiVersion, kind string) (bool, error) {
+	r, err := c.resource(ctx, apiVersion, kind)
+	return r.Namespaced, err
+}
+
+func (c *Client) Get(ctx context.Context, apiVersion, kind, namespace, name string) (Object, error) {
+	p, err := c.objectPath(ctx, apiVersion, kind, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	var obj Object
+	if err := c.do(ctx, http.MethodGet, p, nil, "", nil, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Apply creates or updates the object with server-side apply.
+func (c *Client) Apply(ctx context.Context, obj Object) error {
+	p, err := c.objectPath(ctx, obj.APIVersion(), obj.Kind(), obj.Namespace(), obj.Name())
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"fieldManager": {FieldManager}, "force": {"true"}}
+	return c.do(ctx, http.MethodPatch, p, query, "application/apply-patch+yaml", body, nil)
+}
+
+func (c *Client) Delete(ctx context.Context, apiVersion, kind, namespace, name string) error {
+	p, err := c.objectPath(ctx, apiVersion, kind, namespace, name)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodDelete, p, nil, "", nil, nil)
+}
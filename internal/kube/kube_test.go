@@ -0,0 +1,170 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIsManifest(t *testing.T) {
+	for rel, want := range map[string]bool{
+		"web.k8s.yaml":            true,
+		"web.k8s.yml":             true,
+		"kubernetes/web.yaml":     true,
+		"kubernetes/sub/web.yml":  true,
+		"web.yaml":                false,
+		"conf/kubernetes/web.yml": false,
+		"kubernetes/README.md":    false,
+	} {
+		if got := IsManifest(rel); got != want {
+			t.Errorf("IsManifest(%q) = %v, want %v", rel, got, want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	got, err := Format([]byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+    name: web # the app
+data:
+    a: "1"
+---
+---
+apiVersion: v1
+kind: Service
+metadata: {name: web}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web # the app
+data:
+  a: "1"
+---
+apiVersion: v1
+kind: Service
+metadata: {name: web}
+`
+	if string(got) != want {
+		t.Errorf("Format() =\n%s\nwant\n%s", got, want)
+	}
+
+	for _, bad := range []string{
+		"kind: ConfigMap\nmetadata: {name: a}\n",
+		"apiVersion: v1\nmetadata: {name: a}\n",
+		"apiVersion: v1\nkind: ConfigMap\n",
+		"- a list\n",
+		"apiVersion: [\n",
+	} {
+		if _, err := Format([]byte(bad)); err == nil {
+			t.Errorf("Format(%q) should fail", bad)
+		}
+	}
+}
+
+// fakeAPI serves discovery for the core group and keeps ConfigMaps and
+// Namespaces in memory.
+type fakeAPI struct {
+	mu      sync.Mutex
+	objects map[string]Object
+	patches []*http.Request
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/api/v1" {
+		io.WriteString(w, `{"resources": [
+			{"name": "configmaps", "kind": "ConfigMap", "namespaced": true},
+			{"name": "namespaces", "kind": "Namespace", "namespaced": false},
+			{"name": "pods/log", "kind": "Pod", "namespaced": true}]}`)
+		return
+	}
+	if r.URL.Path == "/apis/apps/v1" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		obj, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(obj)
+	case http.MethodPatch:
+		f.patches = append(f.patches, r)
+		var obj Object
+		json.NewDecoder(r.Body).Decode(&obj)
+		f.objects[r.URL.Path] = obj
+	case http.MethodDelete:
+		if _, ok := f.objects[r.URL.Path]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.objects, r.URL.Path)
+	}
+}
+
+func TestClient(t *testing.T) {
+	f := &fakeAPI{objects: make(map[string]Object)}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	c, err := NewClient(Config{Server: srv.URL, Namespace: "apps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	objs, err := Parse([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata: {name: web}\ndata: {a: b}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "v1", "ConfigMap", "", "web"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() before apply = %v, want ErrNotFound", err)
+	}
+	if err := c.Apply(ctx, objs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.patches) != 1 {
+		t.Fatalf("expected one PATCH, got %d", len(f.patches))
+	}
+	p := f.patches[0]
+	if p.URL.Path != "/api/v1/namespaces/apps/configmaps/web" ||
+		p.URL.Query().Get("fieldManager") != FieldManager ||
+		p.Header.Get("Content-Type") != "application/apply-patch+yaml" {
+		t.Errorf("unexpected apply request %s %s", p.URL, p.Header.Get("Content-Type"))
+	}
+	got, err := c.Get(ctx, "v1", "ConfigMap", "apps", "web")
+	if err != nil || got.Name() != "web" {
+		t.Errorf("Get() = %v, %v", got, err)
+	}
+
+	if ns, err := c.Namespaced(ctx, "v1", "Namespace"); err != nil || ns {
+		t.Errorf("Namespaced(Namespace) = %v, %v", ns, err)
+	}
+	if _, err := c.Namespaced(ctx, "v1", "Pod"); err == nil || !strings.Contains(err.Error(), "no kind Pod") {
+		t.Errorf("subresources should not count as kinds, got %v", err)
+	}
+	if _, err := c.Namespaced(ctx, "apps/v1", "Deployment"); err == nil {
+		t.Errorf("an unknown group should fail discovery")
+	}
+
+	if err := c.Delete(ctx, "v1", "ConfigMap", "apps", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "v1", "ConfigMap", "apps", "web"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete() = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Package kube validates, formats and applies the Kubernetes manifests packs
+// render, so one config can drive k3s next to Nomad.
+package kube
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// IsManifest reports if a rendered file is a Kubernetes manifest: one ending
+// in `.k8s.yaml` or `.k8s.yml`, or any YAML file below a top-level
+// `kubernetes/` dir.
+func IsManifest(rel string) bool {
+	rel = path.Clean(strings.ReplaceAll(rel, "\\", "/"))
+	if strings.HasSuffix(rel, ".k8s.yaml") || strings.HasSuffix(rel, ".k8s.yml") {
+		return true
+	}
+	return strings.HasPrefix(rel, "kubernetes/") && (strings.HasSuffix(rel, ".yaml") || strings.HasSuffix(rel, ".yml"))
+}
+
+// Object is one Kubernetes object as decoded from YAML.
+type Object map[string]interface{}
+
+func (o Object) str(keys ...string) string {
+	var cur interface{} = map[string]interface{}(o)
+	for _, k := range keys {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		cur = m[k]
+	}
+	s, _ := cur.(string)
+	return s
+}
+
+func (o Object) APIVersion() string { return o.str("apiVersion") }
+func (o Object) Kind() string       { return o.str("kind") }
+func (o Object) Name() string       { return o.str("metadata", "name") }
+func (o Object) Namespace() string  { return o.str("metadata", "namespace") }
+
+// SetNamespace fills metadata.namespace.
+func (o Object) SetNamespace(ns string) {
+	meta, ok := o["metadata"].(map[string]interface{})
+	if !ok {
+		meta = map[string]interface{}{}
+		o["metadata"] = meta
+	}
+	meta["namespace"] = ns
+}
+
+// documents splits a multi-document YAML stream into its nodes, skipping
+// empty documents.
+func documents(data []byte) ([]*yaml.Node, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	var docs []*yaml.Node
+	for i := 1; ; i++ {
+		var node yaml.Node
+		err := dec.Decode(&node)
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %v", i, err)
+		}
+		if len(node.Content) == 0 || (node.Content[0].Kind == yaml.ScalarNode && node.Content[0].Tag == "!!null") {
+			continue
+		}
+		docs = append(docs, &node)
+	}
+}
+
+// Parse reads every object in a multi-document manifest, making sure each
+// has an apiVersion, a kind and a name.
+func Parse(data []byte) ([]Object, error) {
+	docs, err := documents(data)
+	if err != nil {
+		return nil, err
+	}
+	var objs []Object
+	for i, doc := range docs {
+		// A plain map, as yaml would decode nested maps into an Object too
+		var m map[string]interface{}
+		if err := doc.Decode(&m); err != nil {
+			return nil, fmt.Errorf("document %d: expected a mapping: %v", i+1, err)
+		}
+		obj := Object(m)
+		switch {
+		case obj.APIVersion() == "":
+			return nil, fmt.Errorf("document %d: apiVersion is missing", i+1)
+		case obj.Kind() == "":
+			return nil, fmt.Errorf("document %d: kind is missing", i+1)
+		case obj.Name() == "":
+			return nil, fmt.Errorf("document %d: %s has no metadata.name", i+1, obj.Kind())
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// Format validates a manifest and rewrites it in a canonical form: two
+// space indents and `---` between documents. Comments are kept.
+func Format(data []byte) ([]byte, error) {
+	if _, err := Parse(data); err != nil {
+		return nil, err
+	}
+	docs, err := documents(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for i, doc := range docs {
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
+		}
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,220 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the
+// Prometheus text format, for a /metrics endpoint or a node_exporter
+// textfile collector.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is where the tool's metrics live.
+var Default = NewRegistry()
+
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+type family struct {
+	name, help, typ string
+	// values by their rendered label set, like `{job="web"}`
+	values map[string]float64
+	// buckets are the upper bounds of a histogram's buckets, and hists its
+	// observations by label set
+	buckets []float64
+	hists   map[string]*observations
+}
+
+// observations are what a histogram saw for one label set.
+type observations struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Vec is a metric with any number of label sets. Labels are given as
+// name, value pairs.
+type Vec struct {
+	r *Registry
+	f *family
+}
+
+func (r *Registry) register(name, help, typ string, buckets ...float64) *Vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, values: make(map[string]float64)}
+		if typ == "histogram" {
+			f.buckets = slices.Sorted(slices.Values(buckets))
+			f.hists = make(map[string]*observations)
+		}
+		r.families[name] = f
+	}
+	return &Vec{r: r, f: f}
+}
+
+// Counter is a value that only goes up.
+func (r *Registry) Counter(name, help string) *Vec { return r.register(name, help, "counter") }
+
+// Gauge is a value that is set.
+func (r *Registry) Gauge(name, help string) *Vec { return r.register(name, help, "gauge") }
+
+// Histogram counts observed values into buckets, each given by its upper
+// bound, and keeps their sum.
+func (r *Registry) Histogram(name, help string, buckets ...float64) *Vec {
+	return r.register(name, help, "histogram", buckets...)
+}
+
+// DurationBuckets suit timing anything from a render to a slow fetch, in
+// seconds.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelKey(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	if len(labels)%2 != 0 {
+		panic("metrics: labels must come in name, value pairs")
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (v *Vec) Add(delta float64, labels ...string) {
+	key := labelKey(labels)
+	v.r.mu.Lock()
+	defer v.r.mu.Unlock()
+	v.f.values[key] += delta
+}
+
+func (v *Vec) Inc(labels ...string) { v.Add(1, labels...) }
+
+func (v *Vec) Set(val float64, labels ...string) {
+	key := labelKey(labels)
+	v.r.mu.Lock()
+	defer v.r.mu.Unlock()
+	v.f.values[key] = val
+}
+
+// Observe adds val to a histogram.
+func (v *Vec) Observe(val float64, labels ...string) {
+	key := labelKey(labels)
+	v.r.mu.Lock()
+	defer v.r.mu.Unlock()
+	o, ok := v.f.hists[key]
+	if !ok {
+		o = &observations{counts: make([]uint64, len(v.f.buckets))}
+		v.f.hists[key] = o
+	}
+	if i, _ := slices.BinarySearch(v.f.buckets, val); i < len(o.counts) {
+		o.counts[i]++
+	}
+	o.sum += val
+	o.count++
+}
+
+// Get returns the value for a label set, zero if it was never set.
+func (v *Vec) Get(labels ...string) float64 {
+	key := labelKey(labels)
+	v.r.mu.Lock()
+	defer v.r.mu.Unlock()
+	return v.f.values[key]
+}
+
+// WriteText writes every metric that has a value, sorted by name and
+// labels.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		f := r.families[name]
+		if len(f.values) == 0 && len(f.hists) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		keys := make([]string, 0, len(f.values))
+		for key := range f.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, key, formatFloat(f.values[key]))
+		}
+		for _, key := range slices.Sorted(maps.Keys(f.hists)) {
+			o := f.hists[key]
+			var cumulative uint64
+			for i, bound := range f.buckets {
+				cumulative += o.counts[i]
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(key, "le", formatFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(key, "le", "+Inf"), o.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, key, formatFloat(o.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, key, o.count)
+		}
+	}
+	r.mu.Unlock()
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// withLabel adds a label to a rendered label set.
+func withLabel(key, name, value string) string {
+	label := fmt.Sprintf(`%s="%s"`, name, value)
+	if key == "" {
+		return "{" + label + "}"
+	}
+	return strings.TrimSuffix(key, "}") + "," + label + "}"
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
+
+// WriteFile writes the metrics to path in one go, as the textfile
+// collector must never see a half written file.
+func (r *Registry) WriteFile(path string) error {
+	var b bytes.Buffer
+	if err := r.WriteText(&b); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
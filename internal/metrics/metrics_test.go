@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	runs := r.Counter("runs_total", "Runs by outcome.")
+	last := r.Gauge("last_run_seconds", "When the last run ended.")
+	r.Gauge("unused", "Never set, never written.")
+
+	runs.Inc("outcome", "passed", "job", "web")
+	runs.Inc("job", "web", "outcome", "passed")
+	runs.Add(2, "job", `we"b`, "outcome", "failed")
+	last.Set(1.5)
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP last_run_seconds When the last run ended.
+# TYPE last_run_seconds gauge
+last_run_seconds 1.5
+# HELP runs_total Runs by outcome.
+# TYPE runs_total counter
+runs_total{job="we\"b",outcome="failed"} 2
+runs_total{job="web",outcome="passed"} 2
+`
+	if b.String() != want {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", b.String(), want)
+	}
+	if runs.Get("job", "web", "outcome", "passed") != 2 {
+		t.Errorf("labels in any order should be the same series")
+	}
+
+	path := filepath.Join(t.TempDir(), "sub", "nd.prom")
+	if err := r.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != want {
+		t.Errorf("WriteFile() wrote\n%s", data)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	took := r.Histogram("took_seconds", "How long it took.", 1, 0.5)
+	took.Observe(0.2, "pack", "web")
+	took.Observe(0.5, "pack", "web")
+	took.Observe(3, "pack", "web")
+	took.Observe(1)
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP took_seconds How long it took.
+# TYPE took_seconds histogram
+took_seconds_bucket{le="0.5"} 0
+took_seconds_bucket{le="1"} 1
+took_seconds_bucket{le="+Inf"} 1
+took_seconds_sum 1
+took_seconds_count 1
+took_seconds_bucket{pack="web",le="0.5"} 2
+took_seconds_bucket{pack="web",le="1"} 2
+took_seconds_bucket{pack="web",le="+Inf"} 3
+took_seconds_sum{pack="web"} 3.7
+took_seconds_count{pack="web"} 3
+`
+	if b.String() != want {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,99 @@
+// Package nomadapi is a small client for the parts of the Nomad HTTP API
+// this tool manages directly.
+package nomadapi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/Vaelatern/nomad-declarative/internal/httpapi"
+)
+
+const DefaultAddress = "http://127.0.0.1:4646"
+
+// ErrNotFound is returned when the API answers 404.
+var ErrNotFound = httpapi.ErrNotFound
+
+// Config says which cluster to talk to, as the nomad CLI would.
+type Config struct {
+	Address   string
+	Region    string
+	Namespace string
+	Token     string
+	CACert    string
+	// HTTPClient, when set, is used as is and CACert is ignored
+	HTTPClient *http.Client
+}
+
+// ConfigFromEnv reads the usual NOMAD_* variables from env, a list of
+// KEY=value pairs, falling back to the process environment for any not in
+// it.
+func ConfigFromEnv(env []string) Config {
+	lookup := func(key string) string { return httpapi.Lookup(env, key) }
+	cfg := Config{
+		Address:   lookup("NOMAD_ADDR"),
+		Region:    lookup("NOMAD_REGION"),
+		Namespace: lookup("NOMAD_NAMESPACE"),
+		Token:     lookup("NOMAD_TOKEN"),
+		CACert:    lookup("NOMAD_CACERT"),
+	}
+	if cfg.Address == "" {
+		cfg.Address = DefaultAddress
+	}
+	return cfg
+}
+
+// APIError is any answer from Nomad that isn't a success.
+type APIError = httpapi.APIError
+
+type Client struct {
+	cfg  Config
+	http *http.Client
+}
+
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Address == "" {
+		cfg.Address = DefaultAddress
+	}
+	c := &Client{cfg: cfg, http: cfg.HTTPClient}
+	if c.http == nil {
+		var err error
+		if c.http, err = httpapi.CAClient(cfg.CACert); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Namespace is the namespace requests default to.
+func (c *Client) Namespace() string {
+	if c.cfg.Namespace == "" {
+		return "default"
+	}
+	return c.cfg.Namespace
+}
+
+// do sends in as JSON, when not nil, and decodes the answer into out, when
+// not nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.cfg.Region != "" && query.Get("region") == "" {
+		query.Set("region", c.cfg.Region)
+	}
+	body, err := httpapi.JSON(in)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if c.cfg.Token != "" {
+		header.Set("X-Nomad-Token", c.cfg.Token)
+	}
+	if in != nil {
+		header.Set("Content-Type", "application/json")
+	}
+	req := httpapi.Request{Method: method, Path: path, Query: query, Header: header, Body: body}
+	return httpapi.Do(ctx, c.http, c.cfg.Address, req, out)
+}
@@ -0,0 +1,48 @@
+package nomadapi
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientCACert(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Namespace": "default", "Path": "app", "Items": {"k": "v"}}`))
+	}))
+	defer srv.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(ca, pemData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	c, err := NewClient(ConfigFromEnv([]string{"NOMAD_ADDR=" + srv.URL}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetVariable(ctx, "", "app"); err == nil {
+		t.Errorf("a server signed by an unknown CA should not be trusted")
+	}
+
+	c, err = NewClient(ConfigFromEnv([]string{"NOMAD_ADDR=" + srv.URL, "NOMAD_CACERT=" + ca}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.GetVariable(ctx, "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Items["k"] != "v" {
+		t.Errorf("GetVariable() = %+v", v)
+	}
+
+	if _, err := NewClient(ConfigFromEnv([]string{"NOMAD_CACERT=" + filepath.Join(t.TempDir(), "missing.pem")})); err == nil {
+		t.Errorf("a missing CA file should be an error")
+	}
+}
@@ -0,0 +1,113 @@
+package nomadapi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+type Namespace struct {
+	Name        string
+	Description string            `json:",omitempty"`
+	Quota       string            `json:",omitempty"`
+	Meta        map[string]string `json:",omitempty"`
+}
+
+type ACLPolicy struct {
+	Name        string
+	Description string `json:",omitempty"`
+	Rules       string
+}
+
+type QuotaSpec struct {
+	Name        string
+	Description string       `json:",omitempty"`
+	Limits      []QuotaLimit `json:",omitempty"`
+}
+
+type QuotaLimit struct {
+	Region      string
+	RegionLimit *QuotaResources `json:",omitempty"`
+}
+
+type QuotaResources struct {
+	CPU         int `json:",omitempty"`
+	Cores       int `json:",omitempty"`
+	MemoryMB    int `json:",omitempty"`
+	MemoryMaxMB int `json:",omitempty"`
+}
+
+type NodePool struct {
+	Name        string
+	Description string            `json:",omitempty"`
+	Meta        map[string]string `json:",omitempty"`
+}
+
+// These objects are not namespaced, so requests never carry one.
+func (c *Client) get(ctx context.Context, path string, out interface{}) error {
+	return c.do(ctx, http.MethodGet, path, url.Values{}, nil, out)
+}
+
+func (c *Client) GetNamespace(ctx context.Context, name string) (*Namespace, error) {
+	var ns Namespace
+	if err := c.get(ctx, "/v1/namespace/"+name, &ns); err != nil {
+		return nil, err
+	}
+	return &ns, nil
+}
+
+func (c *Client) PutNamespace(ctx context.Context, ns Namespace) error {
+	return c.do(ctx, http.MethodPost, "/v1/namespace/"+ns.Name, nil, ns, nil)
+}
+
+func (c *Client) DeleteNamespace(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/namespace/"+name, nil, nil, nil)
+}
+
+func (c *Client) GetACLPolicy(ctx context.Context, name string) (*ACLPolicy, error) {
+	var p ACLPolicy
+	if err := c.get(ctx, "/v1/acl/policy/"+name, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *Client) PutACLPolicy(ctx context.Context, p ACLPolicy) error {
+	return c.do(ctx, http.MethodPost, "/v1/acl/policy/"+p.Name, nil, p, nil)
+}
+
+func (c *Client) DeleteACLPolicy(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/acl/policy/"+name, nil, nil, nil)
+}
+
+func (c *Client) GetQuotaSpec(ctx context.Context, name string) (*QuotaSpec, error) {
+	var q QuotaSpec
+	if err := c.get(ctx, "/v1/quota/"+name, &q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (c *Client) PutQuotaSpec(ctx context.Context, q QuotaSpec) error {
+	return c.do(ctx, http.MethodPost, "/v1/quota", nil, q, nil)
+}
+
+func (c *Client) DeleteQuotaSpec(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/quota/"+name, nil, nil, nil)
+}
+
+func (c *Client) GetNodePool(ctx context.Context, name string) (*NodePool, error) {
+	var p NodePool
+	if err := c.get(ctx, "/v1/node/pool/"+name, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *Client) PutNodePool(ctx context.Context, p NodePool) error {
+	return c.do(ctx, http.MethodPut, "/v1/node/pools", nil, p, nil)
+}
+
+func (c *Client) DeleteNodePool(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/node/pool/"+name, nil, nil, nil)
+}
@@ -0,0 +1,66 @@
+package nomadapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ErrCASConflict means the variable changed since it was read.
+var ErrCASConflict = errors.New("check-and-set conflict, the variable was changed by someone else")
+
+type Variable struct {
+	Namespace   string
+	Path        string
+	Items       map[string]string
+	ModifyIndex uint64 `json:",omitempty"`
+}
+
+func (c *Client) ns(namespace string) string {
+	if namespace == "" {
+		return c.Namespace()
+	}
+	return namespace
+}
+
+// GetVariable reads a variable, returning ErrNotFound if there is none.
+func (c *Client) GetVariable(ctx context.Context, namespace, path string) (*Variable, error) {
+	var v Variable
+	query := url.Values{"namespace": {c.ns(namespace)}}
+	if err := c.do(ctx, http.MethodGet, "/v1/var/"+path, query, nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// PutVariable writes a variable only if its ModifyIndex is still cas. A cas
+// of zero only succeeds if the variable does not exist yet.
+func (c *Client) PutVariable(ctx context.Context, v Variable, cas uint64) (*Variable, error) {
+	v.Namespace = c.ns(v.Namespace)
+	v.ModifyIndex = 0
+	query := url.Values{"namespace": {v.Namespace}, "cas": {strconv.FormatUint(cas, 10)}}
+	var out Variable
+	err := c.do(ctx, http.MethodPut, "/v1/var/"+v.Path, query, v, &out)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict {
+		return nil, fmt.Errorf("%s: %w", v.Path, ErrCASConflict)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteVariable removes a variable only if its ModifyIndex is still cas.
+func (c *Client) DeleteVariable(ctx context.Context, namespace, path string, cas uint64) error {
+	query := url.Values{"namespace": {c.ns(namespace)}, "cas": {strconv.FormatUint(cas, 10)}}
+	err := c.do(ctx, http.MethodDelete, "/v1/var/"+path, query, nil, nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict {
+		return fmt.Errorf("%s: %w", path, ErrCASConflict)
+	}
+	return err
+}
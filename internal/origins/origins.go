@@ -0,0 +1,214 @@
+// Package origins resolves pack origins to filesystems and keeps them, so
+// every job from the same origin sees the same checkout until the origin
+// is invalidated.
+package origins
+
+import (
+	"io/fs"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hairyhenderson/go-fsimpl"
+	"github.com/hairyhenderson/go-fsimpl/blobfs"
+	"github.com/hairyhenderson/go-fsimpl/filefs"
+	"github.com/hairyhenderson/go-fsimpl/gitfs"
+	"github.com/hairyhenderson/go-fsimpl/httpfs"
+)
+
+type entry struct {
+	fsys    fs.FS
+	fetched time.Time
+}
+
+// fetch is a resolution in progress, which lookups of the same origin wait
+// for rather than resolving it again.
+type fetch struct {
+	done chan struct{}
+	fsys fs.FS
+	err  error
+}
+
+// Cache holds resolved origins. Entries older than MaxAge are resolved
+// again, zero keeps them until invalidated. It is safe for concurrent use,
+// different origins being resolved at the same time.
+type Cache struct {
+	MaxAge time.Duration
+	// Observe, when set, is told of every lookup, whether it was a hit and
+	// how long fetching took on a miss
+	Observe func(origin string, hit bool, took time.Duration)
+
+	mu      sync.Mutex
+	entries map[string]entry
+	fetches map[string]*fetch
+	lookup  func(string) (fs.FS, error)
+}
+
+func NewCache(maxAge time.Duration) *Cache {
+	mux := fsimpl.NewMux()
+	mux.Add(filefs.FS)
+	mux.Add(httpfs.FS)
+	mux.Add(blobfs.FS)
+	mux.Add(gitfs.FS)
+	return &Cache{MaxAge: maxAge, entries: make(map[string]entry), lookup: mux.Lookup}
+}
+
+// Lookup returns the filesystem for an origin URL, resolving it if it is
+// not cached or is too old.
+func (c *Cache) Lookup(origin string) (fs.FS, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[origin]; ok && (c.MaxAge <= 0 || time.Since(e.fetched) < c.MaxAge) {
+		c.mu.Unlock()
+		c.observe(origin, true, 0)
+		return e.fsys, nil
+	}
+	if f, ok := c.fetches[origin]; ok {
+		c.mu.Unlock()
+		<-f.done
+		if f.err == nil {
+			c.observe(origin, true, 0)
+		}
+		return f.fsys, f.err
+	}
+	if c.fetches == nil {
+		c.fetches = make(map[string]*fetch)
+	}
+	f := &fetch{done: make(chan struct{})}
+	c.fetches[origin] = f
+	c.mu.Unlock()
+
+	started := time.Now()
+	f.fsys, f.err = c.resolve(origin)
+	took := time.Since(started)
+
+	c.mu.Lock()
+	delete(c.fetches, origin)
+	if f.err == nil {
+		c.entries[origin] = entry{fsys: f.fsys, fetched: time.Now()}
+	}
+	c.mu.Unlock()
+	close(f.done)
+	if f.err == nil {
+		c.observe(origin, false, took)
+	}
+	return f.fsys, f.err
+}
+
+func (c *Cache) resolve(origin string) (fs.FS, error) {
+	fsys, err := c.lookup(origin)
+	if err != nil {
+		return nil, err
+	}
+	// Some filesystems, like git, only fetch once first used. Do it now, so
+	// an origin that can't be fetched is not kept.
+	if _, err := fs.Stat(fsys, "."); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+func (c *Cache) observe(origin string, hit bool, took time.Duration) {
+	if c.Observe != nil {
+		c.Observe(origin, hit, took)
+	}
+}
+
+// Invalidate drops every cached origin in the repository at repoURL, and
+// reports how many there were.
+func (c *Cache) Invalidate(repoURL string) int {
+	key := RepoKey(repoURL)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for origin := range c.entries {
+		if RepoKey(origin) == key {
+			delete(c.entries, origin)
+			n++
+		}
+	}
+	return n
+}
+
+// Redact hides any credentials in an origin, so it can be logged.
+func Redact(origin string) string {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return origin
+	}
+	return u.Redacted()
+}
+
+// RepoKey reduces the many ways to name a git repository to one, like
+// `github.com/org/repo`: the scheme, credentials, port, `.git` suffix, any
+// `//subdir` and `#ref` are dropped. HTTPS, SSH and scp-like
+// `git@host:org/repo.git` forms of a repository all give the same key.
+func RepoKey(repoURL string) string {
+	s := strings.TrimPrefix(repoURL, "git+")
+	s, _, _ = strings.Cut(s, "#")
+	var host, p string
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return strings.ToLower(s)
+		}
+		host, p = u.Hostname(), u.Path
+	} else if at, rest, ok := strings.Cut(s, ":"); ok {
+		// scp-like, user@host:path
+		if _, h, ok := strings.Cut(at, "@"); ok {
+			at = h
+		}
+		host, p = at, rest
+	} else {
+		return strings.ToLower(s)
+	}
+	p = strings.TrimPrefix(p, "/")
+	p, _, _ = strings.Cut(p, "//")
+	p = strings.TrimSuffix(strings.TrimSuffix(p, "/"), ".git")
+	return strings.ToLower(host + "/" + p)
+}
+
+// Ref is the git ref an origin is pinned to with its `#fragment`, as a full
+// ref name. It is empty when the origin follows the default branch.
+func Ref(origin string) string {
+	_, frag, ok := strings.Cut(origin, "#")
+	if !ok || frag == "" {
+		return ""
+	}
+	return fullRef(frag)
+}
+
+func fullRef(ref string) string {
+	if strings.HasPrefix(ref, "refs/") {
+		return ref
+	}
+	return "refs/heads/" + ref
+}
+
+// Matches reports if a push of ref to the repository known by any of
+// repoURLs changes what origin points at. An origin not pinned to a ref
+// follows defaultBranch.
+func Matches(origin string, repoURLs []string, ref, defaultBranch string) bool {
+	if !strings.HasPrefix(origin, "git+") && !strings.HasSuffix(strings.SplitN(origin, "#", 2)[0], ".git") {
+		return false
+	}
+	key := RepoKey(origin)
+	found := false
+	for _, u := range repoURLs {
+		if u != "" && RepoKey(u) == key {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	want := Ref(origin)
+	if want == "" {
+		if defaultBranch == "" {
+			return true
+		}
+		want = fullRef(defaultBranch)
+	}
+	return fullRef(ref) == want
+}
@@ -0,0 +1,115 @@
+package origins
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestRepoKey(t *testing.T) {
+	want := "github.com/org/repo"
+	for _, u := range []string{
+		"git+https://github.com/org/repo.git//packs#refs/heads/main",
+		"git+ssh://git@github.com:22/org/repo.git",
+		"https://user:pw@GitHub.com/org/repo",
+		"git@github.com:org/repo.git",
+		"ssh://git@github.com/org/repo.git/",
+	} {
+		if got := RepoKey(u); got != want {
+			t.Errorf("RepoKey(%q) = %q, want %q", u, got, want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	urls := []string{"https://github.com/org/repo.git", "git@github.com:org/repo.git"}
+	tests := []struct {
+		origin string
+		ref    string
+		want   bool
+	}{
+		{"git+https://github.com/org/repo.git//packs", "refs/heads/main", true},
+		{"git+https://github.com/org/repo.git//packs", "refs/heads/dev", false},
+		{"git+ssh://git@github.com/org/repo.git#dev", "refs/heads/dev", true},
+		{"git+https://github.com/org/repo.git#refs/tags/v1", "refs/heads/main", false},
+		{"git+https://github.com/org/other.git", "refs/heads/main", false},
+		{"file:///srv/packs", "refs/heads/main", false},
+	}
+	for _, tt := range tests {
+		if got := Matches(tt.origin, urls, tt.ref, "main"); got != tt.want {
+			t.Errorf("Matches(%q, %q) = %v, want %v", tt.origin, tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	lookups, hits := 0, 0
+	c := &Cache{Observe: func(_ string, hit bool, _ time.Duration) {
+		if hit {
+			hits++
+		}
+	}, entries: make(map[string]entry), lookup: func(origin string) (fs.FS, error) {
+		lookups++
+		if origin == "bad://x" {
+			return nil, errors.New("unsupported")
+		}
+		return fstest.MapFS{}, nil
+	}}
+	a := "git+https://github.com/org/repo.git//a"
+	b := "git+https://github.com/org/repo.git//b"
+	other := "git+https://github.com/org/other.git"
+	for _, o := range []string{a, a, b, other} {
+		if _, err := c.Lookup(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lookups != 3 || hits != 1 {
+		t.Errorf("expected 3 lookups and a hit, got %d and %d", lookups, hits)
+	}
+	if n := c.Invalidate("git@github.com:org/repo.git"); n != 2 {
+		t.Errorf("Invalidate() dropped %d, want 2", n)
+	}
+	c.Lookup(a)
+	c.Lookup(other)
+	if lookups != 4 {
+		t.Errorf("only the invalidated origin should be resolved again, got %d lookups", lookups)
+	}
+	if _, err := c.Lookup("bad://x"); err == nil {
+		t.Errorf("lookup errors should be returned")
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	var lookups atomic.Int32
+	release := make(chan struct{})
+	c := &Cache{entries: make(map[string]entry), lookup: func(origin string) (fs.FS, error) {
+		lookups.Add(1)
+		if origin == "slow" {
+			<-release
+		}
+		return fstest.MapFS{}, nil
+	}}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Lookup("slow"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// Another origin is not held up by the slow one
+	if _, err := c.Lookup("fast"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	wg.Wait()
+	if n := lookups.Load(); n != 2 {
+		t.Errorf("expected each origin resolved once, got %d lookups", n)
+	}
+}
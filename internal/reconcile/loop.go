@@ -0,0 +1,89 @@
+package reconcile
+
+import (
+	"context"
+	"time"
+
+	"github.com/Vaelatern/nomad-declarative/internal/submission"
+)
+
+// Reconciler runs Sync every Interval, and sooner when triggered. After a
+// failed sync it waits longer each time, up to MaxBackoff.
+type Reconciler struct {
+	Sync       func(ctx context.Context) (Result, error)
+	Interval   time.Duration
+	MaxBackoff time.Duration
+	Status     *Status
+	// OnSync, when set, is told how every sync went
+	OnSync func(res Result, err error)
+
+	wake chan struct{}
+}
+
+func (r *Reconciler) init() {
+	if r.wake == nil {
+		r.wake = make(chan struct{}, 1)
+	}
+	if r.Status == nil {
+		r.Status = &Status{}
+	}
+}
+
+// Trigger asks for a sync as soon as the current one, if any, is done.
+// Triggers while one is already pending are merged into it.
+func (r *Reconciler) Trigger() {
+	r.init()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) error {
+	r.init()
+	for {
+		res, err := r.Sync(ctx)
+		r.Status.record(time.Now(), res, err)
+		if r.OnSync != nil {
+			r.OnSync(res, err)
+		}
+
+		wait := r.Interval
+		if failures := r.Status.Failures(); failures > 0 {
+			max := r.MaxBackoff
+			if max < r.Interval {
+				max = r.Interval
+			}
+			wait = submission.Backoff(failures, r.Interval, max)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-r.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Watch calls onChange whenever fingerprint changes, checking every so
+// often until ctx is done. It is how local config is watched.
+func Watch(ctx context.Context, every time.Duration, fingerprint func() string, onChange func()) {
+	last := fingerprint()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if cur := fingerprint(); cur != last {
+				last = cur
+				onChange()
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package reconcile keeps clusters converged on the config: it remembers
+// what was last applied, so only what changed is applied again, and runs
+// syncs in a loop with a status endpoint.
+package reconcile
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// JobRecord is what was last applied for one deployment.
+type JobRecord struct {
+	Hash      string    `json:"hash"`
+	AppliedAt time.Time `json:"applied_at"`
+	// Overrides are the local files layered over the pack's templates
+	Overrides []string `json:"overrides,omitempty"`
+}
+
+// Manifest records the rendered output last applied for every deployment.
+type Manifest struct {
+	// Revision names everything that was rendered when the last sync fully
+	// succeeded
+	Revision  string               `json:"revision,omitempty"`
+	AppliedAt time.Time            `json:"applied_at,omitzero"`
+	Jobs      map[string]JobRecord `json:"jobs"`
+}
+
+// LoadManifest reads the manifest at path. A missing file is an empty one.
+func LoadManifest(path string) (*Manifest, error) {
+	m := &Manifest{Jobs: make(map[string]JobRecord)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Jobs == nil {
+		m.Jobs = make(map[string]JobRecord)
+	}
+	return m, nil
+}
+
+func (m *Manifest) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Changed lists, sorted, the deployments in hashes whose output differs
+// from what was last applied.
+func (m *Manifest) Changed(hashes map[string]string) []string {
+	var changed []string
+	for name, hash := range hashes {
+		if m.Jobs[name].Hash != hash {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Removed lists, sorted, the deployments last applied that are not in
+// hashes anymore.
+func (m *Manifest) Removed(hashes map[string]string) []string {
+	var removed []string
+	for name := range m.Jobs {
+		if _, ok := hashes[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+func (m *Manifest) Record(job, hash string, at time.Time, overrides ...string) {
+	m.Jobs[job] = JobRecord{Hash: hash, AppliedAt: at, Overrides: overrides}
+}
+
+func (m *Manifest) Forget(job string) {
+	delete(m.Jobs, job)
+}
+
+// HashFiles fingerprints rendered files by their names and contents.
+func HashFiles(files map[string][]byte) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		// Lengths first, so no two sets of files hash the same
+		var size [16]byte
+		binary.BigEndian.PutUint64(size[:8], uint64(len(name)))
+		binary.BigEndian.PutUint64(size[8:], uint64(len(files[name])))
+		h.Write(size[:])
+		h.Write([]byte(name))
+		h.Write(files[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Revision fingerprints every deployment's hash at once, short enough to
+// show.
+func Revision(hashes map[string]string) string {
+	files := make(map[string][]byte, len(hashes))
+	for name, hash := range hashes {
+		files[name] = []byte(hash)
+	}
+	return HashFiles(files)[:12]
+}
@@ -0,0 +1,132 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "applied.json")
+	m, err := LoadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := map[string]string{"web": "1", "east/db": "2"}
+	if got := m.Changed(hashes); !reflect.DeepEqual(got, []string{"east/db", "web"}) {
+		t.Errorf("Changed() on an empty manifest = %v", got)
+	}
+
+	m.Record("web", "1", time.Now())
+	m.Record("old", "3", time.Now())
+	if err := m.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	m, err = LoadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Changed(hashes); !reflect.DeepEqual(got, []string{"east/db"}) {
+		t.Errorf("Changed() = %v, want [east/db]", got)
+	}
+	if got := m.Removed(hashes); !reflect.DeepEqual(got, []string{"old"}) {
+		t.Errorf("Removed() = %v, want [old]", got)
+	}
+}
+
+func TestHashFiles(t *testing.T) {
+	a := HashFiles(map[string][]byte{"a": []byte("bc")})
+	if a == HashFiles(map[string][]byte{"ab": []byte("c")}) {
+		t.Errorf("moving bytes from contents to name should change the hash")
+	}
+	if a != HashFiles(map[string][]byte{"a": []byte("bc")}) {
+		t.Errorf("the same files should hash the same")
+	}
+	if len(Revision(map[string]string{"web": a})) != 12 {
+		t.Errorf("revisions should be short")
+	}
+}
+
+func TestReconciler(t *testing.T) {
+	var calls atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &Reconciler{
+		Interval:   time.Hour,
+		MaxBackoff: time.Hour,
+		Sync: func(ctx context.Context) (Result, error) {
+			n := calls.Add(1)
+			if n == 1 {
+				return Result{}, errors.New("origin unreachable")
+			}
+			if n == 3 {
+				cancel()
+			}
+			return Result{Revision: "abc", Jobs: map[string]JobStatus{"web": {Status: JobApplied}}}, nil
+		},
+	}
+	synced := make(chan error, 3)
+	r.OnSync = func(_ Result, err error) { synced <- err }
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+
+	if err := <-synced; err == nil {
+		t.Fatal("first sync should fail")
+	}
+	rec := httptest.NewRecorder()
+	r.Status.Health(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("health after a failure = %d", rec.Code)
+	}
+
+	// The interval is an hour, only triggers get us further
+	r.Trigger()
+	if err := <-synced; err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	r.Status.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var got statusJSON
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Revision != "abc" || got.Failures != 0 || got.Jobs["web"].Status != JobApplied || got.LastSuccess.IsZero() {
+		t.Errorf("status = %+v", got)
+	}
+
+	r.Trigger()
+	<-synced
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want context.Canceled", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var version atomic.Int32
+	changed := make(chan struct{}, 1)
+	started := make(chan struct{})
+	var once sync.Once
+	go Watch(ctx, time.Millisecond, func() string {
+		v := version.Load()
+		once.Do(func() { close(started) })
+		return string(rune('a' + v))
+	}, func() { changed <- struct{}{} })
+
+	<-started
+	version.Add(1)
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a change was not noticed")
+	}
+}
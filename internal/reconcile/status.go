@@ -0,0 +1,109 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	JobApplied   = "applied"
+	JobUnchanged = "unchanged"
+	JobFailed    = "failed"
+)
+
+// JobStatus is how a deployment fared in the last sync.
+type JobStatus struct {
+	Status      string    `json:"status"`
+	Hash        string    `json:"hash,omitempty"`
+	LastApplied time.Time `json:"last_applied,omitzero"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Result is what a sync reports back.
+type Result struct {
+	Revision string
+	Jobs     map[string]JobStatus
+}
+
+// Status is what the status endpoint shows, kept current by Run.
+type Status struct {
+	mu          sync.Mutex
+	lastSync    time.Time
+	lastSuccess time.Time
+	revision    string
+	err         string
+	failures    int
+	jobs        map[string]JobStatus
+}
+
+type statusJSON struct {
+	LastSync    time.Time            `json:"last_sync,omitzero"`
+	LastSuccess time.Time            `json:"last_success,omitzero"`
+	Revision    string               `json:"revision,omitempty"`
+	Error       string               `json:"error,omitempty"`
+	Failures    int                  `json:"consecutive_failures"`
+	Jobs        map[string]JobStatus `json:"jobs"`
+}
+
+func (s *Status) record(at time.Time, res Result, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSync = at
+	if res.Revision != "" {
+		s.revision = res.Revision
+	}
+	if res.Jobs != nil {
+		s.jobs = res.Jobs
+	}
+	if err != nil {
+		s.err = err.Error()
+		s.failures++
+		return
+	}
+	s.err = ""
+	s.failures = 0
+	s.lastSuccess = at
+}
+
+// Failures is how many syncs in a row have failed.
+func (s *Status) Failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+func (s *Status) snapshot() statusJSON {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make(map[string]JobStatus, len(s.jobs))
+	for name, job := range s.jobs {
+		jobs[name] = job
+	}
+	return statusJSON{
+		LastSync:    s.lastSync,
+		LastSuccess: s.lastSuccess,
+		Revision:    s.revision,
+		Error:       s.err,
+		Failures:    s.failures,
+		Jobs:        jobs,
+	}
+}
+
+// ServeHTTP answers with the status as JSON.
+func (s *Status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.snapshot())
+}
+
+// Health answers 200 unless the last sync failed.
+func (s *Status) Health(w http.ResponseWriter, r *http.Request) {
+	if snap := s.snapshot(); snap.Error != "" {
+		http.Error(w, snap.Error, http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
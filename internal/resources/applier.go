@@ -0,0 +1,119 @@
+package resources
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Vaelatern/nomad-declarative/internal/consulapi"
+	"github.com/Vaelatern/nomad-declarative/internal/kube"
+	"github.com/Vaelatern/nomad-declarative/internal/nomadapi"
+)
+
+// Applier routes each resource to the handler for its kind. It holds the
+// clients for a single deployment, or a single target when pruning.
+type Applier struct {
+	Nomad *nomadapi.Client
+	// Consul is nil when no Consul is configured
+	Consul *consulapi.Client
+	// Kube is nil when no Kubernetes API is configured
+	Kube KubeApplier
+}
+
+// Configured reports if there is a client to apply resources of kind k
+// with.
+func (a Applier) Configured(k Kind) bool {
+	switch k {
+	case KindConsulConfig, KindConsulKV:
+		return a.Consul != nil
+	case KindKubernetes:
+		return a.Kube != nil
+	default:
+		return a.Nomad != nil
+	}
+}
+
+func (a Applier) handler(ref Ref) (Handler, error) {
+	switch ref.Kind {
+	case KindVariable:
+		return VariableHandler{Client: a.Nomad}, nil
+	case KindNamespace:
+		return namespaceHandler(a.Nomad), nil
+	case KindACLPolicy:
+		return policyHandler(a.Nomad), nil
+	case KindQuota:
+		return quotaHandler(a.Nomad), nil
+	case KindNodePool:
+		return nodePoolHandler(a.Nomad), nil
+	case KindConsulConfig, KindConsulKV:
+		if a.Consul == nil {
+			return nil, fmt.Errorf("no Consul configured for %s", ref)
+		}
+		if ref.Kind == KindConsulKV {
+			return ConsulKVHandler{Client: a.Consul}, nil
+		}
+		return ConsulConfigHandler{Client: a.Consul}, nil
+	case KindKubernetes:
+		if a.Kube == nil {
+			return nil, fmt.Errorf("no Kubernetes API configured for %s", ref)
+		}
+		return KubeHandler{Client: a.Kube}, nil
+	default:
+		return nil, fmt.Errorf("no handler for resources of kind %s", ref.Kind)
+	}
+}
+
+// Normalize fills in what a resource left to its cluster's defaults, like
+// the namespace, so the same resource always has the same Ref.
+func (a Applier) Normalize(ctx context.Context, r *Resource) error {
+	switch r.Kind {
+	case KindVariable:
+		v := r.Spec.(nomadapi.Variable)
+		if v.Namespace == "" {
+			v.Namespace = a.Nomad.Namespace()
+		}
+		r.Namespace = v.Namespace
+		r.Spec = v
+	case KindConsulConfig, KindConsulKV:
+		if r.Namespace == "" && a.Consul != nil {
+			r.Namespace = a.Consul.Namespace()
+		}
+	case KindKubernetes:
+		obj := r.Spec.(kube.Object)
+		if obj.Namespace() != "" || a.Kube == nil {
+			return nil
+		}
+		namespaced, err := a.Kube.Namespaced(ctx, obj.APIVersion(), obj.Kind())
+		if err != nil {
+			return err
+		}
+		if namespaced {
+			obj.SetNamespace(a.Kube.Namespace())
+			r.Namespace = obj.Namespace()
+		}
+	}
+	return nil
+}
+
+func (a Applier) Plan(ctx context.Context, r Resource) (Change, error) {
+	h, err := a.handler(r.Ref)
+	if err != nil {
+		return Change{Ref: r.Ref}, err
+	}
+	return h.Plan(ctx, r)
+}
+
+func (a Applier) Apply(ctx context.Context, r Resource) (Change, error) {
+	h, err := a.handler(r.Ref)
+	if err != nil {
+		return Change{Ref: r.Ref}, err
+	}
+	return h.Apply(ctx, r)
+}
+
+func (a Applier) Delete(ctx context.Context, ref Ref) (Change, error) {
+	h, err := a.handler(ref)
+	if err != nil {
+		return Change{Ref: ref}, err
+	}
+	return h.Delete(ctx, ref)
+}
@@ -0,0 +1,381 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/Vaelatern/nomad-declarative/internal/nomadapi"
+)
+
+// byLocation matches files ending in suffix anywhere, and `.hcl` files
+// below the top-level dir.
+func byLocation(suffix, dir string) func(string) bool {
+	return func(rel string) bool {
+		if strings.HasSuffix(rel, suffix) {
+			return true
+		}
+		return strings.HasPrefix(rel, dir+"/") && strings.HasSuffix(rel, ".hcl")
+	}
+}
+
+var (
+	isNamespaceFile = byLocation(".namespace.hcl", "namespaces")
+	isPolicyFile    = byLocation(".policy.hcl", "policies")
+	isQuotaFile     = byLocation(".quota.hcl", "quotas")
+	isNodePoolFile  = byLocation(".nodepool.hcl", "node_pools")
+)
+
+// stem is the file name without its dir and resource suffix.
+func stem(rel, suffix string) string {
+	base := path.Base(rel)
+	if strings.HasSuffix(base, suffix) {
+		return strings.TrimSuffix(base, suffix)
+	}
+	return strings.TrimSuffix(base, ".hcl")
+}
+
+func parseBody(rel string, data []byte, schema *hcl.BodySchema) (*hcl.BodyContent, error) {
+	file, diags := hclparse.NewParser().ParseHCL(data, rel)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	content, diags := file.Body.Content(schema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return content, nil
+}
+
+func optionalString(content *hcl.BodyContent, name string, out *string) error {
+	if attr, ok := content.Attributes[name]; ok {
+		return stringAttr(attr, out)
+	}
+	return nil
+}
+
+// stringMap reads every attribute of a block like `meta { ... }`.
+func stringMap(body hcl.Body) (map[string]string, error) {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	out := make(map[string]string, len(attrs))
+	for name, attr := range attrs {
+		var val string
+		if err := stringAttr(attr, &val); err != nil {
+			return nil, err
+		}
+		out[name] = val
+	}
+	return out, nil
+}
+
+func intAttr(attr *hcl.Attribute, out *int) error {
+	val, diags := attr.Expr.Value(nil)
+	if diags.HasErrors() {
+		return diags
+	}
+	if val.Type() != cty.Number || val.IsNull() {
+		return fmt.Errorf("%s: expected a number", attr.Name)
+	}
+	n, _ := val.AsBigFloat().Int64()
+	*out = int(n)
+	return nil
+}
+
+var namespaceSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{{Name: "name"}, {Name: "description"}, {Name: "quota"}},
+	Blocks:     []hcl.BlockHeaderSchema{{Type: "meta"}},
+}
+
+// parseNamespaceFile reads the spec `nomad namespace apply` takes. The name
+// defaults to the file's.
+func parseNamespaceFile(rel string, data []byte) ([]Resource, error) {
+	content, err := parseBody(rel, data, namespaceSchema)
+	if err != nil {
+		return nil, err
+	}
+	ns := nomadapi.Namespace{Name: stem(rel, ".namespace.hcl")}
+	fields := map[string]*string{"name": &ns.Name, "description": &ns.Description, "quota": &ns.Quota}
+	for name, field := range fields {
+		if err := optionalString(content, name, field); err != nil {
+			return nil, err
+		}
+	}
+	for _, block := range content.Blocks {
+		if ns.Meta, err = stringMap(block.Body); err != nil {
+			return nil, err
+		}
+	}
+	return []Resource{{Ref: Ref{Kind: KindNamespace, Name: ns.Name}, Spec: ns}}, nil
+}
+
+// parseNodePoolFile reads the spec `nomad node pool apply` takes, which may
+// hold several pools:
+//
+//	node_pool "gpu" {
+//	  description = "Nodes with a GPU"
+//	  meta { vendor = "acme" }
+//	}
+func parseNodePoolFile(rel string, data []byte) ([]Resource, error) {
+	content, err := parseBody(rel, data, &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: "node_pool", LabelNames: []string{"name"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []Resource
+	for _, block := range content.Blocks {
+		inner, diags := block.Body.Content(&hcl.BodySchema{
+			Attributes: []hcl.AttributeSchema{{Name: "description"}},
+			Blocks:     []hcl.BlockHeaderSchema{{Type: "meta"}},
+		})
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		pool := nomadapi.NodePool{Name: block.Labels[0]}
+		if err := optionalString(inner, "description", &pool.Description); err != nil {
+			return nil, err
+		}
+		for _, meta := range inner.Blocks {
+			if pool.Meta, err = stringMap(meta.Body); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, Resource{Ref: Ref{Kind: KindNodePool, Name: pool.Name}, Spec: pool})
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no node_pool block")
+	}
+	return out, nil
+}
+
+// parsePolicyFile takes the whole file as the rules of an ACL policy named
+// after the file. The rules are checked to be HCL but are otherwise left to
+// Nomad.
+func parsePolicyFile(rel string, data []byte) ([]Resource, error) {
+	if _, diags := hclparse.NewParser().ParseHCL(data, rel); diags.HasErrors() {
+		return nil, diags
+	}
+	p := nomadapi.ACLPolicy{Name: stem(rel, ".policy.hcl"), Rules: string(data)}
+	return []Resource{{Ref: Ref{Kind: KindACLPolicy, Name: p.Name}, Spec: p}}, nil
+}
+
+var quotaSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{{Name: "name"}, {Name: "description"}},
+	Blocks:     []hcl.BlockHeaderSchema{{Type: "limit"}},
+}
+
+// parseQuotaFile reads the spec `nomad quota apply` takes.
+func parseQuotaFile(rel string, data []byte) ([]Resource, error) {
+	content, err := parseBody(rel, data, quotaSchema)
+	if err != nil {
+		return nil, err
+	}
+	q := nomadapi.QuotaSpec{Name: stem(rel, ".quota.hcl")}
+	if err := optionalString(content, "name", &q.Name); err != nil {
+		return nil, err
+	}
+	if err := optionalString(content, "description", &q.Description); err != nil {
+		return nil, err
+	}
+	for _, block := range content.Blocks {
+		inner, diags := block.Body.Content(&hcl.BodySchema{
+			Attributes: []hcl.AttributeSchema{{Name: "region", Required: true}},
+			Blocks:     []hcl.BlockHeaderSchema{{Type: "region_limit"}},
+		})
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		var limit nomadapi.QuotaLimit
+		if err := optionalString(inner, "region", &limit.Region); err != nil {
+			return nil, err
+		}
+		for _, rl := range inner.Blocks {
+			attrs, diags := rl.Body.JustAttributes()
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			res := &nomadapi.QuotaResources{}
+			fields := map[string]*int{"cpu": &res.CPU, "cores": &res.Cores, "memory": &res.MemoryMB, "memory_max": &res.MemoryMaxMB}
+			for name, attr := range attrs {
+				field, ok := fields[name]
+				if !ok {
+					return nil, fmt.Errorf("region_limit: unsupported attribute %s", name)
+				}
+				if err := intAttr(attr, field); err != nil {
+					return nil, err
+				}
+			}
+			limit.RegionLimit = res
+		}
+		q.Limits = append(q.Limits, limit)
+	}
+	return []Resource{{Ref: Ref{Kind: KindQuota, Name: q.Name}, Spec: q}}, nil
+}
+
+// objectHandler manages cluster-wide objects that are simply replaced whole
+// when they differ.
+type objectHandler struct {
+	get func(ctx context.Context, name string) (interface{}, error)
+	put func(ctx context.Context, spec interface{}) error
+	del func(ctx context.Context, name string) error
+}
+
+func (h objectHandler) plan(ctx context.Context, r Resource) (Change, error) {
+	change := Change{Ref: r.Ref}
+	cur, err := h.get(ctx, r.Name)
+	if errors.Is(err, nomadapi.ErrNotFound) {
+		change.Action = ActionCreate
+		change.Diff = fieldsDiff(nil, r.Spec)
+		return change, nil
+	}
+	if err != nil {
+		return change, err
+	}
+	change.Diff = fieldsDiff(cur, r.Spec)
+	change.Action = ActionNone
+	if len(change.Diff) > 0 {
+		change.Action = ActionUpdate
+	}
+	return change, nil
+}
+
+func (h objectHandler) Plan(ctx context.Context, r Resource) (Change, error) {
+	return h.plan(ctx, r)
+}
+
+func (h objectHandler) Apply(ctx context.Context, r Resource) (Change, error) {
+	change, err := h.plan(ctx, r)
+	if err != nil || change.Action == ActionNone {
+		return change, err
+	}
+	return change, h.put(ctx, r.Spec)
+}
+
+func (h objectHandler) Delete(ctx context.Context, ref Ref) (Change, error) {
+	change := Change{Ref: ref, Action: ActionNone}
+	_, err := h.get(ctx, ref.Name)
+	if errors.Is(err, nomadapi.ErrNotFound) {
+		return change, nil
+	}
+	if err != nil {
+		return change, err
+	}
+	change.Action = ActionDelete
+	return change, h.del(ctx, ref.Name)
+}
+
+// fieldsDiff compares every field of want with the same in have, by their
+// JSON form, and describes each that differs. Fields are compared even when
+// empty, so clearing one is a change, and empty values of any kind are
+// taken as the same. A nil have lists the fields want sets.
+func fieldsDiff(have, want interface{}) []string {
+	h, w := specFields(have), specFields(want)
+	keys := make([]string, 0, len(w))
+	for k := range w {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var diff []string
+	for _, k := range keys {
+		wantJSON, _ := json.Marshal(w[k])
+		if have == nil {
+			if !emptyJSON(wantJSON) {
+				diff = append(diff, fmt.Sprintf("+ %s = %s", k, shorten(string(wantJSON))))
+			}
+			continue
+		}
+		haveJSON, _ := json.Marshal(h[k])
+		if string(haveJSON) != string(wantJSON) && !(emptyJSON(haveJSON) && emptyJSON(wantJSON)) {
+			diff = append(diff, fmt.Sprintf("~ %s = %s -> %s", k, shorten(string(haveJSON)), shorten(string(wantJSON))))
+		}
+	}
+	return diff
+}
+
+// specFields maps the top level fields of a spec struct by their JSON name,
+// leaving none out for being empty.
+func specFields(v interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return out
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return out
+	}
+	for i := 0; i < rv.NumField(); i++ {
+		f := rv.Type().Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		out[name] = rv.Field(i).Interface()
+	}
+	return out
+}
+
+func emptyJSON(data []byte) bool {
+	switch string(data) {
+	case "null", `""`, "0", "false", "{}", "[]":
+		return true
+	}
+	return false
+}
+
+func shorten(s string) string {
+	if len(s) > 60 {
+		return s[:57] + "..."
+	}
+	return s
+}
+
+func namespaceHandler(c *nomadapi.Client) Handler {
+	return objectHandler{
+		get: func(ctx context.Context, name string) (interface{}, error) { return c.GetNamespace(ctx, name) },
+		put: func(ctx context.Context, spec interface{}) error { return c.PutNamespace(ctx, spec.(nomadapi.Namespace)) },
+		del: c.DeleteNamespace,
+	}
+}
+
+func policyHandler(c *nomadapi.Client) Handler {
+	return objectHandler{
+		get: func(ctx context.Context, name string) (interface{}, error) { return c.GetACLPolicy(ctx, name) },
+		put: func(ctx context.Context, spec interface{}) error { return c.PutACLPolicy(ctx, spec.(nomadapi.ACLPolicy)) },
+		del: c.DeleteACLPolicy,
+	}
+}
+
+func quotaHandler(c *nomadapi.Client) Handler {
+	return objectHandler{
+		get: func(ctx context.Context, name string) (interface{}, error) { return c.GetQuotaSpec(ctx, name) },
+		put: func(ctx context.Context, spec interface{}) error { return c.PutQuotaSpec(ctx, spec.(nomadapi.QuotaSpec)) },
+		del: c.DeleteQuotaSpec,
+	}
+}
+
+func nodePoolHandler(c *nomadapi.Client) Handler {
+	return objectHandler{
+		get: func(ctx context.Context, name string) (interface{}, error) { return c.GetNodePool(ctx, name) },
+		put: func(ctx context.Context, spec interface{}) error { return c.PutNodePool(ctx, spec.(nomadapi.NodePool)) },
+		del: c.DeleteNodePool,
+	}
+}
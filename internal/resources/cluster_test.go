@@ -0,0 +1,162 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Vaelatern/nomad-declarative/internal/nomadapi"
+)
+
+// fakeObjects stores whatever is written to the namespace, policy, quota
+// and node pool endpoints, keyed by the path it can be read back from.
+type fakeObjects struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	writes  []string
+}
+
+func newFakeObjects(t *testing.T) (*fakeObjects, *nomadapi.Client) {
+	f := &fakeObjects{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c, err := nomadapi.NewClient(nomadapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, c
+}
+
+func (f *fakeObjects) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case http.MethodPost, http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		var named struct{ Name string }
+		json.Unmarshal(data, &named)
+		switch key {
+		case "/v1/quota":
+			key += "/" + named.Name
+		case "/v1/node/pools":
+			key = "/v1/node/pool/" + named.Name
+		}
+		f.objects[key] = data
+		f.writes = append(f.writes, key)
+	case http.MethodDelete:
+		delete(f.objects, key)
+	}
+}
+
+func TestParseClusterFiles(t *testing.T) {
+	tests := []struct {
+		rel  string
+		data string
+		want []Resource
+	}{
+		{
+			rel:  "namespaces/apps.hcl",
+			data: "description = \"Apps\"\nquota = \"small\"\nmeta {\n  owner = \"ops\"\n}\n",
+			want: []Resource{{Ref: Ref{Kind: KindNamespace, Name: "apps"}, Spec: nomadapi.Namespace{Name: "apps", Description: "Apps", Quota: "small", Meta: map[string]string{"owner": "ops"}}}},
+		},
+		{
+			rel:  "web.policy.hcl",
+			data: "namespace \"apps\" {\n  policy = \"read\"\n}\n",
+			want: []Resource{{Ref: Ref{Kind: KindACLPolicy, Name: "web"}, Spec: nomadapi.ACLPolicy{Name: "web", Rules: "namespace \"apps\" {\n  policy = \"read\"\n}\n"}}},
+		},
+		{
+			rel:  "pools.nodepool.hcl",
+			data: "node_pool \"gpu\" {\n  description = \"GPUs\"\n}\nnode_pool \"edge\" {}\n",
+			want: []Resource{
+				{Ref: Ref{Kind: KindNodePool, Name: "gpu"}, Spec: nomadapi.NodePool{Name: "gpu", Description: "GPUs"}},
+				{Ref: Ref{Kind: KindNodePool, Name: "edge"}, Spec: nomadapi.NodePool{Name: "edge"}},
+			},
+		},
+		{
+			rel:  "small.quota.hcl",
+			data: "limit {\n  region = \"global\"\n  region_limit {\n    cpu = 2500\n    memory = 1000\n  }\n}\n",
+			want: []Resource{{Ref: Ref{Kind: KindQuota, Name: "small"}, Spec: nomadapi.QuotaSpec{Name: "small", Limits: []nomadapi.QuotaLimit{{Region: "global", RegionLimit: &nomadapi.QuotaResources{CPU: 2500, MemoryMB: 1000}}}}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rel, func(t *testing.T) {
+			var got []Resource
+			for _, r := range recognizers {
+				if r.match(tt.rel) {
+					var err error
+					if got, err = r.parse(tt.rel, []byte(tt.data)); err != nil {
+						t.Fatal(err)
+					}
+					break
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsed = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterObjects_ApplyInOrder(t *testing.T) {
+	fake, client := newFakeObjects(t)
+	applier := Applier{Nomad: client}
+	ctx := context.Background()
+
+	list := []Resource{
+		{Ref: Ref{Kind: KindACLPolicy, Name: "web"}, Spec: nomadapi.ACLPolicy{Name: "web", Rules: "x"}},
+		{Ref: Ref{Kind: KindNamespace, Name: "apps"}, Spec: nomadapi.Namespace{Name: "apps", Quota: "small"}},
+		{Ref: Ref{Kind: KindNodePool, Name: "gpu"}, Spec: nomadapi.NodePool{Name: "gpu"}},
+		{Ref: Ref{Kind: KindQuota, Name: "small"}, Spec: nomadapi.QuotaSpec{Name: "small"}},
+	}
+	Sort(list)
+	for _, r := range list {
+		change, err := applier.Apply(ctx, r)
+		if err != nil || change.Action != ActionCreate {
+			t.Fatalf("Apply(%s) = %v, %v", r.Ref, change, err)
+		}
+	}
+	want := []string{"/v1/quota/small", "/v1/namespace/apps", "/v1/node/pool/gpu", "/v1/acl/policy/web"}
+	if !reflect.DeepEqual(fake.writes, want) {
+		t.Errorf("writes = %v, want %v", fake.writes, want)
+	}
+
+	change, err := applier.Plan(ctx, Resource{Ref: Ref{Kind: KindNamespace, Name: "apps"}, Spec: nomadapi.Namespace{Name: "apps", Description: "Apps", Quota: "small"}})
+	if err != nil || change.Action != ActionUpdate || !strings.Contains(strings.Join(change.Diff, "\n"), "Description") {
+		t.Errorf("Plan() = %v, %v", change, err)
+	}
+
+	described := Resource{Ref: Ref{Kind: KindNamespace, Name: "apps"}, Spec: nomadapi.Namespace{Name: "apps", Description: "Apps", Meta: map[string]string{"team": "web"}}}
+	if _, err := applier.Apply(ctx, described); err != nil {
+		t.Fatal(err)
+	}
+	if change, err := applier.Plan(ctx, described); err != nil || change.Action != ActionNone {
+		t.Errorf("Plan() of what was applied = %v, %v", change, err)
+	}
+	cleared := Resource{Ref: described.Ref, Spec: nomadapi.Namespace{Name: "apps", Meta: map[string]string{}}}
+	change, err = applier.Plan(ctx, cleared)
+	if diff := strings.Join(change.Diff, "\n"); err != nil || change.Action != ActionUpdate || !strings.Contains(diff, "Description") || !strings.Contains(diff, "Meta") {
+		t.Errorf("Plan() clearing fields = %v, %v", change, err)
+	}
+
+	change, err = applier.Delete(ctx, Ref{Kind: KindNodePool, Name: "gpu"})
+	if err != nil || change.Action != ActionDelete {
+		t.Errorf("Delete() = %v, %v", change, err)
+	}
+	if _, ok := fake.objects["/v1/node/pool/gpu"]; ok {
+		t.Errorf("node pool was not deleted")
+	}
+}
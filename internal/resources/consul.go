@@ -0,0 +1,214 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclparse"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+
+	"github.com/Vaelatern/nomad-declarative/internal/consulapi"
+)
+
+// isConsulConfigFile matches `*.consul.hcl` and `*.consul.json` anywhere,
+// and HCL or JSON files below a top-level `consul/config/` dir.
+func isConsulConfigFile(rel string) bool {
+	if strings.HasSuffix(rel, ".consul.hcl") || strings.HasSuffix(rel, ".consul.json") {
+		return true
+	}
+	return strings.HasPrefix(rel, "consul/config/") && (strings.HasSuffix(rel, ".hcl") || strings.HasSuffix(rel, ".json"))
+}
+
+// isConsulKVFile matches everything below a top-level `consul/kv/` dir.
+func isConsulKVFile(rel string) bool {
+	return strings.HasPrefix(rel, "consul/kv/")
+}
+
+// parseConsulConfigFile reads one config entry, as `consul config write`
+// takes it. HCL files may only use attributes, so nested values are
+// written as objects: `Sources = [{ Name = "web", Action = "allow" }]`.
+func parseConsulConfigFile(rel string, data []byte) ([]Resource, error) {
+	entry := consulapi.ConfigEntry{}
+	if strings.HasSuffix(rel, ".json") {
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, err
+		}
+	} else {
+		file, diags := hclparse.NewParser().ParseHCL(data, rel)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		attrs, diags := file.Body.JustAttributes()
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		for name, attr := range attrs {
+			val, diags := attr.Expr.Value(nil)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			raw, err := ctyjson.Marshal(val, val.Type())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			var v interface{}
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			entry[name] = v
+		}
+	}
+	switch {
+	case entry.Kind() == "":
+		return nil, fmt.Errorf("Kind is missing, fields take Consul's CamelCase names")
+	case !slices.Contains(consulapi.ConfigKinds, entry.Kind()):
+		return nil, fmt.Errorf("unknown config entry kind %q", entry.Kind())
+	case entry.Name() == "":
+		return nil, fmt.Errorf("Name is missing")
+	}
+	return []Resource{{
+		Ref:  Ref{Kind: KindConsulConfig, Namespace: entry.Namespace(), Name: entry.Kind() + "/" + entry.Name()},
+		Spec: entry,
+	}}, nil
+}
+
+// parseConsulKVFile makes a key of the file's path below `consul/kv/`,
+// holding the file's contents as they are.
+func parseConsulKVFile(rel string, data []byte) ([]Resource, error) {
+	key := strings.TrimPrefix(rel, "consul/kv/")
+	return []Resource{{Ref: Ref{Kind: KindConsulKV, Name: key}, Spec: data}}, nil
+}
+
+// ConsulConfigHandler manages config entries. Only the fields in the
+// rendered entry are compared, so defaults Consul fills in are no change.
+type ConsulConfigHandler struct {
+	Client *consulapi.Client
+}
+
+func splitConfigName(ref Ref) (kind, name string, err error) {
+	kind, name, ok := strings.Cut(ref.Name, "/")
+	if !ok {
+		return "", "", fmt.Errorf("bad config entry name %q", ref.Name)
+	}
+	return kind, name, nil
+}
+
+func (h ConsulConfigHandler) Plan(ctx context.Context, r Resource) (Change, error) {
+	want := r.Spec.(consulapi.ConfigEntry)
+	change := Change{Ref: r.Ref}
+	live, err := h.Client.GetConfigEntry(ctx, want.Kind(), r.Namespace, want.Name())
+	if errors.Is(err, consulapi.ErrNotFound) {
+		change.Action = ActionCreate
+		return change, nil
+	}
+	if err != nil {
+		return change, err
+	}
+	change.Diff = objectDiff("", map[string]interface{}(live), map[string]interface{}(want), false)
+	change.Action = ActionNone
+	if len(change.Diff) > 0 {
+		change.Action = ActionUpdate
+	}
+	return change, nil
+}
+
+func (h ConsulConfigHandler) Apply(ctx context.Context, r Resource) (Change, error) {
+	change, err := h.Plan(ctx, r)
+	if err != nil || change.Action == ActionNone {
+		return change, err
+	}
+	entry := r.Spec.(consulapi.ConfigEntry)
+	if r.Namespace != "" && entry.Namespace() == "" {
+		entry = cloneEntry(entry)
+		entry["Namespace"] = r.Namespace
+	}
+	return change, h.Client.PutConfigEntry(ctx, entry)
+}
+
+func cloneEntry(e consulapi.ConfigEntry) consulapi.ConfigEntry {
+	out := make(consulapi.ConfigEntry, len(e)+1)
+	for k, v := range e {
+		out[k] = v
+	}
+	return out
+}
+
+func (h ConsulConfigHandler) Delete(ctx context.Context, ref Ref) (Change, error) {
+	change := Change{Ref: ref, Action: ActionNone}
+	kind, name, err := splitConfigName(ref)
+	if err != nil {
+		return change, err
+	}
+	_, err = h.Client.GetConfigEntry(ctx, kind, ref.Namespace, name)
+	if errors.Is(err, consulapi.ErrNotFound) {
+		return change, nil
+	}
+	if err != nil {
+		return change, err
+	}
+	change.Action = ActionDelete
+	return change, h.Client.DeleteConfigEntry(ctx, kind, ref.Namespace, name)
+}
+
+// ConsulKVHandler manages KV keys with check-and-set, as VariableHandler
+// does variables. Values are never shown.
+type ConsulKVHandler struct {
+	Client *consulapi.Client
+}
+
+func (h ConsulKVHandler) current(ctx context.Context, ns, key string) (*consulapi.KVPair, error) {
+	cur, err := h.Client.GetKV(ctx, ns, key)
+	if errors.Is(err, consulapi.ErrNotFound) {
+		return nil, nil
+	}
+	return cur, err
+}
+
+func (h ConsulKVHandler) plan(ctx context.Context, r Resource) (Change, *consulapi.KVPair, error) {
+	change := Change{Ref: r.Ref}
+	cur, err := h.current(ctx, r.Namespace, r.Name)
+	if err != nil {
+		return change, nil, err
+	}
+	switch {
+	case cur == nil:
+		change.Action = ActionCreate
+	case string(cur.Value) != string(r.Spec.([]byte)):
+		change.Action = ActionUpdate
+		change.Diff = []string{"~ value"}
+	default:
+		change.Action = ActionNone
+	}
+	return change, cur, nil
+}
+
+func (h ConsulKVHandler) Plan(ctx context.Context, r Resource) (Change, error) {
+	change, _, err := h.plan(ctx, r)
+	return change, err
+}
+
+func (h ConsulKVHandler) Apply(ctx context.Context, r Resource) (Change, error) {
+	change, cur, err := h.plan(ctx, r)
+	if err != nil || change.Action == ActionNone {
+		return change, err
+	}
+	var cas uint64
+	if cur != nil {
+		cas = cur.ModifyIndex
+	}
+	return change, h.Client.PutKV(ctx, r.Namespace, r.Name, r.Spec.([]byte), cas)
+}
+
+func (h ConsulKVHandler) Delete(ctx context.Context, ref Ref) (Change, error) {
+	change := Change{Ref: ref, Action: ActionNone}
+	cur, err := h.current(ctx, ref.Namespace, ref.Name)
+	if err != nil || cur == nil {
+		return change, err
+	}
+	change.Action = ActionDelete
+	return change, h.Client.DeleteKV(ctx, ref.Namespace, ref.Name, cur.ModifyIndex)
+}
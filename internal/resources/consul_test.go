@@ -0,0 +1,216 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Vaelatern/nomad-declarative/internal/consulapi"
+)
+
+// fakeConsul keeps config entries and keys in memory, adding the fields
+// and indexes Consul would.
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	entries map[string]consulapi.ConfigEntry
+	kv      map[string]consulapi.KVPair
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, *consulapi.Client) {
+	f := &fakeConsul{entries: make(map[string]consulapi.ConfigEntry), kv: make(map[string]consulapi.KVPair)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c, err := consulapi.NewClient(consulapi.Config{Address: strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, c
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	switch {
+	case r.URL.Path == "/v1/config" && r.Method == http.MethodPut:
+		var e consulapi.ConfigEntry
+		json.NewDecoder(r.Body).Decode(&e)
+		e["CreateIndex"] = f.index
+		if e.Kind() == "service-defaults" && e["Protocol"] == nil {
+			e["Protocol"] = "tcp"
+		}
+		f.entries[e.Kind()+"/"+e.Name()] = e
+		io.WriteString(w, "true")
+	case strings.HasPrefix(r.URL.Path, "/v1/config/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/config/")
+		e, ok := f.entries[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.entries, key)
+			return
+		}
+		json.NewEncoder(w).Encode(e)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		cur, exists := f.kv[key]
+		cas, _ := strconv.ParseUint(r.URL.Query().Get("cas"), 10, 64)
+		switch r.Method {
+		case http.MethodGet:
+			if !exists {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode([]consulapi.KVPair{cur})
+		case http.MethodPut:
+			if cas != cur.ModifyIndex {
+				io.WriteString(w, "false")
+				return
+			}
+			value, _ := io.ReadAll(r.Body)
+			f.kv[key] = consulapi.KVPair{Key: key, Value: value, ModifyIndex: f.index}
+			io.WriteString(w, "true")
+		case http.MethodDelete:
+			if cas != cur.ModifyIndex {
+				io.WriteString(w, "false")
+				return
+			}
+			delete(f.kv, key)
+			io.WriteString(w, "true")
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestParseConsulConfigFile(t *testing.T) {
+	got, err := parseConsulConfigFile("web.consul.hcl", []byte(`
+Kind = "service-intentions"
+Name = "web"
+Sources = [{
+  Name   = "api"
+  Action = "allow"
+}]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := consulapi.ConfigEntry{
+		"Kind":    "service-intentions",
+		"Name":    "web",
+		"Sources": []interface{}{map[string]interface{}{"Name": "api", "Action": "allow"}},
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Spec, want) || got[0].Name != "service-intentions/web" {
+		t.Errorf("parseConsulConfigFile() = %+v, want %+v", got, want)
+	}
+
+	for rel, bad := range map[string]string{
+		"a.consul.hcl":         `Name = "web"`,
+		"b.consul.hcl":         `kind = "service-defaults"` + "\n" + `name = "web"`,
+		"consul/config/c.json": `{"Kind": "service-default", "Name": "web"}`,
+		"d.consul.json":        `{"Kind": "mesh"}`,
+	} {
+		if _, err := parseConsulConfigFile(rel, []byte(bad)); err == nil {
+			t.Errorf("%s should not parse", rel)
+		}
+	}
+}
+
+func TestRecognized_ConsulKVWins(t *testing.T) {
+	found, err := parseConsulKVFile("consul/kv/app/web/config.nv.hcl", []byte("x"))
+	if err != nil || found[0].Name != "app/web/config.nv.hcl" {
+		t.Errorf("parseConsulKVFile() = %v, %v", found, err)
+	}
+	if !Recognized("consul/kv/app/web/config.nv.hcl") || !recognizers[0].match("consul/kv/app/web/config.nv.hcl") {
+		t.Errorf("keys below consul/kv should be recognized as keys first")
+	}
+}
+
+func TestConsulConfigHandler(t *testing.T) {
+	fake, client := newFakeConsul(t)
+	applier := Applier{Consul: client}
+	ctx := context.Background()
+
+	found, err := parseConsulConfigFile("consul/config/web.json", []byte(`{"Kind": "service-defaults", "Name": "web"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := found[0]
+	if change, err := applier.Apply(ctx, r); err != nil || change.Action != ActionCreate {
+		t.Fatalf("first Apply() = %v, %v", change, err)
+	}
+	// Fields Consul filled in are not a change
+	if change, err := applier.Plan(ctx, r); err != nil || change.Action != ActionNone {
+		t.Errorf("Plan() after apply = %v, %v", change, err)
+	}
+
+	r.Spec = consulapi.ConfigEntry{"Kind": "service-defaults", "Name": "web", "Protocol": "http"}
+	change, err := applier.Plan(ctx, r)
+	if err != nil || !reflect.DeepEqual(change.Diff, []string{"~ Protocol = tcp -> http"}) {
+		t.Errorf("Plan() of an update = %v, %v", change, err)
+	}
+	if _, err := applier.Apply(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if fake.entries["service-defaults/web"]["Protocol"] != "http" {
+		t.Errorf("entry was not updated: %v", fake.entries)
+	}
+
+	if change, err := applier.Delete(ctx, r.Ref); err != nil || change.Action != ActionDelete {
+		t.Errorf("Delete() = %v, %v", change, err)
+	}
+	if change, err := applier.Delete(ctx, r.Ref); err != nil || change.Action != ActionNone {
+		t.Errorf("Delete() of a missing entry = %v, %v", change, err)
+	}
+}
+
+func TestConsulKVHandler(t *testing.T) {
+	fake, client := newFakeConsul(t)
+	applier := Applier{Consul: client}
+	ctx := context.Background()
+
+	found, _ := parseConsulKVFile("consul/kv/app/db_password", []byte("hunter2"))
+	r := found[0]
+	if change, err := applier.Apply(ctx, r); err != nil || change.Action != ActionCreate {
+		t.Fatalf("first Apply() = %v, %v", change, err)
+	}
+	if change, err := applier.Plan(ctx, r); err != nil || change.Action != ActionNone {
+		t.Errorf("Plan() after apply = %v, %v", change, err)
+	}
+
+	r.Spec = []byte("hunter3")
+	change, err := applier.Plan(ctx, r)
+	if err != nil || change.Action != ActionUpdate || strings.Contains(change.String(), "hunter") {
+		t.Errorf("Plan() of an update = %v, %v", change, err)
+	}
+	if _, err := applier.Apply(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.kv["app/db_password"].Value) != "hunter3" {
+		t.Errorf("key was not updated: %v", fake.kv)
+	}
+
+	// Someone else writes in between our read and write
+	err = client.PutKV(ctx, "", "app/db_password", []byte("x"), 1)
+	if !errors.Is(err, consulapi.ErrCASConflict) {
+		t.Errorf("stale cas = %v, want ErrCASConflict", err)
+	}
+
+	if change, err := applier.Delete(ctx, r.Ref); err != nil || change.Action != ActionDelete {
+		t.Errorf("Delete() = %v, %v", change, err)
+	}
+	if len(fake.kv) != 0 {
+		t.Errorf("key was not deleted: %v", fake.kv)
+	}
+}
@@ -0,0 +1,215 @@
+package resources
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Vaelatern/nomad-declarative/internal/kube"
+)
+
+// KubeApplier is what applying Kubernetes manifests needs. *kube.Client
+// speaks to a real API server.
+type KubeApplier interface {
+	Namespace() string
+	Namespaced(ctx context.Context, apiVersion, kind string) (bool, error)
+	Get(ctx context.Context, apiVersion, kind, namespace, name string) (kube.Object, error)
+	Apply(ctx context.Context, obj kube.Object) error
+	Delete(ctx context.Context, apiVersion, kind, namespace, name string) error
+}
+
+// parseKubeFile makes a resource of every object in a manifest. They are
+// named `<apiVersion>/<kind>/<name>`, like `apps/v1/Deployment/web`.
+func parseKubeFile(rel string, data []byte) ([]Resource, error) {
+	objs, err := kube.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Resource, 0, len(objs))
+	for _, obj := range objs {
+		out = append(out, Resource{
+			Ref:  Ref{Kind: KindKubernetes, Namespace: obj.Namespace(), Name: kubeName(obj.APIVersion(), obj.Kind(), obj.Name())},
+			Spec: obj,
+		})
+	}
+	return out, nil
+}
+
+func kubeName(apiVersion, kind, name string) string {
+	return apiVersion + "/" + kind + "/" + name
+}
+
+// splitKubeName undoes kubeName. The apiVersion may itself hold a slash.
+func splitKubeName(full string) (apiVersion, kind, name string, err error) {
+	parts := strings.Split(full, "/")
+	if len(parts) < 3 {
+		return "", "", "", fmt.Errorf("bad Kubernetes object name %q", full)
+	}
+	n := len(parts)
+	return strings.Join(parts[:n-2], "/"), parts[n-2], parts[n-1], nil
+}
+
+// kubeOrder is where an object named by kubeName goes among Kubernetes
+// objects: namespaces and custom resource definitions first, then built in
+// kinds, then the custom resources the definitions allow.
+func kubeOrder(full string) int {
+	apiVersion, kind, _, err := splitKubeName(full)
+	if err != nil {
+		return 2
+	}
+	switch {
+	case kind == "Namespace" && apiVersion == "v1":
+		return 0
+	case kind == "CustomResourceDefinition":
+		return 1
+	}
+	group, _, found := strings.Cut(apiVersion, "/")
+	if found && strings.Contains(group, ".") && !strings.HasSuffix(group, ".k8s.io") {
+		return 3
+	}
+	return 2
+}
+
+// KubeHandler applies objects with server-side apply, so only the fields in
+// the manifest are owned and compared.
+type KubeHandler struct {
+	Client KubeApplier
+}
+
+func (h KubeHandler) Plan(ctx context.Context, r Resource) (Change, error) {
+	want := r.Spec.(kube.Object)
+	change := Change{Ref: r.Ref}
+	live, err := h.Client.Get(ctx, want.APIVersion(), want.Kind(), want.Namespace(), want.Name())
+	if errors.Is(err, kube.ErrNotFound) {
+		change.Action = ActionCreate
+		return change, nil
+	}
+	if err != nil {
+		return change, err
+	}
+	secret := want.Kind() == "Secret"
+	if secret {
+		want = foldStringData(want)
+	}
+	change.Diff = objectDiff("", live, want, secret)
+	change.Action = ActionNone
+	if len(change.Diff) > 0 {
+		change.Action = ActionUpdate
+	}
+	return change, nil
+}
+
+func (h KubeHandler) Apply(ctx context.Context, r Resource) (Change, error) {
+	change, err := h.Plan(ctx, r)
+	if err != nil || change.Action == ActionNone {
+		return change, err
+	}
+	return change, h.Client.Apply(ctx, r.Spec.(kube.Object))
+}
+
+func (h KubeHandler) Delete(ctx context.Context, ref Ref) (Change, error) {
+	change := Change{Ref: ref, Action: ActionNone}
+	apiVersion, kind, name, err := splitKubeName(ref.Name)
+	if err != nil {
+		return change, err
+	}
+	err = h.Client.Delete(ctx, apiVersion, kind, ref.Namespace, name)
+	if errors.Is(err, kube.ErrNotFound) {
+		return change, nil
+	}
+	if err == nil {
+		change.Action = ActionDelete
+	}
+	return change, err
+}
+
+// foldStringData gives a copy of a Secret with its stringData encoded into
+// data, as the server stores it, so it compares with the live object.
+func foldStringData(obj kube.Object) kube.Object {
+	stringData, ok := asMap(obj["stringData"])
+	if !ok {
+		return obj
+	}
+	folded := make(kube.Object, len(obj))
+	for k, v := range obj {
+		folded[k] = v
+	}
+	delete(folded, "stringData")
+	data := make(map[string]interface{})
+	if old, ok := asMap(obj["data"]); ok {
+		for k, v := range old {
+			data[k] = v
+		}
+	}
+	for k, v := range stringData {
+		data[k] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(v)))
+	}
+	folded["data"] = data
+	return folded
+}
+
+// objectDiff lists every leaf of want that live lacks or has differently.
+// Fields only the server set are ignored, also in list elements as long as
+// the list keeps its length. Secret values are never shown.
+func objectDiff(prefix string, live, want interface{}, secret bool) []string {
+	if wantMap, ok := asMap(want); ok {
+		liveMap, _ := asMap(live)
+		keys := make([]string, 0, len(wantMap))
+		for k := range wantMap {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var diff []string
+		for _, k := range keys {
+			p := k
+			if prefix != "" {
+				p = prefix + "." + k
+			}
+			if _, ok := liveMap[k]; !ok && liveMap != nil {
+				diff = append(diff, "+ "+p)
+				continue
+			}
+			diff = append(diff, objectDiff(p, liveMap[k], wantMap[k], secret)...)
+		}
+		return diff
+	}
+	wantList, isList := want.([]interface{})
+	liveList, _ := live.([]interface{})
+	if isList && len(wantList) == len(liveList) {
+		var diff []string
+		for i := range wantList {
+			diff = append(diff, objectDiff(fmt.Sprintf("%s[%d]", prefix, i), liveList[i], wantList[i], secret)...)
+		}
+		return diff
+	}
+	if equalValues(live, want) {
+		return nil
+	}
+	if secret {
+		return []string{"~ " + prefix}
+	}
+	return []string{fmt.Sprintf("~ %s = %v -> %v", prefix, shorten(fmt.Sprint(live)), shorten(fmt.Sprint(want)))}
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case kube.Object:
+		return m, true
+	}
+	return nil, false
+}
+
+// equalValues compares YAML and JSON decoded values, where numbers may
+// have come out as different types.
+func equalValues(a, b interface{}) bool {
+	if fmt.Sprint(a) == fmt.Sprint(b) {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
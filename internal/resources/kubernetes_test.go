@@ -0,0 +1,178 @@
+package resources
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Vaelatern/nomad-declarative/internal/kube"
+)
+
+// fakeKube is a KubeApplier over a map, where applied objects gain the
+// fields a server would add.
+type fakeKube struct {
+	objects map[string]kube.Object
+}
+
+func (f *fakeKube) Namespace() string { return "apps" }
+
+func (f *fakeKube) Namespaced(ctx context.Context, apiVersion, kind string) (bool, error) {
+	return kind != "Namespace", nil
+}
+
+func (f *fakeKube) Get(ctx context.Context, apiVersion, kind, namespace, name string) (kube.Object, error) {
+	obj, ok := f.objects[kubeName(apiVersion, kind, namespace+"/"+name)]
+	if !ok {
+		return nil, kube.ErrNotFound
+	}
+	return obj, nil
+}
+
+func (f *fakeKube) Apply(ctx context.Context, obj kube.Object) error {
+	live := kube.Object{"status": map[string]interface{}{"ready": true}}
+	for k, v := range obj {
+		live[k] = v
+	}
+	f.objects[kubeName(obj.APIVersion(), obj.Kind(), obj.Namespace()+"/"+obj.Name())] = live
+	return nil
+}
+
+func (f *fakeKube) Delete(ctx context.Context, apiVersion, kind, namespace, name string) error {
+	key := kubeName(apiVersion, kind, namespace+"/"+name)
+	if _, ok := f.objects[key]; !ok {
+		return kube.ErrNotFound
+	}
+	delete(f.objects, key)
+	return nil
+}
+
+func TestKubeHandler(t *testing.T) {
+	fake := &fakeKube{objects: make(map[string]kube.Object)}
+	applier := Applier{Kube: fake}
+	ctx := context.Background()
+
+	found, err := parseKubeFile("web.k8s.yaml", []byte(`
+apiVersion: apps/v1
+kind: Deployment
+metadata: {name: web}
+spec: {replicas: 2}
+---
+apiVersion: v1
+kind: Namespace
+metadata: {name: apps}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range found {
+		if err := applier.Normalize(ctx, &found[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if found[0].Namespace != "apps" || found[0].Spec.(kube.Object).Namespace() != "apps" {
+		t.Errorf("Deployment was not put in the default namespace: %+v", found[0].Ref)
+	}
+	if found[1].Namespace != "" {
+		t.Errorf("Namespace objects are not namespaced, got %q", found[1].Namespace)
+	}
+
+	r := found[0]
+	if change, err := applier.Apply(ctx, r); err != nil || change.Action != ActionCreate {
+		t.Fatalf("first Apply() = %v, %v", change, err)
+	}
+	if change, err := applier.Plan(ctx, r); err != nil || change.Action != ActionNone {
+		t.Errorf("Plan() after apply = %v, %v", change, err)
+	}
+
+	r.Spec.(kube.Object)["spec"] = map[string]interface{}{"replicas": 3, "paused": true}
+	change, err := applier.Plan(ctx, r)
+	if err != nil || !reflect.DeepEqual(change.Diff, []string{"+ spec.paused", "~ spec.replicas = 2 -> 3"}) {
+		t.Errorf("Plan() of an update = %v, %v", change, err)
+	}
+
+	if change, err := applier.Delete(ctx, r.Ref); err != nil || change.Action != ActionDelete {
+		t.Errorf("Delete() = %v, %v", change, err)
+	}
+	if change, err := applier.Delete(ctx, r.Ref); err != nil || change.Action != ActionNone {
+		t.Errorf("Delete() of a missing object = %v, %v", change, err)
+	}
+}
+
+func TestApplier_NoKube(t *testing.T) {
+	_, err := Applier{}.Plan(context.Background(), Resource{Ref: Ref{Kind: KindKubernetes, Name: "v1/ConfigMap/a"}})
+	if err == nil {
+		t.Errorf("planning a manifest without a Kubernetes API should fail")
+	}
+	if (Applier{}).Configured(KindKubernetes) {
+		t.Errorf("an Applier without a Kubernetes API should not apply manifests")
+	}
+}
+
+func TestKubeHandler_SecretStringData(t *testing.T) {
+	fake := &fakeKube{objects: map[string]kube.Object{
+		"v1/Secret/apps/db": {
+			"apiVersion": "v1", "kind": "Secret",
+			"metadata": map[string]interface{}{"name": "db", "namespace": "apps"},
+			"data":     map[string]interface{}{"user": "YWRtaW4=", "password": "aHVudGVyMg=="},
+		},
+	}}
+	applier := Applier{Kube: fake}
+	secret := func(password string) Resource {
+		found, err := parseKubeFile("db.k8s.yaml", []byte(`
+apiVersion: v1
+kind: Secret
+metadata: {name: db, namespace: apps}
+data: {user: YWRtaW4=}
+stringData: {password: `+password+`}
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found[0]
+	}
+	if change, err := applier.Plan(context.Background(), secret("hunter2")); err != nil || change.Action != ActionNone {
+		t.Errorf("Plan() of stringData the server holds as data = %v, %v", change, err)
+	}
+	change, err := applier.Plan(context.Background(), secret("changed"))
+	if err != nil || !reflect.DeepEqual(change.Diff, []string{"~ data.password"}) {
+		t.Errorf("Plan() of changed stringData = %v, %v", change, err)
+	}
+}
+
+func TestSort_KubeKinds(t *testing.T) {
+	list := []Resource{
+		{Ref: Ref{Kind: KindKubernetes, Namespace: "apps", Name: kubeName("cert-manager.io/v1", "Certificate", "web")}},
+		{Ref: Ref{Kind: KindKubernetes, Namespace: "apps", Name: kubeName("apps/v1", "Deployment", "web")}},
+		{Ref: Ref{Kind: KindKubernetes, Name: kubeName("apiextensions.k8s.io/v1", "CustomResourceDefinition", "certificates.cert-manager.io")}},
+		{Ref: Ref{Kind: KindKubernetes, Name: kubeName("v1", "Namespace", "apps")}},
+		{Ref: Ref{Kind: KindKubernetes, Name: kubeName("rbac.authorization.k8s.io/v1", "ClusterRole", "reader")}},
+	}
+	Sort(list)
+	var got []string
+	for _, r := range list {
+		got = append(got, r.Name)
+	}
+	want := []string{
+		"v1/Namespace/apps",
+		"apiextensions.k8s.io/v1/CustomResourceDefinition/certificates.cert-manager.io",
+		"rbac.authorization.k8s.io/v1/ClusterRole/reader",
+		"apps/v1/Deployment/web",
+		"cert-manager.io/v1/Certificate/web",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Sort() = %q, want %q", got, want)
+	}
+}
+
+func TestState_OrphansKubeNamespace(t *testing.T) {
+	s := NewState()
+	web := Ref{Kind: KindKubernetes, Namespace: "apps", Name: kubeName("v1", "ConfigMap", "web")}
+	old := Ref{Kind: KindKubernetes, Namespace: "apps", Name: kubeName("v1", "ConfigMap", "old")}
+	s.Add(web, "web")
+	s.Add(old, "web")
+	// Declared with no API to fill in the namespace
+	unplaced := Resource{Ref: Ref{Kind: KindKubernetes, Name: kubeName("v1", "ConfigMap", "web")}}
+	if got := s.Orphans([]Resource{unplaced}); !reflect.DeepEqual(got, []Ref{old}) {
+		t.Errorf("Orphans() = %v, want %v", got, []Ref{old})
+	}
+}
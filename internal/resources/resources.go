@@ -0,0 +1,245 @@
+// Package resources finds the typed outputs packs render next to their
+// scripts, and applies them through the API of the system they belong to
+// rather than through a script.
+package resources
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Vaelatern/nomad-declarative/internal/kube"
+)
+
+type Kind string
+
+const (
+	KindQuota     Kind = "nomad-quota"
+	KindNamespace Kind = "nomad-namespace"
+	KindNodePool  Kind = "nomad-node-pool"
+	KindACLPolicy Kind = "nomad-acl-policy"
+	KindVariable  Kind = "nomad-variable"
+
+	KindConsulConfig Kind = "consul-config-entry"
+	KindConsulKV     Kind = "consul-kv"
+
+	KindKubernetes Kind = "kubernetes"
+)
+
+// kindOrder is the order kinds are applied in, lowest first, and pruned
+// in reverse. Quotas come before the namespaces using them, and namespaces
+// and pools before anything placed in them. Kinds not listed go last.
+// Kubernetes objects are ordered among themselves by kubeOrder.
+var kindOrder = map[Kind]int{
+	KindQuota:     1,
+	KindNamespace: 2,
+	KindNodePool:  3,
+	KindACLPolicy: 4,
+	KindVariable:  10,
+
+	KindConsulConfig: 11,
+	KindConsulKV:     12,
+
+	KindKubernetes: 20,
+}
+
+// ClusterScoped reports if resources of kind k are what others are placed
+// in, so they are applied for every deployment before any of them.
+func (k Kind) ClusterScoped() bool {
+	return k == KindQuota || k == KindNamespace || k == KindNodePool
+}
+
+// Ref names a resource wherever it lives.
+type Ref struct {
+	Target    string `json:"target,omitempty"`
+	Kind      Kind   `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+func (r Ref) String() string {
+	s := string(r.Kind) + " "
+	if r.Namespace != "" {
+		s += r.Namespace + "/"
+	}
+	s += r.Name
+	if r.Target != "" {
+		s += " @ " + r.Target
+	}
+	return s
+}
+
+// Resource is one typed output found in a deployment's output directory.
+type Resource struct {
+	Ref
+	// Job is the deployment the resource was rendered for
+	Job string
+	// File is where it was read from, relative to the deployment's dir
+	File string
+	// Spec is the decoded contents, its type depends on Kind
+	Spec interface{}
+}
+
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+	ActionNone   Action = "no-op"
+)
+
+var actionSymbol = map[Action]string{
+	ActionCreate: "+",
+	ActionUpdate: "~",
+	ActionDelete: "-",
+	ActionNone:   " ",
+}
+
+// Change is what applying a resource did, or would do.
+type Change struct {
+	Ref
+	Action Action
+	// Diff lines describe the change, with secret values left out
+	Diff []string
+}
+
+func (c Change) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", actionSymbol[c.Action], c.Ref)
+	for _, line := range c.Diff {
+		fmt.Fprintf(&b, "\n    %s", line)
+	}
+	return b.String()
+}
+
+// Handler plans, applies and deletes resources of one kind on one cluster.
+type Handler interface {
+	Plan(ctx context.Context, r Resource) (Change, error)
+	Apply(ctx context.Context, r Resource) (Change, error)
+	Delete(ctx context.Context, ref Ref) (Change, error)
+}
+
+// recognizer knows which rendered files hold resources of its kind.
+type recognizer struct {
+	match func(rel string) bool
+	parse func(rel string, data []byte) ([]Resource, error)
+}
+
+// recognizers are tried in order. Anything below `consul/kv/` is a key, even
+// when it looks like another kind.
+var recognizers = []recognizer{
+	{match: isConsulKVFile, parse: parseConsulKVFile},
+	{match: isConsulConfigFile, parse: parseConsulConfigFile},
+	{match: isQuotaFile, parse: parseQuotaFile},
+	{match: isNamespaceFile, parse: parseNamespaceFile},
+	{match: isNodePoolFile, parse: parseNodePoolFile},
+	{match: isPolicyFile, parse: parsePolicyFile},
+	{match: isVariableFile, parse: parseVariableFile},
+	{match: kube.IsManifest, parse: parseKubeFile},
+}
+
+// Recognized reports if the file at rel, relative to a deployment's output
+// dir, is a typed resource rather than something for a script to use.
+func Recognized(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, r := range recognizers {
+		if r.match(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// DiscoverFiles finds the typed resources among the files rendered for the
+// deployment job, keyed by their slash separated path below its dir, in the
+// order they should be applied.
+func DiscoverFiles(files map[string][]byte, job, target string) ([]Resource, error) {
+	var found []Resource
+	for _, rel := range slices.Sorted(maps.Keys(files)) {
+		for _, r := range recognizers {
+			if !r.match(rel) {
+				continue
+			}
+			parsed, err := r.parse(rel, files[rel])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path.Join(job, rel), err)
+			}
+			for _, res := range parsed {
+				res.Job = job
+				res.File = rel
+				res.Target = target
+				found = append(found, res)
+			}
+			break
+		}
+	}
+	Sort(found)
+	return found, nil
+}
+
+// Sort puts resources in the order they are applied: by kind, then name.
+func Sort(list []Resource) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return less(list[i].Ref, list[j].Ref)
+	})
+}
+
+func order(k Kind) int {
+	if o, ok := kindOrder[k]; ok {
+		return o
+	}
+	return 1000
+}
+
+func less(a, b Ref) bool {
+	if order(a.Kind) != order(b.Kind) {
+		return order(a.Kind) < order(b.Kind)
+	}
+	if a.Kind == KindKubernetes && kubeOrder(a.Name) != kubeOrder(b.Name) {
+		return kubeOrder(a.Name) < kubeOrder(b.Name)
+	}
+	if a.Target != b.Target {
+		return a.Target < b.Target
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+// itemsDiff describes how a key/value map changes, without the values.
+func itemsDiff(have, want map[string]string) []string {
+	keys := make(map[string]bool)
+	for k := range have {
+		keys[k] = true
+	}
+	for k := range want {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var diff []string
+	for _, k := range sorted {
+		old, inHave := have[k]
+		val, inWant := want[k]
+		switch {
+		case !inHave:
+			diff = append(diff, "+ "+k)
+		case !inWant:
+			diff = append(diff, "- "+k)
+		case old != val:
+			diff = append(diff, "~ "+k)
+		}
+	}
+	return diff
+}
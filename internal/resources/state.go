@@ -0,0 +1,124 @@
+package resources
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// State remembers every resource this tool applied, and the deployment it
+// was applied for. Only resources in it are ever pruned, so anything
+// created by hand is left alone.
+type State struct {
+	mu sync.Mutex
+	// owned maps each resource to the deployment that applied it
+	owned map[Ref]string
+}
+
+type stateFile struct {
+	Resources []stateEntry `json:"resources"`
+}
+
+type stateEntry struct {
+	Ref
+	Job string `json:"job,omitempty"`
+}
+
+func NewState() *State {
+	return &State{owned: make(map[Ref]string)}
+}
+
+// LoadState reads the state at path. A missing file is an empty state.
+func LoadState(path string) (*State, error) {
+	s := NewState()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f stateFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	for _, entry := range f.Resources {
+		s.owned[entry.Ref] = entry.Job
+	}
+	return s, nil
+}
+
+func (s *State) Save(path string) error {
+	var f stateFile
+	for _, ref := range s.Refs() {
+		f.Resources = append(f.Resources, stateEntry{Ref: ref, Job: s.Owner(ref)})
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Add records ref as applied for the deployment job.
+func (s *State) Add(ref Ref, job string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.owned[ref] = job
+}
+
+// Owner is the deployment ref was last applied for, empty when not known.
+func (s *State) Owner(ref Ref) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.owned[ref]
+}
+
+func (s *State) Remove(ref Ref) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.owned, ref)
+}
+
+// Refs lists the owned resources in apply order.
+func (s *State) Refs() []Ref {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refs := make([]Ref, 0, len(s.owned))
+	for ref := range s.owned {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return less(refs[i], refs[j]) })
+	return refs
+}
+
+// Orphans lists owned resources that are no longer declared, in the reverse
+// of apply order so dependents go first. A Kubernetes object declared
+// without a namespace keeps its name in any namespace: either its kind has
+// none, or there was no API to ask for the default one.
+func (s *State) Orphans(declared []Resource) []Ref {
+	want := make(map[Ref]bool, len(declared))
+	for _, r := range declared {
+		want[r.Ref] = true
+	}
+	var orphans []Ref
+	refs := s.Refs()
+	for i := len(refs) - 1; i >= 0; i-- {
+		anywhere := refs[i]
+		anywhere.Namespace = ""
+		if !want[refs[i]] && !(refs[i].Kind == KindKubernetes && want[anywhere]) {
+			orphans = append(orphans, refs[i])
+		}
+	}
+	return orphans
+}
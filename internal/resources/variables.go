@@ -0,0 +1,180 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/Vaelatern/nomad-declarative/internal/nomadapi"
+)
+
+// isVariableFile matches `*.nv.hcl` anywhere, and any `.hcl` file below a
+// top-level `variables/` dir.
+func isVariableFile(rel string) bool {
+	if strings.HasSuffix(rel, ".nv.hcl") {
+		return true
+	}
+	return strings.HasPrefix(rel, "variables/") && strings.HasSuffix(rel, ".hcl")
+}
+
+var variableSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "path"},
+		{Name: "namespace"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "items"},
+	},
+}
+
+// parseVariableFile reads the same spec `nomad var put` takes:
+//
+//	path = "nomad/jobs/web"
+//	namespace = "apps"
+//	items {
+//	  user = "web"
+//	}
+//
+// Without a path, one below `variables/` uses its location there, so
+// `variables/nomad/jobs/web.hcl` is the variable `nomad/jobs/web`.
+func parseVariableFile(rel string, data []byte) ([]Resource, error) {
+	file, diags := hclparse.NewParser().ParseHCL(data, rel)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	content, diags := file.Body.Content(variableSchema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	v := nomadapi.Variable{Items: make(map[string]string)}
+	if attr, ok := content.Attributes["path"]; ok {
+		if err := stringAttr(attr, &v.Path); err != nil {
+			return nil, err
+		}
+	}
+	if attr, ok := content.Attributes["namespace"]; ok {
+		if err := stringAttr(attr, &v.Namespace); err != nil {
+			return nil, err
+		}
+	}
+	if v.Path == "" {
+		if !strings.HasPrefix(rel, "variables/") {
+			return nil, fmt.Errorf("no path set for the variable")
+		}
+		v.Path = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(rel, "variables/"), ".hcl"), ".nv")
+	}
+	v.Path = strings.Trim(path.Clean(v.Path), "/")
+
+	for _, block := range content.Blocks {
+		attrs, diags := block.Body.JustAttributes()
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		for name, attr := range attrs {
+			var val string
+			if err := stringAttr(attr, &val); err != nil {
+				return nil, err
+			}
+			v.Items[name] = val
+		}
+	}
+	if len(v.Items) == 0 {
+		return nil, fmt.Errorf("variable %s has no items", v.Path)
+	}
+
+	return []Resource{{
+		Ref:  Ref{Kind: KindVariable, Namespace: v.Namespace, Name: v.Path},
+		Spec: v,
+	}}, nil
+}
+
+func stringAttr(attr *hcl.Attribute, out *string) error {
+	val, diags := attr.Expr.Value(nil)
+	if diags.HasErrors() {
+		return diags
+	}
+	if val.IsNull() || !val.IsKnown() {
+		return fmt.Errorf("%s: needs a value", attr.Name)
+	}
+	switch val.Type() {
+	case cty.String:
+		*out = val.AsString()
+	case cty.Number:
+		*out = val.AsBigFloat().Text('f', -1)
+	case cty.Bool:
+		*out = fmt.Sprint(val.True())
+	default:
+		return fmt.Errorf("%s: expected a string, got %s", attr.Name, val.Type().FriendlyName())
+	}
+	return nil
+}
+
+// VariableHandler manages Nomad Variables with check-and-set, so a variable
+// changed by someone else between the read and the write is not clobbered.
+type VariableHandler struct {
+	Client *nomadapi.Client
+}
+
+func (h VariableHandler) current(ctx context.Context, ns, name string) (*nomadapi.Variable, error) {
+	cur, err := h.Client.GetVariable(ctx, ns, name)
+	if errors.Is(err, nomadapi.ErrNotFound) {
+		return nil, nil
+	}
+	return cur, err
+}
+
+func (h VariableHandler) plan(ctx context.Context, r Resource) (Change, *nomadapi.Variable, error) {
+	want := r.Spec.(nomadapi.Variable)
+	change := Change{Ref: r.Ref}
+	cur, err := h.current(ctx, want.Namespace, want.Path)
+	if err != nil {
+		return change, nil, err
+	}
+	if cur == nil {
+		change.Action = ActionCreate
+		change.Diff = itemsDiff(nil, want.Items)
+		return change, nil, nil
+	}
+	change.Diff = itemsDiff(cur.Items, want.Items)
+	change.Action = ActionNone
+	if len(change.Diff) > 0 {
+		change.Action = ActionUpdate
+	}
+	return change, cur, nil
+}
+
+func (h VariableHandler) Plan(ctx context.Context, r Resource) (Change, error) {
+	change, _, err := h.plan(ctx, r)
+	return change, err
+}
+
+func (h VariableHandler) Apply(ctx context.Context, r Resource) (Change, error) {
+	change, cur, err := h.plan(ctx, r)
+	if err != nil || change.Action == ActionNone {
+		return change, err
+	}
+	var cas uint64
+	if cur != nil {
+		cas = cur.ModifyIndex
+	}
+	_, err = h.Client.PutVariable(ctx, r.Spec.(nomadapi.Variable), cas)
+	return change, err
+}
+
+func (h VariableHandler) Delete(ctx context.Context, ref Ref) (Change, error) {
+	change := Change{Ref: ref, Action: ActionNone}
+	cur, err := h.current(ctx, ref.Namespace, ref.Name)
+	if err != nil || cur == nil {
+		return change, err
+	}
+	change.Action = ActionDelete
+	change.Diff = itemsDiff(cur.Items, nil)
+	return change, h.Client.DeleteVariable(ctx, ref.Namespace, ref.Name, cur.ModifyIndex)
+}
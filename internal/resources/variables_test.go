@@ -0,0 +1,190 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Vaelatern/nomad-declarative/internal/nomadapi"
+)
+
+// fakeNomad keeps variables in memory and honours cas the way Nomad does.
+type fakeNomad struct {
+	mu    sync.Mutex
+	index uint64
+	vars  map[string]nomadapi.Variable
+}
+
+func newFakeNomad(t *testing.T) (*fakeNomad, *nomadapi.Client) {
+	f := &fakeNomad{vars: make(map[string]nomadapi.Variable)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c, err := nomadapi.NewClient(nomadapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, c
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.URL.Path, "/v1/var/") {
+		http.NotFound(w, r)
+		return
+	}
+	key := r.URL.Query().Get("namespace") + "/" + strings.TrimPrefix(r.URL.Path, "/v1/var/")
+	cur, exists := f.vars[key]
+	casOK := func() bool {
+		cas, err := strconv.ParseUint(r.URL.Query().Get("cas"), 10, 64)
+		return err == nil && cas == cur.ModifyIndex
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(cur)
+	case http.MethodPut:
+		if !casOK() {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(cur)
+			return
+		}
+		var v nomadapi.Variable
+		json.NewDecoder(r.Body).Decode(&v)
+		f.index++
+		v.ModifyIndex = f.index
+		f.vars[key] = v
+		json.NewEncoder(w).Encode(v)
+	case http.MethodDelete:
+		if !casOK() {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		delete(f.vars, key)
+	}
+}
+
+func TestParseVariableFile(t *testing.T) {
+	got, err := parseVariableFile("variables/nomad/jobs/web.hcl", []byte(`
+items {
+  user = "web"
+  port = 8080
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := nomadapi.Variable{Path: "nomad/jobs/web", Items: map[string]string{"user": "web", "port": "8080"}}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Spec, want) || got[0].Name != "nomad/jobs/web" {
+		t.Errorf("parseVariableFile() = %+v, want %+v", got, want)
+	}
+
+	if _, err := parseVariableFile("db.nv.hcl", []byte(`items { a = "b" }`)); err == nil {
+		t.Errorf("a *.nv.hcl without a path should be an error")
+	}
+}
+
+func TestDiscoverFiles(t *testing.T) {
+	found, err := DiscoverFiles(map[string][]byte{
+		"db.nv.hcl":         []byte(`path = "db"` + "\n" + `items { pw = "x" }`),
+		"variables/app.hcl": []byte(`items { a = "b" }`),
+		"web.nomad":         []byte(`job "web" {}`),
+	}, "east/web", "east")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range found {
+		names = append(names, r.Ref.String())
+	}
+	want := []string{"nomad-variable app @ east", "nomad-variable db @ east"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("DiscoverFiles() = %v, want %v", names, want)
+	}
+	if found[0].File != "variables/app.hcl" || found[0].Job != "east/web" {
+		t.Errorf("DiscoverFiles() = %+v", found[0])
+	}
+}
+
+func TestVariableHandler(t *testing.T) {
+	fake, client := newFakeNomad(t)
+	applier := Applier{Nomad: client}
+	ctx := context.Background()
+
+	r := Resource{Ref: Ref{Kind: KindVariable, Name: "app"}, Spec: nomadapi.Variable{Path: "app", Items: map[string]string{"a": "1"}}}
+	if err := applier.Normalize(ctx, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Namespace != "default" {
+		t.Errorf("Normalize() namespace = %q, want default", r.Namespace)
+	}
+
+	change, err := applier.Apply(ctx, r)
+	if err != nil || change.Action != ActionCreate {
+		t.Fatalf("first Apply() = %v, %v", change, err)
+	}
+	change, err = applier.Plan(ctx, r)
+	if err != nil || change.Action != ActionNone {
+		t.Errorf("Plan() after apply = %v, %v", change, err)
+	}
+
+	r.Spec = nomadapi.Variable{Namespace: "default", Path: "app", Items: map[string]string{"a": "2", "b": "3"}}
+	change, err = applier.Plan(ctx, r)
+	if err != nil || change.Action != ActionUpdate || !reflect.DeepEqual(change.Diff, []string{"~ a", "+ b"}) {
+		t.Errorf("Plan() of an update = %v, %v", change, err)
+	}
+	if strings.Contains(change.String(), "2") {
+		t.Errorf("plan shows a secret value: %s", change)
+	}
+	if _, err := applier.Apply(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else writes in between our read and write
+	_, err = client.PutVariable(ctx, nomadapi.Variable{Path: "app", Items: map[string]string{"x": "y"}}, 1)
+	if !errors.Is(err, nomadapi.ErrCASConflict) {
+		t.Errorf("stale cas = %v, want ErrCASConflict", err)
+	}
+
+	change, err = applier.Delete(ctx, r.Ref)
+	if err != nil || change.Action != ActionDelete {
+		t.Errorf("Delete() = %v, %v", change, err)
+	}
+	if len(fake.vars) != 0 {
+		t.Errorf("variable was not deleted: %v", fake.vars)
+	}
+}
+
+func TestState_Orphans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s := NewState()
+	keep := Ref{Kind: KindVariable, Namespace: "default", Name: "keep"}
+	gone := Ref{Kind: KindVariable, Namespace: "default", Name: "gone"}
+	s.Add(keep, "web")
+	s.Add(gone, "east/web")
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := loaded.Orphans([]Resource{{Ref: keep}})
+	if !reflect.DeepEqual(got, []Ref{gone}) {
+		t.Errorf("Orphans() = %v, want %v", got, []Ref{gone})
+	}
+	if owner := loaded.Owner(gone); owner != "east/web" {
+		t.Errorf("Owner() = %q, want the deployment that applied it", owner)
+	}
+}
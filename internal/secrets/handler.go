@@ -0,0 +1,69 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// redactingHandler replaces the values of a Resolver in every message and
+// attribute logged through it.
+type redactingHandler struct {
+	inner slog.Handler
+	r     *Resolver
+}
+
+// NewRedactingHandler wraps inner so nothing r resolved reaches it.
+func NewRedactingHandler(inner slog.Handler, r *Resolver) slog.Handler {
+	return redactingHandler{inner: inner, r: r}
+}
+
+func (h redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h redactingHandler) Handle(ctx context.Context, rec slog.Record) error {
+	out := slog.NewRecord(rec.Time, rec.Level, h.r.Redact(rec.Message), rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.redact(a))
+		return true
+	})
+	return h.inner.Handle(ctx, out)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redact(a)
+	}
+	return redactingHandler{inner: h.inner.WithAttrs(redacted), r: h.r}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{inner: h.inner.WithGroup(name), r: h.r}
+}
+
+func (h redactingHandler) redact(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, h.r.Redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			redacted[i] = h.redact(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindAny:
+		switch any := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, h.r.Redact(any.Error()))
+		case []byte:
+			return slog.String(a.Key, h.r.Redact(string(any)))
+		case fmt.Stringer:
+			return slog.String(a.Key, h.r.Redact(any.String()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// lookupEnv reads secret://env/NAME from the environment.
+func lookupEnv(_ context.Context, ref Ref) (string, error) {
+	v, ok := os.LookupEnv(ref.Path)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref.Path)
+	}
+	return v, nil
+}
+
+// lookupFile reads secret://file/<absolute path>. Without a key the whole
+// file is the value, less a trailing newline. With one, the file is read
+// as JSON, TOML or YAML by its extension, or else as KEY=VALUE lines.
+func lookupFile(_ context.Context, ref Ref) (string, error) {
+	data, err := os.ReadFile("/" + ref.Path)
+	if err != nil {
+		return "", err
+	}
+	if ref.Key == "" {
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	values := make(map[string]interface{})
+	switch path.Ext(ref.Path) {
+	case ".json":
+		err = json.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if k, v, ok := strings.Cut(line, "="); ok {
+				values[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"'`)
+			}
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("Can't parse %s: %v", ref.Path, err)
+	}
+	return pick(values, ref)
+}
+
+// pick is the value at a key, which may go into tables with dots.
+func pick(values map[string]interface{}, ref Ref) (string, error) {
+	var cur interface{} = values
+	for _, part := range strings.Split(ref.Key, ".") {
+		table, ok := cur.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("%s has no key %s", ref.Path, ref.Key)
+		}
+		if cur, ok = table[part]; !ok {
+			return "", fmt.Errorf("%s has no key %s", ref.Path, ref.Key)
+		}
+	}
+	switch v := cur.(type) {
+	case string:
+		return v, nil
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("key %s of %s is not a single value", ref.Key, ref.Path)
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
@@ -0,0 +1,217 @@
+// Package secrets resolves `secret://` references in config values, and
+// keeps the values resolved so they can be redacted wherever they would
+// otherwise be shown.
+//
+//	secret://env/NAME
+//	secret://file/run/secrets/db.json#password
+//	secret://vault/secret/apps/db#password
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Prefix starts every secret reference.
+const Prefix = "secret://"
+
+// Redacted replaces secret values wherever they are shown.
+const Redacted = "[redacted]"
+
+// Ref is a parsed secret reference: secret://<provider>/<path>#<key>.
+type Ref struct {
+	Provider string
+	Path     string
+	// Key picks one value out of a structured secret, empty for all of it
+	Key string
+}
+
+func (r Ref) String() string {
+	s := Prefix + r.Provider + "/" + r.Path
+	if r.Key != "" {
+		s += "#" + r.Key
+	}
+	return s
+}
+
+// IsRef reports if s is a secret reference.
+func IsRef(s string) bool {
+	return strings.HasPrefix(s, Prefix)
+}
+
+func Parse(s string) (Ref, error) {
+	if !IsRef(s) {
+		return Ref{}, fmt.Errorf("%q is not a secret reference", s)
+	}
+	rest, key, _ := strings.Cut(strings.TrimPrefix(s, Prefix), "#")
+	provider, p, ok := strings.Cut(rest, "/")
+	if !ok || provider == "" || p == "" {
+		return Ref{}, fmt.Errorf("%q should look like %s<provider>/<path>", s, Prefix)
+	}
+	p, err := url.PathUnescape(p)
+	if err != nil {
+		return Ref{}, fmt.Errorf("bad path in %q: %v", s, err)
+	}
+	return Ref{Provider: provider, Path: p, Key: key}, nil
+}
+
+// Provider looks secrets up in one place.
+type Provider interface {
+	Lookup(ctx context.Context, ref Ref) (string, error)
+}
+
+// ProviderFunc lets a function be a Provider.
+type ProviderFunc func(ctx context.Context, ref Ref) (string, error)
+
+func (f ProviderFunc) Lookup(ctx context.Context, ref Ref) (string, error) {
+	return f(ctx, ref)
+}
+
+// Resolver resolves references through its providers, each once, and
+// remembers every value it resolved. It is safe for concurrent use.
+type Resolver struct {
+	providers map[string]Provider
+
+	mu     sync.Mutex
+	values map[string]string
+	// known are values learned some other way than resolving them
+	known map[string]bool
+}
+
+// NewResolver resolves through the file, env and vault providers, and those
+// given, which win on a clash of names.
+func NewResolver(extra map[string]Provider) *Resolver {
+	r := &Resolver{
+		providers: map[string]Provider{
+			"file":  ProviderFunc(lookupFile),
+			"env":   ProviderFunc(lookupEnv),
+			"vault": &Vault{},
+		},
+		values: make(map[string]string),
+		known:  make(map[string]bool),
+	}
+	for name, p := range extra {
+		r.providers[name] = p
+	}
+	return r
+}
+
+// Resolve looks up the value of a secret reference.
+func (r *Resolver) Resolve(ctx context.Context, s string) (string, error) {
+	r.mu.Lock()
+	v, ok := r.values[s]
+	r.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+	ref, err := Parse(s)
+	if err != nil {
+		return "", err
+	}
+	p, ok := r.providers[ref.Provider]
+	if !ok {
+		return "", fmt.Errorf("no secret provider %s for %s", ref.Provider, s)
+	}
+	v, err = p.Lookup(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("Can't resolve %s: %v", s, err)
+	}
+	r.mu.Lock()
+	r.values[s] = v
+	r.mu.Unlock()
+	return v, nil
+}
+
+// ResolveAll replaces every secret reference among the strings of v, going
+// into maps and lists, with its value. v is not changed.
+func (r *Resolver) ResolveAll(ctx context.Context, v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		if !IsRef(val) {
+			return val, nil
+		}
+		return r.Resolve(ctx, val)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			resolved, err := r.ResolveAll(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = resolved
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			resolved, err := r.ResolveAll(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// Add makes values secret as if they had been resolved, for those found
+// some other way, like decrypting them.
+func (r *Resolver) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		r.known[v] = true
+	}
+}
+
+// Values are every non-empty value resolved or added so far, longest first
+// so one containing another is redacted whole.
+func (r *Resolver) Values() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[string]bool, len(r.values))
+	var out []string
+	add := func(v string) {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	for _, v := range r.values {
+		add(v)
+	}
+	for v := range r.known {
+		add(v)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i]) != len(out[j]) {
+			return len(out[i]) > len(out[j])
+		}
+		return out[i] < out[j]
+	})
+	return out
+}
+
+// Redact replaces every value resolved so far in s.
+func (r *Resolver) Redact(s string) string {
+	for _, v := range r.Values() {
+		s = strings.ReplaceAll(s, v, Redacted)
+	}
+	return s
+}
+
+// Contains reports if data holds any value resolved so far.
+func (r *Resolver) Contains(data []byte) bool {
+	for _, v := range r.Values() {
+		if strings.Contains(string(data), v) {
+			return true
+		}
+	}
+	return false
+}
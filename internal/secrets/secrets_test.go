@@ -0,0 +1,145 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	ref, err := Parse("secret://file/run/secrets/db.json#user.password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != (Ref{Provider: "file", Path: "run/secrets/db.json", Key: "user.password"}) {
+		t.Errorf("got %+v", ref)
+	}
+	if ref.String() != "secret://file/run/secrets/db.json#user.password" {
+		t.Errorf("got %s", ref)
+	}
+	for _, bad := range []string{"file/x", "secret://", "secret://env", "secret:///x"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("%q should not parse", bad)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"token":     "s3cret-token\n",
+		"db.json":   `{"user": {"password": "hunter2"}, "port": 5432}`,
+		"db.toml":   "password = \"from-toml\"\n",
+		"db.yaml":   "password: from-yaml\n",
+		"app.env":   "# comment\nAPI_KEY=\"from-env-file\"\n",
+		"list.json": `{"hosts": ["a", "b"]}`,
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("SECRETS_TEST_VAR", "from-env")
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/kv/data/apps/db" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"password": "from-vault"}, "metadata": {"version": 3}}}`))
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "root")
+
+	r := NewResolver(map[string]Provider{
+		"static": ProviderFunc(func(_ context.Context, ref Ref) (string, error) {
+			return "static-" + ref.Path, nil
+		}),
+	})
+	ctx := context.Background()
+	for ref, want := range map[string]string{
+		"secret://file" + dir + "/token":                 "s3cret-token",
+		"secret://file" + dir + "/db.json#user.password": "hunter2",
+		"secret://file" + dir + "/db.json#port":          "5432",
+		"secret://file" + dir + "/db.toml#password":      "from-toml",
+		"secret://file" + dir + "/db.yaml#password":      "from-yaml",
+		"secret://file" + dir + "/app.env#API_KEY":       "from-env-file",
+		"secret://env/SECRETS_TEST_VAR":                  "from-env",
+		"secret://vault/kv/apps/db#password":             "from-vault",
+		"secret://static/thing":                          "static-thing",
+	} {
+		got, err := r.Resolve(ctx, ref)
+		if err != nil {
+			t.Errorf("%s: %v", ref, err)
+		} else if got != want {
+			t.Errorf("%s is %q, want %q", ref, got, want)
+		}
+	}
+	for _, ref := range []string{
+		"secret://file" + dir + "/missing",
+		"secret://file" + dir + "/db.json#nope",
+		"secret://file" + dir + "/list.json#hosts",
+		"secret://env/SECRETS_TEST_UNSET",
+		"secret://vault/kv/apps/other#password",
+		"secret://vault/kv/apps/db",
+		"secret://nowhere/x",
+	} {
+		if _, err := r.Resolve(ctx, ref); err == nil {
+			t.Errorf("%s should not resolve", ref)
+		}
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	t.Setenv("SECRETS_TEST_VAR", "from-env")
+	r := NewResolver(nil)
+	args := map[string]interface{}{
+		"plain":  "secret-less",
+		"count":  int64(3),
+		"nested": map[string]interface{}{"pw": "secret://env/SECRETS_TEST_VAR"},
+		"list":   []interface{}{"secret://env/SECRETS_TEST_VAR", "x"},
+	}
+	got, err := r.ResolveAll(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved := got.(map[string]interface{})
+	if resolved["nested"].(map[string]interface{})["pw"] != "from-env" || resolved["list"].([]interface{})[0] != "from-env" {
+		t.Errorf("references left in %v", resolved)
+	}
+	if args["nested"].(map[string]interface{})["pw"] != "secret://env/SECRETS_TEST_VAR" {
+		t.Errorf("the args given were changed")
+	}
+	if r.Redact("pw=from-env") != "pw="+Redacted || !r.Contains([]byte("a from-env b")) {
+		t.Errorf("resolved values are not redacted")
+	}
+	r.Add("decrypted", "")
+	if r.Redact("pw=decrypted from-env") != "pw="+Redacted+" "+Redacted || len(r.Values()) != 2 {
+		t.Errorf("added values are not redacted: %v", r.Values())
+	}
+}
+
+func TestRedactingHandler(t *testing.T) {
+	t.Setenv("SECRETS_TEST_VAR", "hunter2")
+	r := NewResolver(nil)
+	if _, err := r.Resolve(context.Background(), "secret://env/SECRETS_TEST_VAR"); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	log := slog.New(NewRedactingHandler(slog.NewTextHandler(&out, nil), r)).With("job", "hunter2-job")
+	log.Info("password is hunter2", "rendered", []byte("pw = hunter2"), slog.Group("g", "pw", "hunter2"))
+	if strings.Contains(out.String(), "hunter2") {
+		t.Errorf("secret logged: %s", out.String())
+	}
+}
@@ -0,0 +1,95 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Vault reads secret://vault/<mount>/<path>#<key> from a KV version 2
+// secrets engine of Vault or OpenBao. The mount is the first element of the
+// path.
+type Vault struct {
+	// Address and Token default to VAULT_ADDR and VAULT_TOKEN, or
+	// BAO_ADDR and BAO_TOKEN
+	Address string
+	Token   string
+	// Namespace defaults to VAULT_NAMESPACE
+	Namespace string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (v *Vault) Lookup(ctx context.Context, ref Ref) (string, error) {
+	if ref.Key == "" {
+		return "", fmt.Errorf("vault secrets need a #key")
+	}
+	mount, p, ok := strings.Cut(ref.Path, "/")
+	if !ok || p == "" {
+		return "", fmt.Errorf("vault secrets look like %svault/<mount>/<path>#<key>", Prefix)
+	}
+	addr := v.Address
+	if addr == "" {
+		addr = firstEnv("VAULT_ADDR", "BAO_ADDR")
+	}
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	token := v.Token
+	if token == "" {
+		token = firstEnv("VAULT_TOKEN", "BAO_TOKEN")
+	}
+	namespace := v.Namespace
+	if namespace == "" {
+		namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	client := v.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+mount+"/data/"+p, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault answered %s for %s/%s", resp.Status, mount, p)
+	}
+	var secret struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("Can't parse vault answer for %s/%s: %v", mount, p, err)
+	}
+	return pick(secret.Data.Data, ref)
+}
@@ -1,16 +1,37 @@
 package submission
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
+// ErrDependencyFailed marks a job that was not run because something it
+// depends on did not succeed.
+var ErrDependencyFailed = errors.New("skipped, a dependency failed")
+
+// outputWaitDelay is how long a script's output is still read after it
+// exited or was killed, before giving up on what it left running.
+const outputWaitDelay = 5 * time.Second
+
 type CmdReturn struct {
 	ProgName string
+	Job      string
+	Stdout   []byte
+	Stderr   []byte
+	Duration time.Duration
+	// ExitCode is -1 when the script never ran or was killed by a signal
+	ExitCode int
+	// Attempts counts how many times the script was run, retries included
+	Attempts int
 	Err      error
 }
 
@@ -18,13 +39,76 @@ func (c CmdReturn) Error() string {
 	return fmt.Sprintf("%s: %v", c.ProgName, c.Err)
 }
 
-// ExecuteFilesAsync runs executable files in nested directories and collects errors
-func ExecuteFilesAsync(compiledDir string) error {
-	errChan := make(chan error, 100)
+func (c CmdReturn) Unwrap() error {
+	return c.Err
+}
 
-	var wg sync.WaitGroup
+// Options tune how scripts are run.
+type Options struct {
+	// Workers caps how many scripts run at once. Zero or less means no cap.
+	Workers int
+	// ScriptTimeout kills a single script that runs longer. Zero means no
+	// limit. The overall limit is taken from the context.
+	ScriptTimeout time.Duration
+	// Output receives the stdout and stderr of every script as it is
+	// written, each line prefixed with the job name. Nil sends each line to
+	// Logger instead, the output is still captured on the CmdReturn.
+	Output io.Writer
+	// Logger receives an event for every script run, retried or skipped.
+	// Nil discards them.
+	Logger *slog.Logger
+	// Retries is how many more times a script that failed in a retryable way
+	// is run, unless Jobs says otherwise for its job.
+	Retries int
+	// RetryBackoff is the first wait before a retry, doubling each time up
+	// to MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// Jobs holds settings for single jobs, keyed by job name.
+	Jobs map[string]JobOptions
+	// Secrets are values replaced with Redacted in streamed and captured
+	// output.
+	Secrets []string
+	// Resources, when set, is called for each job before its scripts run,
+	// to apply the typed resources rendered into its dir. If any of the
+	// results failed the job's scripts are not run.
+	Resources func(ctx context.Context, job string, dir string) []CmdReturn
+	// Failed are jobs already known to have failed, like those that failed
+	// to render, with why. They are not run, and their dependents are
+	// skipped.
+	Failed map[string]error
+}
+
+// JobOptions override Options for one job.
+type JobOptions struct {
+	Retries int
+	// Env is added to the environment of the job's scripts, as KEY=value.
+	Env []string
+}
 
-	err := filepath.Walk(compiledDir, func(path string, info os.FileInfo, err error) error {
+func (o Options) logger() *slog.Logger {
+	if o.Logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return o.Logger
+}
+
+func (o Options) retriesFor(job string) int {
+	if jo, ok := o.Jobs[job]; ok {
+		return jo.Retries
+	}
+	return o.Retries
+}
+
+type script struct {
+	Job  string
+	Path string
+}
+
+// executables lists every executable file below dir.
+func executables(dir string) ([]string, error) {
+	var found []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -32,35 +116,216 @@ func ExecuteFilesAsync(compiledDir string) error {
 			return nil
 		}
 		if info.Mode()&0111 != 0 {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				cmd := exec.Command("./" + filepath.Base(path))
-				cmd.Args[0] = filepath.Base(path)
-				cmd.Dir = filepath.Dir(path)
-				cmd.Env = os.Environ()
-				fmt.Printf("Executing %s: %v\n", path, cmd)
-				err := cmd.Run()
-				errChan <- CmdReturn{ProgName: path, Err: err}
-			}()
+			found = append(found, path)
 		}
 		return nil
 	})
+	return found, err
+}
+
+func runScript(ctx context.Context, s script, opts Options, out *lockedWriter, redact redactor) CmdReturn {
+	if opts.ScriptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.ScriptTimeout)
+		defer cancel()
+	}
+
+	log := opts.logger().With("job", s.Job, "script", s.Path)
+	var stdout, stderr bytes.Buffer
+	outPrefix := newPrefixWriter(out, "["+s.Job+"] ", redact)
+	errPrefix := newPrefixWriter(out, "["+s.Job+"] ", redact)
+	if opts.Output == nil {
+		outPrefix = newPrefixWriter(lineLogger{log.With("stream", "stdout")}, "", redact)
+		errPrefix = newPrefixWriter(lineLogger{log.With("stream", "stderr")}, "", redact)
+	}
+
+	cmd := exec.CommandContext(ctx, "./"+filepath.Base(s.Path))
+	cmd.Args[0] = filepath.Base(s.Path)
+	cmd.Dir = filepath.Dir(s.Path)
+	cmd.Env = append(os.Environ(), opts.Jobs[s.Job].Env...)
+	cmd.Stdout = io.MultiWriter(&stdout, outPrefix)
+	cmd.Stderr = io.MultiWriter(&stderr, errPrefix)
+	killGroup(cmd)
+	cmd.WaitDelay = outputWaitDelay
+	log.Info("Executing script")
+	start := time.Now()
+	err := cmd.Run()
+	if errors.Is(err, exec.ErrWaitDelay) && ctx.Err() == nil {
+		log.Warn("Script left a process holding its output open", "waited", outputWaitDelay)
+		err = nil
+	}
+	duration := time.Since(start)
+	outPrefix.Flush()
+	errPrefix.Flush()
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
 	if err != nil {
-		return err
+		log.Warn("Script failed", "exit_code", exitCode, "duration", duration, "err", err)
+	} else {
+		log.Info("Script finished", "duration", duration)
 	}
+	return CmdReturn{
+		ProgName: s.Path,
+		Job:      s.Job,
+		Stdout:   redact.apply(stdout.Bytes()),
+		Stderr:   redact.apply(stderr.Bytes()),
+		Duration: duration,
+		ExitCode: exitCode,
+		Attempts: 1,
+		Err:      err,
+	}
+}
 
-	go func() {
-		wg.Wait() // Should be a no-op...
-		close(errChan)
-	}()
+// runAll runs the scripts with at most opts.Workers at a time and waits for
+// them all. Scripts not yet started when ctx is done are not started at all.
+func runAll(ctx context.Context, scripts []script, opts Options) []CmdReturn {
+	out := &lockedWriter{w: opts.Output}
+	redact := newRedactor(opts.Secrets)
+	results := make([]CmdReturn, len(scripts))
+	var sem chan struct{}
+	if opts.Workers > 0 {
+		sem = make(chan struct{}, opts.Workers)
+	}
+	var wg sync.WaitGroup
+	for i, s := range scripts {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = CmdReturn{ProgName: s.Path, Job: s.Job, ExitCode: -1, Err: ctx.Err()}
+				continue
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			results[i] = runScript(ctx, s, opts, out, redact)
+		}()
+	}
+	wg.Wait()
+	return results
+}
 
+func joinFailures(results []CmdReturn) error {
 	var finalError error
-	for err := range errChan {
-		if err.(CmdReturn).Err != nil {
-			finalError = errors.Join(finalError, err)
+	for _, res := range results {
+		if res.Err != nil {
+			finalError = errors.Join(finalError, res)
 		}
 	}
-
 	return finalError
 }
+
+// ExecuteGraph runs the scripts of each job found under compiledDir/<job>,
+// one wave of the dependency graph at a time. A job only starts once all of
+// its dependencies ran without error, otherwise it is skipped. Every script
+// run and every skipped job is returned, along with the joined failures.
+func ExecuteGraph(ctx context.Context, compiledDir string, graph Graph, opts Options) ([]CmdReturn, error) {
+	waves, err := graph.Waves()
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make(map[string]bool)
+	var results []CmdReturn
+	for _, wave := range waves {
+		var scripts []script
+		for _, job := range wave {
+			if err, ok := opts.Failed[job]; ok {
+				failed[job] = true
+				results = append(results, CmdReturn{ProgName: job, Job: job, ExitCode: -1, Err: err})
+				continue
+			}
+			if blocked(graph[job], failed) {
+				opts.logger().Warn("Skipping job, a dependency failed", "job", job)
+				failed[job] = true
+				results = append(results, CmdReturn{ProgName: job, Job: job, ExitCode: -1, Err: ErrDependencyFailed})
+				continue
+			}
+			if ctx.Err() != nil {
+				failed[job] = true
+				results = append(results, CmdReturn{ProgName: job, Job: job, ExitCode: -1, Err: ctx.Err()})
+				continue
+			}
+			if opts.Resources != nil {
+				applied := opts.Resources(ctx, job, filepath.Join(compiledDir, job))
+				results = append(results, applied...)
+				if joinFailures(applied) != nil {
+					failed[job] = true
+					continue
+				}
+			}
+			jobPaths, err := executables(filepath.Join(compiledDir, job))
+			if errors.Is(err, os.ErrNotExist) {
+				continue // job rendered nothing, which is not a failure
+			}
+			if err != nil {
+				return results, err
+			}
+			for _, p := range jobPaths {
+				scripts = append(scripts, script{Job: job, Path: p})
+			}
+		}
+		for _, res := range runWithRetries(ctx, scripts, opts) {
+			if res.Err != nil {
+				failed[res.Job] = true
+			}
+			results = append(results, res)
+		}
+	}
+
+	return results, joinFailures(results)
+}
+
+// runWithRetries runs the scripts, then runs again only those that failed
+// in a retryable way and still have retries left, waiting a backoff between
+// rounds. Results keep the order of scripts.
+func runWithRetries(ctx context.Context, scripts []script, opts Options) []CmdReturn {
+	results := make([]CmdReturn, len(scripts))
+	pending := make([]int, len(scripts))
+	for i := range scripts {
+		pending[i] = i
+	}
+	for attempt := 0; len(pending) > 0; attempt++ {
+		batch := make([]script, len(pending))
+		for i, idx := range pending {
+			batch[i] = scripts[idx]
+		}
+		var retry []int
+		for i, res := range runAll(ctx, batch, opts) {
+			idx := pending[i]
+			res.Attempts = attempt + 1
+			results[idx] = res
+			if ctx.Err() == nil && attempt < opts.retriesFor(res.Job) && Retryable(res) {
+				retry = append(retry, idx)
+			}
+		}
+		if len(retry) == 0 {
+			break
+		}
+		wait := Backoff(attempt, opts.RetryBackoff, opts.MaxRetryBackoff)
+		opts.logger().Warn("Retrying failed scripts", "count", len(retry), "wait", wait)
+		if sleep(ctx, wait) != nil {
+			break
+		}
+		pending = retry
+	}
+	return results
+}
+
+func blocked(deps []string, failed map[string]bool) bool {
+	for _, dep := range deps {
+		if failed[dep] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package submission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, dir, job, name, body string) {
+	t.Helper()
+	jobDir := filepath.Join(dir, job)
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(jobDir, name), []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecuteGraph_CapturesAndPrefixesOutput(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "iscsi", "run.sh", "echo plugin up; echo warn >&2")
+	writeScript(t, dir, "app", "run.sh", "printf 'no newline'")
+
+	var out strings.Builder
+	_, err := ExecuteGraph(context.Background(), dir, Graph{"app": {"iscsi"}, "iscsi": nil}, Options{Workers: 1, Output: &out})
+	if err != nil {
+		t.Fatalf("ExecuteGraph() error = %v", err)
+	}
+	for _, want := range []string{"[iscsi] plugin up\n", "[iscsi] warn\n", "[app] no newline\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q is missing %q", out.String(), want)
+		}
+	}
+	if strings.Index(out.String(), "[iscsi]") > strings.Index(out.String(), "[app]") {
+		t.Errorf("app ran before its dependency:\n%s", out.String())
+	}
+}
+
+func TestExecuteGraph_RedactsMultiLineSecrets(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "app", "run.sh", `printf 'key:\n%s\ndone\n' "$KEY"`)
+
+	key := "-----BEGIN KEY-----\nMIIEvQIBADANBgkq\n-----END KEY-----"
+	var out strings.Builder
+	opts := Options{
+		Output:  &out,
+		Jobs:    map[string]JobOptions{"app": {Env: []string{"KEY=" + key}}},
+		Secrets: []string{key},
+	}
+	if _, err := ExecuteGraph(context.Background(), dir, Graph{"app": nil}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "MIIEvQIBADANBgkq") {
+		t.Errorf("a line of a multi-line secret leaked into output:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "[app] key:") || !strings.Contains(out.String(), "[app] done") {
+		t.Errorf("output around the secret was lost:\n%s", out.String())
+	}
+}
+
+func TestExecuteGraph_LogsOutputWithoutWriter(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "app", "run.sh", "echo token=s3cret")
+
+	var buf bytes.Buffer
+	opts := Options{Logger: slog.New(slog.NewJSONHandler(&buf, nil)), Secrets: []string{"s3cret"}}
+	if _, err := ExecuteGraph(context.Background(), dir, Graph{"app": nil}, opts); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, raw := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var event map[string]interface{}
+		if err := json.Unmarshal(raw, &event); err != nil {
+			t.Fatalf("not a JSON event: %s", raw)
+		}
+		if event["job"] != "app" {
+			t.Errorf("event without the job: %s", raw)
+		}
+		if event["msg"] == "Script output" {
+			lines = append(lines, event["line"].(string))
+		}
+	}
+	if len(lines) != 1 || lines[0] != "token="+Redacted {
+		t.Errorf("output events = %q, want one redacted line", lines)
+	}
+}
+
+func TestExecuteGraph_SkipsDependents(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "iscsi", "run.sh", "exit 3")
+	writeScript(t, dir, "app", "run.sh", "touch ran")
+
+	_, err := ExecuteGraph(context.Background(), dir, Graph{"app": {"iscsi"}, "iscsi": nil}, Options{})
+	if !errors.Is(err, ErrDependencyFailed) {
+		t.Errorf("ExecuteGraph() error = %v, want it to include ErrDependencyFailed", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app", "ran")); err == nil {
+		t.Errorf("app ran even though iscsi failed")
+	}
+}
+
+func TestExecuteGraph_KnownFailures(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "broken", "run.sh", "touch ran")
+	writeScript(t, dir, "app", "run.sh", "touch ran")
+	writeScript(t, dir, "other", "run.sh", "touch ran")
+
+	renderErr := errors.New("template failed")
+	results, err := ExecuteGraph(context.Background(), dir, Graph{"app": {"broken"}, "broken": nil, "other": nil}, Options{Failed: map[string]error{"broken": renderErr}})
+	if !errors.Is(err, renderErr) || !errors.Is(err, ErrDependencyFailed) {
+		t.Errorf("ExecuteGraph() error = %v, want the known failure and a skipped dependent", err)
+	}
+	for job, want := range map[string]bool{"broken": false, "app": false, "other": true} {
+		if _, err := os.Stat(filepath.Join(dir, job, "ran")); (err == nil) != want {
+			t.Errorf("%s ran = %v, want %v", job, err == nil, want)
+		}
+	}
+	if len(results) != 3 {
+		t.Errorf("results = %v, want one per job", results)
+	}
+}
+
+func TestRunAll_ScriptTimeout(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "slow", "run.sh", "exec sleep 5")
+
+	start := time.Now()
+	results := runAll(context.Background(), []script{{Job: "slow", Path: filepath.Join(dir, "slow", "run.sh")}}, Options{ScriptTimeout: 100 * time.Millisecond})
+	if !errors.Is(results[0].Err, context.DeadlineExceeded) {
+		t.Errorf("Err = %v, want DeadlineExceeded", results[0].Err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("script was not stopped at its timeout")
+	}
+}
+
+func TestRunAll_ScriptTimeoutKillsChildren(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "slow", "run.sh", "sleep 5\necho done")
+
+	start := time.Now()
+	results := runAll(context.Background(), []script{{Job: "slow", Path: filepath.Join(dir, "slow", "run.sh")}}, Options{ScriptTimeout: 100 * time.Millisecond})
+	if !errors.Is(results[0].Err, context.DeadlineExceeded) {
+		t.Errorf("Err = %v, want DeadlineExceeded", results[0].Err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("script was not stopped at its timeout, its child kept it waiting")
+	}
+}
+
+func TestExecuteGraph_InjectsEnvAndRedacts(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "apps", "run.sh", `echo "ns=$NOMAD_NAMESPACE token=$NOMAD_TOKEN"`)
+	writeScript(t, dir, "other", "run.sh", `echo "ns=$NOMAD_NAMESPACE"`)
+
+	var out strings.Builder
+	opts := Options{
+		Output:  &out,
+		Jobs:    map[string]JobOptions{"apps": {Env: []string{"NOMAD_NAMESPACE=apps", "NOMAD_TOKEN=s3cret"}}},
+		Secrets: []string{"s3cret"},
+	}
+	results, err := ExecuteGraph(context.Background(), dir, Graph{"apps": nil, "other": nil}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "s3cret") {
+		t.Errorf("secret leaked into output:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "[apps] ns=apps token="+Redacted) {
+		t.Errorf("apps did not get its env:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "[other] ns=apps") {
+		t.Errorf("env leaked into another job:\n%s", out.String())
+	}
+	for _, res := range results {
+		if strings.Contains(string(res.Stdout), "s3cret") {
+			t.Errorf("secret leaked into captured output of %s", res.Job)
+		}
+	}
+}
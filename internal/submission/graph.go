@@ -0,0 +1,160 @@
+package submission
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Graph maps a job name to the names of the jobs it depends on.
+type Graph map[string][]string
+
+// CycleError is returned when the dependencies loop back on themselves.
+type CycleError struct {
+	Cycle []string
+}
+
+func (c CycleError) Error() string {
+	return fmt.Sprintf("dependency cycle: %s", strings.Join(c.Cycle, " -> "))
+}
+
+// Validate makes sure every dependency names a known job.
+func (g Graph) Validate() error {
+	for _, name := range g.sortedNames() {
+		for _, dep := range g[name] {
+			if _, ok := g[dep]; !ok {
+				return fmt.Errorf("job %s depends on unknown job %s", name, dep)
+			}
+		}
+	}
+	return nil
+}
+
+// Waves groups the jobs in topological order. Every job in a wave only
+// depends on jobs in earlier waves, so a wave can be submitted all at once.
+// Names inside each wave are sorted to keep runs repeatable.
+func (g Graph) Waves() ([][]string, error) {
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+
+	remaining := make(map[string]int, len(g))
+	dependents := make(map[string][]string)
+	for name, deps := range g {
+		remaining[name] = len(deps)
+		for _, dep := range deps {
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+
+	var waves [][]string
+	var wave []string
+	for name, count := range remaining {
+		if count == 0 {
+			wave = append(wave, name)
+		}
+	}
+	done := 0
+	for len(wave) > 0 {
+		sort.Strings(wave)
+		waves = append(waves, wave)
+		done += len(wave)
+		var next []string
+		for _, name := range wave {
+			for _, dependent := range dependents[name] {
+				remaining[dependent]--
+				if remaining[dependent] == 0 {
+					next = append(next, dependent)
+				}
+			}
+		}
+		wave = next
+	}
+
+	if done != len(g) {
+		return nil, CycleError{Cycle: g.findCycle(remaining)}
+	}
+	return waves, nil
+}
+
+// findCycle walks the jobs that never became ready until it finds one it has
+// already seen. Every such job sits on or behind a cycle.
+func (g Graph) findCycle(remaining map[string]int) []string {
+	var start string
+	for _, name := range g.sortedNames() {
+		if remaining[name] > 0 {
+			start = name
+			break
+		}
+	}
+	seen := make(map[string]int)
+	var path []string
+	for cur := start; ; {
+		if idx, ok := seen[cur]; ok {
+			return append(path[idx:], cur)
+		}
+		seen[cur] = len(path)
+		path = append(path, cur)
+		deps := append([]string(nil), g[cur]...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if remaining[dep] > 0 {
+				cur = dep
+				break
+			}
+		}
+	}
+}
+
+// WriteDOT prints the graph in Graphviz DOT format. Edges point from a
+// dependency to the job that waits on it.
+func (g Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph jobs {\n")
+	names := g.sortedNames()
+	for _, name := range names {
+		fmt.Fprintf(&b, "\t%q;\n", name)
+	}
+	for _, name := range names {
+		deps := append([]string(nil), g[name]...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			fmt.Fprintf(&b, "\t%q -> %q;\n", dep, name)
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Subgraph keeps only the named jobs. Dependencies on jobs left out are
+// dropped, as if those had already been submitted.
+func (g Graph) Subgraph(names []string) Graph {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	out := make(Graph, len(names))
+	for name, deps := range g {
+		if !keep[name] {
+			continue
+		}
+		out[name] = nil
+		for _, dep := range deps {
+			if keep[dep] {
+				out[name] = append(out[name], dep)
+			}
+		}
+	}
+	return out
+}
+
+func (g Graph) sortedNames() []string {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
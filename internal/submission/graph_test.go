@@ -0,0 +1,90 @@
+package submission
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGraph_Waves(t *testing.T) {
+	tests := []struct {
+		name    string
+		graph   Graph
+		want    [][]string
+		wantErr bool
+	}{
+		{
+			name:  "independent jobs share a wave",
+			graph: Graph{"b": nil, "a": nil},
+			want:  [][]string{{"a", "b"}},
+		},
+		{
+			name: "dependencies come first",
+			graph: Graph{
+				"app":   {"iscsi", "vars"},
+				"iscsi": nil,
+				"vars":  nil,
+				"proxy": {"app"},
+			},
+			want: [][]string{{"iscsi", "vars"}, {"app"}, {"proxy"}},
+		},
+		{
+			name:    "unknown dependency",
+			graph:   Graph{"app": {"missing"}},
+			wantErr: true,
+		},
+		{
+			name:    "cycle",
+			graph:   Graph{"a": {"b"}, "b": {"c"}, "c": {"a"}, "d": nil},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.graph.Waves()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Waves() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Waves() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGraph_WavesReportsCycle(t *testing.T) {
+	_, err := Graph{"a": {"b"}, "b": {"a"}, "c": {"a"}}.Waves()
+	var cycle CycleError
+	if !errors.As(err, &cycle) {
+		t.Fatalf("Waves() error = %v, want a CycleError", err)
+	}
+	want := []string{"a", "b", "a"}
+	if !reflect.DeepEqual(cycle.Cycle, want) {
+		t.Errorf("Cycle = %v, want %v", cycle.Cycle, want)
+	}
+}
+
+func TestGraph_WriteDOT(t *testing.T) {
+	var b strings.Builder
+	if err := (Graph{"app": {"iscsi"}, "iscsi": nil}).WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "digraph jobs {\n\t\"app\";\n\t\"iscsi\";\n\t\"iscsi\" -> \"app\";\n}\n"
+	if b.String() != want {
+		t.Errorf("WriteDOT() = %q, want %q", b.String(), want)
+	}
+}
+
+func TestGraph_Subgraph(t *testing.T) {
+	g := Graph{"app": {"iscsi", "vars"}, "iscsi": nil, "vars": nil, "proxy": {"app"}}
+	got := g.Subgraph([]string{"app", "vars"})
+	want := Graph{"app": {"vars"}, "vars": nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Subgraph() = %v, want %v", got, want)
+	}
+	if _, err := got.Waves(); err != nil {
+		t.Errorf("a subgraph should stay valid: %v", err)
+	}
+}
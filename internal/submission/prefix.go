@@ -0,0 +1,79 @@
+package submission
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// lockedWriter lets many scripts share one output without interleaving
+// inside a write. A nil inner writer discards everything.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	if l.w == nil {
+		return len(p), nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// prefixWriter buffers until a full line is seen, then writes it out with
+// the prefix in front and secrets redacted. Whole lines keep parallel output
+// readable.
+type prefixWriter struct {
+	out    io.Writer
+	prefix []byte
+	buf    []byte
+	redact redactor
+}
+
+func newPrefixWriter(out io.Writer, prefix string, redact redactor) *prefixWriter {
+	return &prefixWriter{out: out, prefix: []byte(prefix), redact: redact}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		idx := bytes.IndexByte(p.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:idx+1]); err != nil {
+			return len(b), err
+		}
+		p.buf = p.buf[idx+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes out a trailing line that had no newline.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	line := append(p.buf, '\n')
+	p.buf = nil
+	return p.writeLine(line)
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	_, err := p.out.Write(append(append([]byte{}, p.prefix...), p.redact.apply(line)...))
+	return err
+}
+
+// lineLogger logs every line written to it as a script output event. It
+// takes whole lines, as a prefixWriter writes them.
+type lineLogger struct {
+	log *slog.Logger
+}
+
+func (l lineLogger) Write(line []byte) (int, error) {
+	l.log.Info("Script output", "line", string(bytes.TrimSuffix(line, []byte("\n"))))
+	return len(line), nil
+}
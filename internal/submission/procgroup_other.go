@@ -0,0 +1,9 @@
+//go:build !unix
+
+package submission
+
+import "os/exec"
+
+// killGroup leaves cmd to be killed on its own, as there are no process
+// groups to kill; WaitDelay still stops waiting on its output.
+func killGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package submission
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killGroup runs cmd in a process group of its own, and kills the whole
+// group when its context is done, so the commands a script started don't
+// outlive it holding its output open.
+func killGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
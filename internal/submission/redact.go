@@ -0,0 +1,49 @@
+package submission
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Redacted replaces secret values in script output.
+const Redacted = "[redacted]"
+
+// minSecretLine is how long a line of a multi-line secret must be to be
+// redacted on its own, so lines like `}` are left alone.
+const minSecretLine = 4
+
+// redactor blanks out known secret values.
+type redactor [][]byte
+
+func newRedactor(secrets []string) redactor {
+	var r redactor
+	for _, s := range secrets {
+		if s == "" {
+			continue
+		}
+		r = append(r, []byte(s))
+		if !strings.Contains(s, "\n") {
+			continue
+		}
+		// Output is redacted a line at a time, so each line of a multi-line
+		// secret, like a PEM key, is a secret too
+		for _, line := range strings.Split(s, "\n") {
+			if line = strings.TrimSpace(line); len(line) >= minSecretLine {
+				r = append(r, []byte(line))
+			}
+		}
+	}
+	// Longest first, so a secret containing another is hidden whole
+	sort.Slice(r, func(i, j int) bool { return len(r[i]) > len(r[j]) })
+	return r
+}
+
+func (r redactor) apply(b []byte) []byte {
+	for _, secret := range r {
+		if bytes.Contains(b, secret) {
+			b = bytes.ReplaceAll(b, secret, []byte(Redacted))
+		}
+	}
+	return b
+}
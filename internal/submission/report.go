@@ -0,0 +1,183 @@
+package submission
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	StatusPassed  = "passed"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// Report is the outcome of a submission run, one entry per script that ran
+// and per job that was skipped.
+type Report struct {
+	Started  time.Time     `json:"started"`
+	Duration float64       `json:"duration_seconds"`
+	Entries  []ReportEntry `json:"entries"`
+}
+
+type ReportEntry struct {
+	Job      string  `json:"job"`
+	Script   string  `json:"script,omitempty"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration_seconds"`
+	ExitCode int     `json:"exit_code"`
+	Attempts int     `json:"attempts"`
+	Stdout   string  `json:"stdout,omitempty"`
+	Stderr   string  `json:"stderr,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// NewReport turns the results of ExecuteGraph into a report, sorted by job
+// and then script so the same run always reads the same.
+func NewReport(started time.Time, results []CmdReturn) Report {
+	report := Report{
+		Started:  started,
+		Duration: time.Since(started).Seconds(),
+		Entries:  make([]ReportEntry, 0, len(results)),
+	}
+	for _, res := range results {
+		entry := ReportEntry{
+			Job:      res.Job,
+			Status:   StatusPassed,
+			Duration: res.Duration.Seconds(),
+			ExitCode: res.ExitCode,
+			Attempts: res.Attempts,
+			Stdout:   string(res.Stdout),
+			Stderr:   string(res.Stderr),
+		}
+		if res.ProgName != res.Job {
+			entry.Script = res.ProgName
+		}
+		if res.Err != nil {
+			entry.Error = res.Err.Error()
+			entry.Status = StatusFailed
+			if errors.Is(res.Err, ErrDependencyFailed) {
+				entry.Status = StatusSkipped
+			}
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+	sort.SliceStable(report.Entries, func(i, j int) bool {
+		a, b := report.Entries[i], report.Entries[j]
+		if a.Job != b.Job {
+			return a.Job < b.Job
+		}
+		return a.Script < b.Script
+	})
+	return report
+}
+
+// Count returns how many entries have the given status.
+func (r Report) Count(status string) int {
+	n := 0
+	for _, e := range r.Entries {
+		if e.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+func (r Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     float64      `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      float64     `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the report as JUnit XML, with a test suite per job and
+// a test case per script.
+func (r Report) WriteJUnit(w io.Writer) error {
+	suites := junitSuites{Time: r.Duration}
+	index := make(map[string]int)
+	for _, e := range r.Entries {
+		i, ok := index[e.Job]
+		if !ok {
+			i = len(suites.Suites)
+			index[e.Job] = i
+			suites.Suites = append(suites.Suites, junitSuite{
+				Name:      e.Job,
+				Timestamp: r.Started.Format(time.RFC3339),
+			})
+		}
+		suite := &suites.Suites[i]
+
+		name := e.Script
+		if name == "" {
+			name = e.Job
+		}
+		tc := junitCase{
+			Name:      name,
+			Classname: e.Job,
+			Time:      e.Duration,
+			SystemOut: e.Stdout,
+			SystemErr: e.Stderr,
+		}
+		switch e.Status {
+		case StatusFailed:
+			tc.Failure = &junitMessage{Message: e.Error, Body: e.Stderr}
+			suite.Failures++
+			suites.Failures++
+		case StatusSkipped:
+			tc.Skipped = &junitMessage{Message: e.Error}
+			suite.Skipped++
+			suites.Skipped++
+		}
+		suite.Tests++
+		suite.Time += e.Duration
+		suites.Tests++
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
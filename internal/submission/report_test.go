@@ -0,0 +1,63 @@
+package submission
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sampleResults() []CmdReturn {
+	return []CmdReturn{
+		{ProgName: "out/web/run.sh", Job: "web", ExitCode: -1, Err: ErrDependencyFailed},
+		{ProgName: "out/iscsi/run.sh", Job: "iscsi", Stderr: []byte("boom\n"), ExitCode: 2, Duration: time.Second, Err: errors.New("exit status 2")},
+		{ProgName: "out/iscsi/vars.sh", Job: "iscsi", Stdout: []byte("ok\n"), ExitCode: 0},
+	}
+}
+
+func TestNewReport(t *testing.T) {
+	report := NewReport(time.Now(), sampleResults())
+
+	var got []string
+	for _, e := range report.Entries {
+		got = append(got, e.Job+" "+e.Status)
+	}
+	want := "iscsi failed,iscsi passed,web skipped"
+	if strings.Join(got, ",") != want {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+	if report.Entries[0].ExitCode != 2 || report.Entries[0].Stderr != "boom\n" {
+		t.Errorf("failed entry lost its details: %+v", report.Entries[0])
+	}
+
+	var b strings.Builder
+	if err := report.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal([]byte(b.String()), &decoded); err != nil {
+		t.Fatalf("report is not valid JSON: %v", err)
+	}
+	if len(decoded.Entries) != 3 {
+		t.Errorf("decoded %d entries, want 3", len(decoded.Entries))
+	}
+}
+
+func TestReport_WriteJUnit(t *testing.T) {
+	var b strings.Builder
+	if err := NewReport(time.Now(), sampleResults()).WriteJUnit(&b); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitSuites
+	if err := xml.Unmarshal([]byte(b.String()), &suites); err != nil {
+		t.Fatalf("report is not valid XML: %v\n%s", err, b.String())
+	}
+	if suites.Tests != 3 || suites.Failures != 1 || suites.Skipped != 1 {
+		t.Errorf("totals = %d tests, %d failures, %d skipped", suites.Tests, suites.Failures, suites.Skipped)
+	}
+	if len(suites.Suites) != 2 || suites.Suites[0].Name != "iscsi" {
+		t.Errorf("suites = %+v, want one per job", suites.Suites)
+	}
+}
@@ -0,0 +1,77 @@
+package submission
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"regexp"
+	"time"
+)
+
+// ExitTempFail is the exit code (EX_TEMPFAIL from sysexits.h) a script can
+// use to say its failure is worth retrying no matter what it printed.
+const ExitTempFail = 75
+
+var (
+	// permanentFailure matches output from Nomad that retrying won't fix,
+	// like a jobspec that doesn't parse or a request the API rejected.
+	permanentFailure = regexp.MustCompile(`(?i)error parsing|error getting job struct|failed to parse|invalid|unexpected response code: 4\d\d|permission denied|acl token not found`)
+	// transientFailure matches connection trouble and server side errors on
+	// the `Error ...:` lines Nomad prints, so a script's own output talking of
+	// timeouts doesn't count.
+	transientFailure = regexp.MustCompile(`(?im)^\s*error\b.*(connection refused|connection reset|i/o timeout|no such host|tls handshake timeout|unexpected eof|eof\b|unexpected response code: 5\d\d|\b50[234]\b|no cluster leader|rpc error|timeout)`)
+)
+
+// Retryable decides if a failed script is worth running again. Only failures
+// that look transient are: Nomad reporting connection errors or 5xx
+// responses from the API, a script killed by its own timeout, or a script
+// exiting with ExitTempFail. Anything that looks like a bad jobspec or a
+// rejected request is permanent, and so is anything unrecognised.
+func Retryable(res CmdReturn) bool {
+	if res.Err == nil || errors.Is(res.Err, ErrDependencyFailed) {
+		return false
+	}
+	if errors.Is(res.Err, context.DeadlineExceeded) {
+		return true
+	}
+	if res.ExitCode == ExitTempFail {
+		return true
+	}
+	output := append(append([]byte{}, res.Stderr...), res.Stdout...)
+	if permanentFailure.Match(output) {
+		return false
+	}
+	return transientFailure.Match(output)
+}
+
+// Backoff returns how long to wait before retry number attempt (counting
+// from zero). The delay doubles each time up to max, and a random jitter
+// takes up to half of it off so retries from many jobs don't line up.
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	delay := base
+	// Doubling stops short of overflowing when there is no max to stop it
+	for i := 0; i < attempt && (max <= 0 || delay < max) && delay <= math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+// sleep waits for d or until ctx is done, whichever is first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,95 @@
+package submission
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	failed := errors.New("exit status 1")
+	tests := []struct {
+		name string
+		res  CmdReturn
+		want bool
+	}{
+		{"success", CmdReturn{}, false},
+		{"connection refused", CmdReturn{Err: failed, Stderr: []byte(`Error submitting job: Put "http://127.0.0.1:4646/v1/jobs": dial tcp 127.0.0.1:4646: connect: connection refused`)}, true},
+		{"script output", CmdReturn{Err: failed, Stdout: []byte("waiting for db, timeout=30s\nstatus 502 from upstream")}, false},
+		{"server error", CmdReturn{Err: failed, Stderr: []byte("Error submitting job: Unexpected response code: 503 (no leader)")}, true},
+		{"bad jobspec", CmdReturn{Err: failed, Stderr: []byte("Error getting job struct: Error parsing job file")}, false},
+		{"client error", CmdReturn{Err: failed, Stderr: []byte("Unexpected response code: 400 (job validation failed)")}, false},
+		{"temp fail exit", CmdReturn{Err: failed, ExitCode: ExitTempFail}, true},
+		{"script timeout", CmdReturn{Err: context.DeadlineExceeded}, true},
+		{"dependency", CmdReturn{Err: ErrDependencyFailed}, false},
+		{"unknown", CmdReturn{Err: failed, Stderr: []byte("something odd")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Retryable(tt.res); got != tt.want {
+				t.Errorf("Retryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		got := Backoff(attempt, 100*time.Millisecond, time.Second)
+		want := 100 * time.Millisecond << attempt
+		if want > time.Second {
+			want = time.Second
+		}
+		if got < want/2 || got > want {
+			t.Errorf("Backoff(%d) = %v, want between %v and %v", attempt, got, want/2, want)
+		}
+	}
+}
+
+func TestBackoff_NoMax(t *testing.T) {
+	for _, attempt := range []int{62, 63, 100} {
+		if got := Backoff(attempt, time.Second, 0); got <= 0 {
+			t.Errorf("Backoff(%d) with no max = %v, it overflowed", attempt, got)
+		}
+	}
+}
+
+func TestExecuteGraph_RetriesOnlyFailedScripts(t *testing.T) {
+	dir := t.TempDir()
+	writeScript(t, dir, "flaky", "run.sh", `echo x >> count; [ "$(wc -l < count)" -ge 2 ] || { echo "Error submitting job: dial tcp: connection refused" >&2; exit 1; }`)
+	writeScript(t, dir, "steady", "run.sh", "echo x >> count")
+	writeScript(t, dir, "broken", "run.sh", `echo x >> count; echo "Error parsing job file" >&2; exit 1`)
+
+	opts := Options{
+		Retries:      3,
+		RetryBackoff: time.Millisecond,
+		Jobs:         map[string]JobOptions{"steady": {Retries: 0}},
+	}
+	results, _ := ExecuteGraph(context.Background(), dir, Graph{"flaky": nil, "steady": nil, "broken": nil}, opts)
+
+	runs := func(job string) int {
+		data, err := os.ReadFile(filepath.Join(dir, job, "count"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "x")
+	}
+	if got := runs("flaky"); got != 2 {
+		t.Errorf("flaky ran %d times, want 2", got)
+	}
+	if got := runs("steady"); got != 1 {
+		t.Errorf("steady ran %d times, want 1", got)
+	}
+	if got := runs("broken"); got != 1 {
+		t.Errorf("broken ran %d times, want 1 since its failure is permanent", got)
+	}
+	for _, res := range results {
+		if res.Job == "flaky" && (res.Err != nil || res.Attempts != 2) {
+			t.Errorf("flaky result = %+v, want success on attempt 2", res)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package templating
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Delims are the action delimiters of a pack's templates.
+type Delims struct {
+	Left, Right string
+}
+
+// DefaultDelims leave `{{ }}` to the config and to Nomad's own templates.
+var DefaultDelims = Delims{Left: "[[", Right: "]]"}
+
+func (d Delims) orDefault() Delims {
+	if d == (Delims{}) {
+		return DefaultDelims
+	}
+	return d
+}
+
+func (d Delims) String() string {
+	d = d.orDefault()
+	return d.Left + " " + d.Right
+}
+
+// ParseDelims reads a pair of delimiters as pack.toml gives them.
+func ParseDelims(pair []string) (Delims, error) {
+	if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+		return Delims{}, fmt.Errorf("delims should be a pair like [\"<<\", \">>\"], got %q", pair)
+	}
+	return Delims{Left: pair[0], Right: pair[1]}, nil
+}
+
+// raw gives its argument back as is, so a backquoted string of text that
+// looks like actions is output without being run:
+//
+//	[[ raw `{{ key "service/db/url" }}` ]]
+func raw(s string) string {
+	return s
+}
+
+// Passthrough keeps the text raw and verbatim output as is, so Unrendered
+// does not take it for actions left unrendered. The zero value is ready.
+type Passthrough struct {
+	texts []string
+}
+
+func (p *Passthrough) keep(s string) string {
+	if p != nil {
+		p.texts = append(p.texts, s)
+	}
+	return s
+}
+
+// holds reports if s is within text kept.
+func (p *Passthrough) holds(s string) bool {
+	if p == nil {
+		return false
+	}
+	for _, text := range p.texts {
+		if strings.Contains(text, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerbatimFuncs give templates `verbatim`, which is a file of fsys as is,
+// never executed. Files starting with an underscore are not output on their
+// own, so they can hold consul-template content to embed:
+//
+//	data = <<EOT
+//	[[ verbatim "_consul/app.ctmpl" ]]
+//	EOT
+//
+// What `verbatim` and `raw` output is kept in kept, which may be nil.
+func VerbatimFuncs(fsys fs.FS, kept *Passthrough) template.FuncMap {
+	return template.FuncMap{
+		"verbatim": func(name string) (string, error) {
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return "", fmt.Errorf("Can't read verbatim file %s: %v", name, err)
+			}
+			return kept.keep(string(data)), nil
+		},
+		"raw": kept.keep,
+	}
+}
+
+// unrendered are the patterns Unrendered looks for, compiled once per pair
+// of delimiters.
+type unrendered struct {
+	action *regexp.Regexp
+	header *regexp.Regexp
+}
+
+var unrenderedCache sync.Map // Delims to *unrendered
+
+func unrenderedFor(d Delims) *unrendered {
+	if u, ok := unrenderedCache.Load(d); ok {
+		return u.(*unrendered)
+	}
+	left, right := regexp.QuoteMeta(d.Left), regexp.QuoteMeta(d.Right)
+	// A name must be followed by what comes after a function or keyword, so
+	// TOML's [[inputs.cpu]] is left alone
+	u := &unrendered{
+		action: regexp.MustCompile(left + `-?\s*((\.|\$|/\*|[A-Za-z_][A-Za-z0-9_]*[\s|)]).*?|[A-Za-z_][A-Za-z0-9_]*-?)` + right),
+		header: regexp.MustCompile(`^\s*` + left + `\s*([A-Za-z0-9_-]+)\s*` + right + `\s*(#.*)?$`),
+	}
+	actual, _ := unrenderedCache.LoadOrStore(d, u)
+	return actual.(*unrendered)
+}
+
+// keywords stand alone in an action, so a line of just one of them between
+// the delimiters is not taken for a TOML table header.
+var keywords = map[string]bool{"end": true, "else": true, "break": true, "continue": true}
+
+// Unrendered lists the lines of output, from 1, holding what looks like an
+// action left unrendered: the delimiters around a pipeline, a variable, a
+// comment or a function call. Text kept by raw or verbatim, and lines that
+// are a TOML array of tables header, are not.
+func Unrendered(output []byte, d Delims, kept *Passthrough) []int {
+	u := unrenderedFor(d.orDefault())
+	var lines []int
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, len(output)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if m := u.header.FindSubmatch(line); m != nil && !keywords[string(m[1])] {
+			continue
+		}
+		for _, match := range u.action.FindAll(line, -1) {
+			if !kept.holds(string(match)) {
+				lines = append(lines, n)
+				break
+			}
+		}
+	}
+	return lines
+}
@@ -0,0 +1,63 @@
+package templating
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseDelims(t *testing.T) {
+	d, err := ParseDelims([]string{"<<", ">>"})
+	if err != nil || d != (Delims{Left: "<<", Right: ">>"}) {
+		t.Errorf("ParseDelims() = %v, %v", d, err)
+	}
+	for _, bad := range [][]string{nil, {"<<"}, {"", ">>"}, {"<", ">", "!"}} {
+		if _, err := ParseDelims(bad); err == nil {
+			t.Errorf("%q should not parse", bad)
+		}
+	}
+}
+
+func TestTemplateDelims(t *testing.T) {
+	fsys := fstest.MapFS{
+		"job.nomad.tpl":     {Data: []byte("name = \"<< .name >>\"\ntpl = \"{{ key \\\"db\\\" }}\"\nraw = \"<< raw `<< not run >>` >>\"\n<< verbatim \"_consul/app.ctmpl\" >>")},
+		"_consul/app.ctmpl": {Data: []byte("{{ with secret \"db\" }}<< .Data >>{{ end }}\n")},
+	}
+	tpl, err := Template(fsys, nil, Delims{Left: "<<", Right: ">>"}, VerbatimFuncs(fsys, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := tpl.ExecuteTemplate(&out, "job.nomad.tpl", map[string]interface{}{"name": "web"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "name = \"web\"\ntpl = \"{{ key \\\"db\\\" }}\"\nraw = \"<< not run >>\"\n{{ with secret \"db\" }}<< .Data >>{{ end }}\n"
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestUnrendered(t *testing.T) {
+	output := []byte(`ok = [[1, 2], [3]]
+left = "[[ .Args.name ]]"
+tpl = "{{ key "db" }}"
+comment = [[/* gone */]]
+call = "[[- include "x" ]]"
+[[inputs.cpu]]
+[[ outputs ]]
+[[end]]
+kept = "[[ .Kept ]]"
+`)
+	var kept Passthrough
+	kept.keep(`"[[ .Kept ]]"`)
+	if got, want := Unrendered(output, Delims{}, &kept), []int{2, 4, 5, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unrendered() = %v, want %v", got, want)
+	}
+	if got, want := Unrendered(output, Delims{}, nil), []int{2, 4, 5, 8, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unrendered() with nothing kept = %v, want %v", got, want)
+	}
+	if got, want := Unrendered(output, Delims{Left: "{{", Right: "}}"}, nil), []int{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unrendered() with {{ }} = %v, want %v", got, want)
+	}
+}
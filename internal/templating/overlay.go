@@ -0,0 +1,82 @@
+package templating
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"text/template"
+)
+
+// overlay is a filesystem where the files of top hide those of the same
+// name in bottom, and directories list the entries of both.
+type overlay struct {
+	top, bottom fs.FS
+}
+
+// Overlay layers top over bottom: a file in top replaces the one at the
+// same path in bottom, and files only in top are added.
+func Overlay(top, bottom fs.FS) fs.FS {
+	return overlay{top: top, bottom: bottom}
+}
+
+func (o overlay) Open(name string) (fs.File, error) {
+	if info, err := fs.Stat(o.top, name); err == nil && !info.IsDir() {
+		return o.top.Open(name)
+	}
+	f, err := o.bottom.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.top.Open(name)
+	}
+	return f, err
+}
+
+func (o overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	top, topErr := fs.ReadDir(o.top, name)
+	bottom, bottomErr := fs.ReadDir(o.bottom, name)
+	if topErr != nil && bottomErr != nil {
+		return nil, bottomErr
+	}
+	entries := make(map[string]fs.DirEntry, len(top)+len(bottom))
+	for _, e := range bottom {
+		entries[e.Name()] = e
+	}
+	for _, e := range top {
+		entries[e.Name()] = e
+	}
+	out := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+// ParseOverrides parses the templates of overrides again over tpl, so a
+// `define` in them replaces the one of the same name parsed before.
+func ParseOverrides(tpl *template.Template, overrides fs.FS) (*template.Template, error) {
+	files := internalTemplates(overrides)
+	if len(files) == 0 {
+		return tpl, nil
+	}
+	tpl, err := tpl.ParseFS(overrides, files...)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse override templates: %v", err)
+	}
+	return tpl, nil
+}
+
+// Files lists every file below the root of fsys, sorted.
+func Files(fsys fs.FS) ([]string, error) {
+	var files []string
+	err := fs.WalkDir(fsys, ".", func(entry string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, entry)
+		}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,53 @@
+package templating
+
+import (
+	"bytes"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOverlay(t *testing.T) {
+	pack := fstest.MapFS{
+		"web.nomad.tpl":      {Data: []byte(`job [[ template "name" ]]`)},
+		"zz/_helpers.tpl":    {Data: []byte(`[[ define "name" ]]pack[[ end ]]`)},
+		"scripts/run.sh.tpl": {Data: []byte("pack")},
+	}
+	overrides := fstest.MapFS{
+		"_names.tpl":         {Data: []byte(`[[ define "name" ]]local[[ end ]]`)},
+		"scripts/run.sh.tpl": {Data: []byte("local")},
+		"scripts/new.sh":     {Data: []byte("new")},
+	}
+	fsys := Overlay(overrides, pack)
+
+	files, err := Files(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"_names.tpl", "scripts/new.sh", "scripts/run.sh.tpl", "web.nomad.tpl", "zz/_helpers.tpl"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Files() = %v, want %v", files, want)
+	}
+	if data, _ := fs.ReadFile(fsys, "scripts/run.sh.tpl"); string(data) != "local" {
+		t.Errorf("run.sh.tpl = %q, the override should win", data)
+	}
+	if data, _ := fs.ReadFile(fsys, "zz/_helpers.tpl"); string(data) != `[[ define "name" ]]pack[[ end ]]` {
+		t.Errorf("zz/_helpers.tpl = %q, files not overridden should stay", data)
+	}
+
+	tpl, err := Template(fsys, nil, Delims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tpl, err = ParseOverrides(tpl, overrides); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := tpl.ExecuteTemplate(&out, "web.nomad.tpl", nil); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "job local" {
+		t.Errorf("rendered %q, the override's define should win", out.String())
+	}
+}
@@ -36,6 +36,7 @@ func helperFuncs() template.FuncMap {
 		"getarg":  getArg,
 		"unquote": unquote,
 		"tohcl":   convertToHCL,
+		"raw":     raw,
 	}
 }
 
@@ -55,16 +56,23 @@ func internalTemplates(source fs.FS) []string {
 	return finalTpls
 }
 
-func Template(source fs.FS, shared fs.FS) (*template.Template, error) {
+// Template parses the helper templates of a pack, and of the shared
+// _common dir, with delims, the zero value being DefaultDelims. Any extra
+// funcs are added last, winning over the built in ones.
+func Template(source fs.FS, shared fs.FS, delims Delims, extra ...template.FuncMap) (*template.Template, error) {
 	if source == nil {
 		return nil, fmt.Errorf("Source template fs.FS is nil")
 	}
 
+	delims = delims.orDefault()
 	baseTemplate := template.New("base").
-		Delims("[[", "]]").
+		Delims(delims.Left, delims.Right).
 		Option("missingkey=default").
 		Funcs(sprig.FuncMap()).
 		Funcs(helperFuncs())
+	for _, funcs := range extra {
+		baseTemplate = baseTemplate.Funcs(funcs)
+	}
 
 	var err error // avoid shadowing baseTemplate
 	if shared != nil {
@@ -0,0 +1,285 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ModePlan  = "plan"
+	ModeApply = "apply"
+
+	RunQueued    = "queued"
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// keepRuns is how many finished runs can still be queried.
+const keepRuns = 100
+
+// maxBody caps the size of a webhook payload.
+const maxBody = 5 << 20
+
+// keepDeliveries is how many delivery IDs are remembered to reject replays.
+const keepDeliveries = 1000
+
+// Run is one push being handled.
+type Run struct {
+	ID       string    `json:"id"`
+	Mode     string    `json:"mode"`
+	Source   string    `json:"source"`
+	Repo     string    `json:"repo"`
+	Ref      string    `json:"ref"`
+	Commit   string    `json:"commit,omitempty"`
+	Status   string    `json:"status"`
+	Jobs     []string  `json:"jobs"`
+	Output   string    `json:"output,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Queued   time.Time `json:"queued"`
+	Started  time.Time `json:"started,omitzero"`
+	Finished time.Time `json:"finished,omitzero"`
+}
+
+// Handler takes push webhooks on ServeHTTP and lets runs be queried on
+// Runs. Runs happen one at a time, in the order pushes came in.
+//
+// The signature only covers the body, so nothing outside it may ask for
+// more than DefaultMode: `?mode=plan` can turn an apply into a plan, never
+// the other way. A delivery seen before is rejected as a replay.
+type Handler struct {
+	Secret []byte
+	// DefaultMode is used when the request has no `?mode=plan`
+	DefaultMode string
+	// Do handles a push, writing what it did to out. It returns the jobs
+	// the push concerned.
+	Do func(ctx context.Context, push Push, mode string, out io.Writer) ([]string, error)
+
+	mu    sync.Mutex
+	runs  map[string]*Run
+	order []string
+	queue chan queued
+	// deliveries are the recent delivery IDs, in the order seen
+	deliveries    map[string]bool
+	deliveryOrder []string
+}
+
+type queued struct {
+	run  *Run
+	push Push
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (h *Handler) init() {
+	if h.runs == nil {
+		h.runs = make(map[string]*Run)
+		h.queue = make(chan queued, keepRuns)
+		h.deliveries = make(map[string]bool)
+	}
+}
+
+// seen remembers a delivery, reporting if it was already.
+func (h *Handler) seen(delivery string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.init()
+	if h.deliveries[delivery] {
+		return true
+	}
+	h.deliveries[delivery] = true
+	h.deliveryOrder = append(h.deliveryOrder, delivery)
+	if len(h.deliveryOrder) > keepDeliveries {
+		delete(h.deliveries, h.deliveryOrder[0])
+		h.deliveryOrder = h.deliveryOrder[1:]
+	}
+	return false
+}
+
+// forget lets a delivery be taken again, as when it could not be queued.
+func (h *Handler) forget(delivery string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.deliveries, delivery)
+	h.deliveryOrder = slices.DeleteFunc(h.deliveryOrder, func(d string) bool { return d == delivery })
+}
+
+// lowerMode is the mode asked for, which may only be lower than def.
+func lowerMode(asked, def string) (string, error) {
+	switch asked {
+	case "", def:
+		return def, nil
+	case ModePlan:
+		return ModePlan, nil
+	case ModeApply:
+		return "", errors.New("the webhook only plans, ?mode=apply can't change that")
+	default:
+		return "", errors.New("mode must be plan or apply")
+	}
+}
+
+// Start runs queued pushes until ctx is done.
+func (h *Handler) Start(ctx context.Context) {
+	h.mu.Lock()
+	h.init()
+	h.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case q := <-h.queue:
+			h.run(ctx, q)
+		}
+	}
+}
+
+func (h *Handler) run(ctx context.Context, q queued) {
+	h.update(q.run, func(r *Run) {
+		r.Status = RunRunning
+		r.Started = time.Now()
+	})
+	var out bytes.Buffer
+	jobs, err := h.Do(ctx, q.push, q.run.Mode, &out)
+	h.update(q.run, func(r *Run) {
+		r.Finished = time.Now()
+		r.Jobs = jobs
+		r.Output = out.String()
+		r.Status = RunSucceeded
+		if err != nil {
+			r.Status = RunFailed
+			r.Error = err.Error()
+		}
+	})
+}
+
+func (h *Handler) update(run *Run, change func(*Run)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	change(run)
+}
+
+func (h *Handler) get(id string) (Run, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	run, ok := h.runs[id]
+	if !ok {
+		return Run{}, false
+	}
+	return *run, true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// ServeHTTP takes a push webhook, queues a run for it and answers with the
+// run's ID and where to query it.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST", http.StatusMethodNotAllowed)
+		return
+	}
+	asked := r.URL.Query().Get("mode")
+	mode, err := lowerMode(asked, h.DefaultMode)
+	if err != nil {
+		code := http.StatusBadRequest
+		if asked == ModeApply {
+			code = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	push, err := ParsePush(r.Header, body, h.Secret)
+	switch {
+	case errors.Is(err, ErrBadSignature):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, ErrNotPush):
+		writeJSON(w, http.StatusOK, map[string]string{"ignored": err.Error()})
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.seen(push.Delivery) {
+		http.Error(w, "delivery "+push.Delivery+" was already taken", http.StatusConflict)
+		return
+	}
+
+	run := &Run{
+		ID:     newID(),
+		Mode:   mode,
+		Source: push.Source,
+		Repo:   push.Repo(),
+		Ref:    push.Ref,
+		Commit: push.Commit,
+		Status: RunQueued,
+		Queued: time.Now(),
+	}
+	h.mu.Lock()
+	h.init()
+	h.runs[run.ID] = run
+	h.order = append(h.order, run.ID)
+	if len(h.order) > keepRuns {
+		delete(h.runs, h.order[0])
+		h.order = h.order[1:]
+	}
+	h.mu.Unlock()
+
+	select {
+	case h.queue <- queued{run: run, push: push}:
+	default:
+		const full = "too many runs queued"
+		h.update(run, func(r *Run) {
+			r.Status = RunFailed
+			r.Error = full
+		})
+		// so that the host redelivering it is not taken as a replay
+		h.forget(push.Delivery)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"run_id": run.ID, "error": full})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"run_id": run.ID, "status_url": "/runs/" + run.ID})
+}
+
+// Runs answers `GET /runs/<id>` with the run, to those giving the secret
+// as `Authorization: Bearer <secret>`, as runs hold script output.
+func (h *Handler) Runs(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), h.Secret) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	run, ok := h.get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
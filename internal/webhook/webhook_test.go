@@ -0,0 +1,215 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var secret = []byte("s3cret")
+
+const payload = `{
+  "ref": "refs/heads/main",
+  "after": "abc123",
+  "repository": {
+    "clone_url": "https://git.example/org/packs.git",
+    "ssh_url": "git@git.example:org/packs.git",
+    "default_branch": "main"
+  }
+}`
+
+func sign(body string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestParsePush(t *testing.T) {
+	github := http.Header{}
+	github.Set("X-GitHub-Event", "push")
+	github.Set("X-Hub-Signature-256", "sha256="+sign(payload))
+	github.Set("X-GitHub-Delivery", "d1")
+	push, err := ParsePush(github, []byte(payload), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if push.Source != "github" || push.Delivery != "d1" || push.Ref != "refs/heads/main" || push.Commit != "abc123" || push.URLs[1] != "git@git.example:org/packs.git" {
+		t.Errorf("ParsePush() = %+v", push)
+	}
+
+	gitea := http.Header{}
+	gitea.Set("X-Gitea-Event", "push")
+	gitea.Set("X-Gitea-Signature", sign(payload))
+	if _, err := ParsePush(gitea, []byte(payload), secret); err == nil {
+		t.Errorf("a push without a delivery ID was taken")
+	}
+	gitea.Set("X-Gitea-Delivery", "d2")
+	if push, err := ParsePush(gitea, []byte(payload), secret); err != nil || push.Source != "gitea" {
+		t.Errorf("ParsePush() from gitea = %+v, %v", push, err)
+	}
+
+	gitea.Set("X-Gitea-Signature", sign(payload+" "))
+	if _, err := ParsePush(gitea, []byte(payload), secret); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("a bad signature = %v, want ErrBadSignature", err)
+	}
+
+	ping := http.Header{}
+	ping.Set("X-GitHub-Event", "ping")
+	ping.Set("X-Hub-Signature-256", "sha256="+sign("{}"))
+	ping.Set("X-GitHub-Delivery", "d3")
+	if _, err := ParsePush(ping, []byte("{}"), secret); !errors.Is(err, ErrNotPush) {
+		t.Errorf("a ping = %v, want ErrNotPush", err)
+	}
+
+	sshOnly := `{"ref": "refs/heads/main", "repository": {"ssh_url": "git@git.example:org/packs.git"}}`
+	github.Set("X-Hub-Signature-256", "sha256="+sign(sshOnly))
+	if push, err := ParsePush(github, []byte(sshOnly), secret); err != nil || push.Repo() != "git@git.example:org/packs.git" {
+		t.Errorf("Repo() without a clone URL = %q, %v", push.Repo(), err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newHandler := func(mode string) *httptest.Server {
+		h := &Handler{
+			Secret:      secret,
+			DefaultMode: mode,
+			Do: func(ctx context.Context, push Push, mode string, out io.Writer) ([]string, error) {
+				fmt.Fprintf(out, "%s of %s", mode, push.Commit)
+				if mode == ModeApply {
+					return []string{"web"}, errors.New("web: exit status 1")
+				}
+				return []string{"web"}, nil
+			},
+		}
+		go h.Start(ctx)
+		mux := http.NewServeMux()
+		mux.Handle("/webhook", h)
+		mux.HandleFunc("/runs/", h.Runs)
+		return httptest.NewServer(mux)
+	}
+	planning, applying := newHandler(ModePlan), newHandler(ModeApply)
+	defer planning.Close()
+	defer applying.Close()
+
+	deliveries := 0
+	post := func(srv *httptest.Server, query, sig, delivery string) (*http.Response, map[string]string) {
+		if delivery == "" {
+			deliveries++
+			delivery = fmt.Sprintf("delivery-%d", deliveries)
+		}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/webhook"+query, strings.NewReader(payload))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-GitHub-Delivery", delivery)
+		req.Header.Set("X-Hub-Signature-256", "sha256="+sig)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out map[string]string
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp, out
+	}
+	get := func(srv *httptest.Server, id, token string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/runs/"+id, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	wait := func(srv *httptest.Server, id string) Run {
+		for i := 0; i < 500; i++ {
+			resp := get(srv, id, string(secret))
+			var run Run
+			json.NewDecoder(resp.Body).Decode(&run)
+			resp.Body.Close()
+			if run.Status == RunSucceeded || run.Status == RunFailed {
+				return run
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("run %s did not finish", id)
+		return Run{}
+	}
+
+	if resp, _ := post(planning, "", "00", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned push = %d, want 401", resp.StatusCode)
+	}
+
+	resp, out := post(planning, "", sign(payload), "once")
+	if resp.StatusCode != http.StatusAccepted || out["status_url"] != "/runs/"+out["run_id"] {
+		t.Fatalf("push = %d %v", resp.StatusCode, out)
+	}
+	run := wait(planning, out["run_id"])
+	if run.Status != RunSucceeded || run.Output != "plan of abc123" || run.Jobs[0] != "web" || run.Repo != "https://git.example/org/packs.git" {
+		t.Errorf("plan run = %+v", run)
+	}
+	if resp, _ := post(planning, "", sign(payload), "once"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("replayed push = %d, want 409", resp.StatusCode)
+	}
+	for _, token := range []string{"", "wrong"} {
+		if resp := get(planning, out["run_id"], token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("run queried with %q = %d, want 401", token, resp.StatusCode)
+		}
+	}
+
+	if resp, _ := post(planning, "?mode=apply", sign(payload), ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("raising the mode = %d, want 403", resp.StatusCode)
+	}
+	_, out = post(applying, "", sign(payload), "")
+	if run := wait(applying, out["run_id"]); run.Status != RunFailed || run.Error != "web: exit status 1" {
+		t.Errorf("apply run = %+v", run)
+	}
+	_, out = post(applying, "?mode=plan", sign(payload), "")
+	if run := wait(applying, out["run_id"]); run.Mode != ModePlan || run.Status != RunSucceeded {
+		t.Errorf("lowered run = %+v", run)
+	}
+
+	if resp, _ := post(planning, "?mode=destroy", sign(payload), ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown mode = %d, want 400", resp.StatusCode)
+	}
+	if resp := get(planning, "nope", string(secret)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown run = %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerQueueFull(t *testing.T) {
+	// Never started, so nothing leaves the queue
+	h := &Handler{Secret: secret, DefaultMode: ModePlan}
+	post := func(delivery string) int {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(payload))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-GitHub-Delivery", delivery)
+		req.Header.Set("X-Hub-Signature-256", "sha256="+sign(payload))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i := 0; i < keepRuns; i++ {
+		if code := post(fmt.Sprintf("delivery-%d", i)); code != http.StatusAccepted {
+			t.Fatalf("push %d = %d", i, code)
+		}
+	}
+	if code := post("late"); code != http.StatusServiceUnavailable {
+		t.Errorf("push to a full queue = %d, want 503", code)
+	}
+	if code := post("late"); code != http.StatusServiceUnavailable {
+		t.Errorf("redelivered push = %d, want it taken again rather than 409", code)
+	}
+}
@@ -0,0 +1,39 @@
+// Package packtest runs the test cases of a pack from Go tests, so a pack
+// repository can check its templates in CI with `go test`:
+//
+//	var update = flag.Bool("update", false, "rewrite the goldens")
+//
+//	func TestPack(t *testing.T) {
+//		packtest.Run(t, ".", *update)
+//	}
+//
+// See engine.TestPack for how cases are laid out.
+package packtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Vaelatern/nomad-declarative/engine"
+)
+
+// Run runs every case of the pack at packDir as a subtest, failing those
+// that do not render their goldens. With update, the goldens are written
+// instead.
+func Run(t *testing.T, packDir string, update bool) {
+	t.Helper()
+	cases, err := engine.New(engine.Options{}).TestPack(context.Background(), packDir, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if c.Err != nil {
+				t.Fatal(c.Err)
+			}
+			if !c.Passed() {
+				t.Errorf("rendered output differs from the goldens:\n%s", c.Diff())
+			}
+		})
+	}
+}
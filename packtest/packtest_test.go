@@ -0,0 +1,32 @@
+package packtest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	pack := filepath.Join(t.TempDir(), "web")
+	for name, contents := range map[string]string{
+		"templates/web.nomad.tpl": "job \"[[ .JobName ]]\" {\ndatacenters=[\"[[ .Args.dc ]]\"]\n}\n",
+		"tests/basic.toml":        "dc = \"east\"\n",
+	} {
+		p := filepath.Join(pack, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Run(t, pack, true)
+	golden, err := os.ReadFile(filepath.Join(pack, "tests", "basic", "web.nomad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "job \"basic\" {\n  datacenters = [\"east\"]\n}\n"; string(golden) != want {
+		t.Errorf("golden = %q, want %q", golden, want)
+	}
+	Run(t, pack, false)
+}